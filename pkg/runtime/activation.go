@@ -0,0 +1,69 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+// (SD_LISTEN_FDS_START). Swapped in tests.
+var listenFDsStart = 3
+
+// activatedListener returns the listener passed by systemd socket
+// activation (LISTEN_PID/LISTEN_FDS), or nil if there is none for this
+// process. As with sd_listen_fds, LISTEN_PID must name this process, so
+// descriptors inherited from a parent are never adopted. Only the first
+// socket is used. The variables are unset so child processes do not adopt
+// the socket too.
+func activatedListener() (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("runtime: socket activation: invalid LISTEN_FDS %q", fds)
+	}
+
+	f := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_"+strconv.Itoa(listenFDsStart))
+	defer f.Close() // FileListener holds its own duplicate
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("runtime: socket activation: fd %d: %w", listenFDsStart, err)
+	}
+	return ln, nil
+}
+
+// listen binds the service listener: the socket-activated one if enabled
+// and present, otherwise Address:Port using ListenConfig.
+func (s *MeshService) listen(ctx context.Context) (net.Listener, error) {
+	if s.opts.SocketActivation {
+		ln, err := activatedListener()
+		if err != nil {
+			return nil, err
+		}
+		if ln != nil {
+			s.logger.Info("using socket-activated listener", "addr", ln.Addr().String())
+			return ln, nil
+		}
+		s.logger.Info("no socket passed by the service manager; binding normally")
+	}
+
+	lc := s.opts.ListenConfig
+	if lc == nil {
+		lc = &net.ListenConfig{}
+	}
+	addr := net.JoinHostPort(s.opts.Address, strconv.Itoa(s.opts.Port))
+	ln, err := lc.Listen(ctx, s.opts.Network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("runtime: listen %s: %w", addr, err)
+	}
+	return ln, nil
+}
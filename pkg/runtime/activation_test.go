@@ -0,0 +1,96 @@
+//go:build unix
+
+package runtime
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// inheritSocket simulates a socket passed by systemd: it prepares a
+// listener and exposes a duplicate of its descriptor as the first
+// activated fd.
+func inheritSocket(t *testing.T) (addr string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := listenFDsStart
+	listenFDsStart = fd
+	t.Cleanup(func() { listenFDsStart = orig })
+	return ln.Addr().String()
+}
+
+func TestSocketActivation(t *testing.T) {
+	tests := []struct {
+		name      string
+		pid       string // LISTEN_PID; "self" = this process
+		wantAdopt bool
+	}{
+		{name: "adopts inherited socket", pid: "self", wantAdopt: true},
+		{name: "no LISTEN_PID", pid: "", wantAdopt: false},
+		{name: "meant for another process", pid: "1", wantAdopt: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inherited := inheritSocket(t)
+			if !tt.wantAdopt {
+				defer syscall.Close(listenFDsStart)
+			}
+			pid := tt.pid
+			if pid == "self" {
+				pid = strconv.Itoa(os.Getpid())
+			}
+			t.Setenv("LISTEN_PID", pid)
+			t.Setenv("LISTEN_FDS", "1")
+
+			svc, err := New(
+				WithServiceName("activated"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithSocketActivation(true),
+				WithAutoRegister(false),
+				WithHeartbeat(false),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			addr, _ := runService(t, svc)
+			if got := addr == inherited; got != tt.wantAdopt {
+				t.Fatalf("bound %s, inherited %s; want adopted = %v", addr, inherited, tt.wantAdopt)
+			}
+			if tt.wantAdopt && os.Getenv("LISTEN_FDS") != "" {
+				t.Fatal("LISTEN_FDS left set for child processes")
+			}
+
+			resp, err := http.Get("http://" + addr + "/health")
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("health = %d, want 200", resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// interfaceAddrs lists the host's interface addresses. Swapped in tests.
+var interfaceAddrs = net.InterfaceAddrs
+
+// AddressFamily selects the IP family of an auto-detected advertised
+// address.
+type AddressFamily string
+
+const (
+	FamilyAuto AddressFamily = "auto" // the listen network's family; for "tcp", IPv4 first, then IPv6
+	FamilyIPv4 AddressFamily = "ipv4"
+	FamilyIPv6 AddressFamily = "ipv6"
+)
+
+// detectNetwork returns the network whose family detectAddress should pick
+// from: the one family requires, or the listen network for FamilyAuto.
+func detectNetwork(network string, family AddressFamily) string {
+	switch family {
+	case FamilyIPv4:
+		return "tcp4"
+	case FamilyIPv6:
+		return "tcp6"
+	}
+	return network
+}
+
+// isUnspecified reports whether host is a wildcard bind address such as
+// "0.0.0.0" or "::", which is meaningless to advertise.
+func isUnspecified(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
+
+// detectAddress picks an address to advertise from the host's interfaces,
+// restricted to the family implied by network ("tcp4", "tcp6", or "tcp").
+// Global unicast addresses are preferred, IPv4 first for "tcp"; if none
+// exist the loopback address of the family is returned.
+func detectAddress(network string) (string, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("runtime: list interface addresses: %w", err)
+	}
+
+	var v4, v6 net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			if v4 == nil {
+				v4 = ip4
+			}
+		} else if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+
+	switch network {
+	case "tcp4":
+		if v4 != nil {
+			return v4.String(), nil
+		}
+		return "127.0.0.1", nil
+	case "tcp6":
+		if v6 != nil {
+			return v6.String(), nil
+		}
+		return "::1", nil
+	default:
+		if v4 != nil {
+			return v4.String(), nil
+		}
+		if v6 != nil {
+			return v6.String(), nil
+		}
+		return "127.0.0.1", nil
+	}
+}
+
+// checkAdvertisedHost warns when the advertised address is a host name
+// that the configured Resolver cannot resolve, as peers probably cannot
+// either. It does nothing without a Resolver, so start makes no DNS
+// queries by default; with split-horizon DNS a failure may be expected,
+// so it is not an error.
+func (s *MeshService) checkAdvertisedHost(ctx context.Context) {
+	r := s.opts.Resolver
+	if r == nil || net.ParseIP(s.advertisedAddr) != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.opts.HealthTimeout)
+	defer cancel()
+	if _, err := r.LookupHost(ctx, s.advertisedAddr); err != nil {
+		s.logger.Warn("advertised host does not resolve", "host", s.advertisedAddr, "error", err)
+	}
+}
+
+// expandAdvertiseTemplate resolves an AdvertisedAddressTemplate such as
+// "${HOST_IP}:{port}": environment variables are interpolated and {port}
+// becomes the bound port. The result is a host, optionally with a port
+// that overrides the bound one; 0 means none was given. Unset variables
+// are an error rather than silently advertising a broken address.
+func expandAdvertiseTemplate(tmpl string, boundPort int) (host string, port int, err error) {
+	var missing []string
+	s := os.Expand(tmpl, func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", 0, fmt.Errorf("runtime: advertised address template %q: unset environment variables: %s",
+			tmpl, strings.Join(missing, ", "))
+	}
+	s = strings.ReplaceAll(s, "{port}", strconv.Itoa(boundPort))
+
+	host = s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		if port, err = strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+			return "", 0, fmt.Errorf("runtime: advertised address template %q: invalid port %q", tmpl, p)
+		}
+		host = h
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("runtime: advertised address template %q expands to an empty host", tmpl)
+	}
+	return host, port, nil
+}
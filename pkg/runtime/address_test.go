@@ -0,0 +1,275 @@
+package runtime
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectAddress(t *testing.T) {
+	ipNet := func(s string) net.Addr { return &net.IPNet{IP: net.ParseIP(s)} }
+
+	tests := []struct {
+		name    string
+		addrs   []net.Addr
+		network string
+		want    string
+	}{
+		{"tcp prefers ipv4", []net.Addr{ipNet("2001:db8::1"), ipNet("10.0.0.5")}, "tcp", "10.0.0.5"},
+		{"tcp falls back to ipv6", []net.Addr{ipNet("2001:db8::1")}, "tcp", "2001:db8::1"},
+		{"tcp6 picks ipv6", []net.Addr{ipNet("10.0.0.5"), ipNet("2001:db8::1")}, "tcp6", "2001:db8::1"},
+		{"tcp4 picks ipv4", []net.Addr{ipNet("2001:db8::1"), ipNet("10.0.0.5")}, "tcp4", "10.0.0.5"},
+		{"skips loopback and link-local", []net.Addr{ipNet("127.0.0.1"), ipNet("fe80::1"), ipNet("192.168.1.2")}, "tcp", "192.168.1.2"},
+		{"tcp4 loopback fallback", []net.Addr{ipNet("127.0.0.1")}, "tcp4", "127.0.0.1"},
+		{"tcp6 loopback fallback", []net.Addr{ipNet("10.0.0.5")}, "tcp6", "::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := interfaceAddrs
+			interfaceAddrs = func() ([]net.Addr, error) { return tt.addrs, nil }
+			defer func() { interfaceAddrs = orig }()
+
+			got, err := detectAddress(tt.network)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("detectAddress(%q) = %q, want %q", tt.network, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUnspecified(t *testing.T) {
+	for host, want := range map[string]bool{
+		"":          true,
+		"0.0.0.0":   true,
+		"::":        true,
+		"10.0.0.1":  false,
+		"::1":       false,
+		"localhost": false,
+	} {
+		if got := isUnspecified(host); got != want {
+			t.Errorf("isUnspecified(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestExpandAdvertiseTemplate(t *testing.T) {
+	t.Setenv("HOST_IP", "10.1.2.3")
+	t.Setenv("NODE_PORT", "31000")
+
+	tests := []struct {
+		tmpl     string
+		wantHost string
+		wantPort int
+		wantErr  string
+	}{
+		{tmpl: "${HOST_IP}:{port}", wantHost: "10.1.2.3", wantPort: 8080},
+		{tmpl: "$HOST_IP", wantHost: "10.1.2.3"},
+		{tmpl: "${HOST_IP}:${NODE_PORT}", wantHost: "10.1.2.3", wantPort: 31000},
+		{tmpl: "svc-{port}.internal", wantHost: "svc-8080.internal"},
+		{tmpl: "[2001:db8::1]:{port}", wantHost: "2001:db8::1", wantPort: 8080},
+		{tmpl: "${POD_IP}:{port}", wantErr: "POD_IP"},
+		{tmpl: "${HOST_IP}:http", wantErr: "invalid port"},
+		{tmpl: ":{port}", wantErr: "empty host"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			host, port, err := expandAdvertiseTemplate(tt.tmpl, 8080)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.wantHost || port != tt.wantPort {
+				t.Fatalf("got %s, %d; want %s, %d", host, port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestAdvertisedAddressTemplate(t *testing.T) {
+	t.Setenv("HOST_IP", "10.1.2.3")
+	fd := startFakeDiscovery(t)
+	svc, err := New(
+		WithServiceName("templated"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAdvertisedAddressTemplate("${HOST_IP}:{port}"),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, _ := runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) > 0 })
+
+	_, port, _ := net.SplitHostPort(addr)
+	req := fd.Registers()[0]
+	if req.Address != "10.1.2.3" || strconv.Itoa(int(req.Port)) != port {
+		t.Fatalf("advertised %s:%d, want 10.1.2.3:%s", req.Address, req.Port, port)
+	}
+}
+
+func TestAdvertisedEndpoint(t *testing.T) {
+	orig := interfaceAddrs
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.ParseIP("10.9.9.9")}}, nil
+	}
+	t.Cleanup(func() { interfaceAddrs = orig })
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		wantHost string
+		wantPort int // 0 = the bound port
+	}{
+		{
+			name:     "hostname with ephemeral bind",
+			opts:     []Option{WithAddress("127.0.0.1"), WithAdvertisedAddress("orders.svc.internal")},
+			wantHost: "orders.svc.internal",
+		},
+		{
+			name:     "hostname with explicit port",
+			opts:     []Option{WithAddress("127.0.0.1"), WithAdvertisedAddress("orders.svc.internal"), WithAdvertisedPort(443)},
+			wantHost: "orders.svc.internal",
+			wantPort: 443,
+		},
+		{
+			name:     "wildcard bind with explicit port",
+			opts:     []Option{WithAddress("0.0.0.0"), WithAdvertisedPort(8443)},
+			wantHost: "10.9.9.9",
+			wantPort: 8443,
+		},
+		{
+			name:     "template port beats explicit port",
+			opts:     []Option{WithAddress("127.0.0.1"), WithAdvertisedPort(443), WithAdvertisedAddressTemplate("orders.svc.internal:9000")},
+			wantHost: "orders.svc.internal",
+			wantPort: 9000,
+		},
+		{
+			name:     "wildcard from template",
+			opts:     []Option{WithAddress("127.0.0.1"), WithAdvertisedAddressTemplate("0.0.0.0:{port}")},
+			wantHost: "10.9.9.9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			opts := append([]Option{
+				WithServiceName("advertised"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHeartbeat(false),
+			}, tt.opts...)
+			svc, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			addr, _ := runService(t, svc)
+			waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) > 0 })
+
+			wantPort := tt.wantPort
+			if wantPort == 0 {
+				_, port, _ := net.SplitHostPort(addr)
+				wantPort, _ = strconv.Atoi(port)
+			}
+			req := fd.Registers()[0]
+			if req.Address != tt.wantHost || int(req.Port) != wantPort {
+				t.Fatalf("advertised %s:%d, want %s:%d", req.Address, req.Port, tt.wantHost, wantPort)
+			}
+		})
+	}
+
+	if _, err := New(WithAdvertisedPort(70000)); err == nil {
+		t.Fatal("New accepted advertised port 70000")
+	}
+}
+
+func TestAdvertisedAddressTemplate_UnsetVariableFailsStart(t *testing.T) {
+	svc, err := New(
+		WithServiceName("templated"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAdvertisedAddressTemplate("${TOSKA_TEST_UNSET_IP}:{port}"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "TOSKA_TEST_UNSET_IP") {
+		t.Fatalf("Start = %v, want an error naming the unset variable", err)
+	}
+}
+
+func TestAdvertiseFamily(t *testing.T) {
+	orig := interfaceAddrs
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("fe80::1")},
+			&net.IPNet{IP: net.ParseIP("2001:db8::7")},
+			&net.IPNet{IP: net.ParseIP("10.0.0.7")},
+		}, nil
+	}
+	t.Cleanup(func() { interfaceAddrs = orig })
+
+	tests := []struct {
+		family  AddressFamily
+		network string
+		want    string
+		wantErr bool
+	}{
+		{family: FamilyAuto, network: "tcp", want: "10.0.0.7"},
+		{family: "", network: "tcp", want: "10.0.0.7"},
+		{family: FamilyIPv4, network: "tcp", want: "10.0.0.7"},
+		{family: FamilyIPv6, network: "tcp", want: "2001:db8::7"},
+		{family: FamilyAuto, network: "tcp6", want: "2001:db8::7"},
+		{family: FamilyIPv6, network: "tcp4", wantErr: true},
+		{family: "ipx", network: "tcp", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.family)+"/"+tt.network, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			svc, err := New(
+				WithServiceName("family"),
+				WithNetwork(tt.network),
+				WithAddress("0.0.0.0"),
+				WithPort(0),
+				WithAdvertiseFamily(tt.family),
+				WithDiscoveryAddress(fd.addr),
+				WithHeartbeat(false),
+			)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("New succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runService(t, svc)
+			waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) > 0 })
+			if got := fd.Registers()[0].Address; got != tt.want {
+				t.Fatalf("advertised %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
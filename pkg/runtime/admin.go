@@ -0,0 +1,43 @@
+package runtime
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// HandleAdmin registers an operator-facing handler, such as /metrics or
+// /debug/vars, like Handle but gated by AdminAuth. Use it for endpoints
+// that would leak internals when they share the main port.
+func (s *MeshService) HandleAdmin(pattern string, handler http.Handler) {
+	s.Handle(pattern, s.adminOnly(handler))
+}
+
+// adminOnly rejects requests that fail AdminAuth: 401 when no credentials
+// were sent, 403 when they were refused.
+func (s *MeshService) adminOnly(next http.Handler) http.Handler {
+	if s.opts.AdminAuth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.AdminAuth(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			WriteError(w, http.StatusUnauthorized, "unauthorized", "credentials required")
+			return
+		}
+		WriteError(w, http.StatusForbidden, "forbidden", "not allowed")
+	})
+}
+
+// BearerToken returns an AdminAuth check accepting requests that carry
+// "Authorization: Bearer <token>".
+func BearerToken(token string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+	}
+}
@@ -0,0 +1,149 @@
+package runtime
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	svc, err := New(WithServiceName("admin"), WithAdminAuth(BearerToken("s3cret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+	svc.HandleAdmin("GET /metrics", http.HandlerFunc(ok))
+	svc.HandleFunc("GET /orders", ok)
+	h := svc.handler()
+
+	tests := []struct {
+		name string
+		path string
+		auth string
+		want int
+	}{
+		{name: "no credentials", path: "/metrics", want: http.StatusUnauthorized},
+		{name: "wrong token", path: "/metrics", auth: "Bearer nope", want: http.StatusForbidden},
+		{name: "wrong scheme", path: "/metrics", auth: "Basic czNjcmV0", want: http.StatusForbidden},
+		{name: "authorized", path: "/metrics", auth: "Bearer s3cret", want: http.StatusOK},
+		{name: "application route", path: "/orders", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("GET %s = %d, want %d", tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPprof(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		auth string
+		want int
+	}{
+		{name: "disabled", want: http.StatusNotFound},
+		{name: "enabled", opts: []Option{WithPprof(true)}, want: http.StatusOK},
+		{name: "gated", opts: []Option{WithPprof(true), WithAdminAuth(BearerToken("s3cret"))}, want: http.StatusUnauthorized},
+		{name: "authorized", opts: []Option{WithPprof(true), WithAdminAuth(BearerToken("s3cret"))}, auth: "Bearer s3cret", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{
+				WithServiceName("profiled"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithAutoRegister(false),
+				WithHeartbeat(false),
+			}, tt.opts...)
+			svc, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr, _ := runService(t, svc)
+
+			for _, path := range []string{PprofPrefix, PprofPrefix + "cmdline", PprofPrefix + "goroutine"} {
+				req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+				if tt.auth != "" {
+					req.Header.Set("Authorization", tt.auth)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tt.want {
+					t.Fatalf("GET %s = %d, want %d", path, resp.StatusCode, tt.want)
+				}
+			}
+			for _, route := range svc.Routes() {
+				if strings.Contains(route, PprofPrefix) {
+					t.Fatalf("pprof route %q listed in Routes", route)
+				}
+			}
+		})
+	}
+
+	// Nothing leaks onto the default mux, which callers may serve ungated.
+	req := httptest.NewRequest("GET", PprofPrefix, nil)
+	if _, pattern := http.DefaultServeMux.Handler(req); pattern != "" {
+		t.Fatalf("DefaultServeMux serves %q", pattern)
+	}
+}
+
+func TestPprof_Profiles(t *testing.T) {
+	svc, err := New(
+		WithServiceName("profiled"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+		WithPprof(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := runService(t, svc)
+
+	tests := []struct {
+		path     string
+		want     int
+		wantBody string // substring; empty = any non-empty body
+	}{
+		{path: "", want: http.StatusOK, wantBody: "goroutine"},
+		{path: "heap", want: http.StatusOK},
+		{path: "goroutine?debug=1", want: http.StatusOK, wantBody: "goroutine profile"},
+		{path: "profile?seconds=0.1", want: http.StatusOK},
+		{path: "trace?seconds=0.1", want: http.StatusOK},
+		{path: "symbol", want: http.StatusOK, wantBody: "num_symbols: 1"},
+		{path: "nope", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get("http://" + addr + PprofPrefix + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if len(body) == 0 || !strings.Contains(string(body), tt.wantBody) {
+				t.Fatalf("body = %.200q, want it to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package runtime
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// slowStartFloor is the share of its weight an instance gets the moment it
+// is first seen, so a slow-starting instance still takes some traffic.
+const slowStartFloor = 0.1
+
+// balancer selects one instance from a resolved set. Strategies the client
+// cannot implement locally (LeastConnections, IPHash) fall back to
+// round-robin.
+type balancer struct {
+	strategy  LoadBalancingStrategy
+	slowStart time.Duration
+	health    HealthSource     // nil = DiscoveryHealth
+	now       func() time.Time // swapped in tests
+
+	mu     sync.Mutex
+	next   map[string]uint64               // per-service round-robin cursor
+	seen   map[string]map[string]time.Time // per-service first sighting of each instance
+	credit map[string]map[string]float64   // per-service smooth round-robin state, during slow start
+}
+
+func newBalancer(strategy LoadBalancingStrategy, slowStart time.Duration) *balancer {
+	return &balancer{
+		strategy:  strategy,
+		slowStart: slowStart,
+		now:       time.Now,
+		next:      make(map[string]uint64),
+		seen:      make(map[string]map[string]time.Time),
+		credit:    make(map[string]map[string]float64),
+	}
+}
+
+// pick returns one of instances, which must be non-empty. Only healthy
+// instances are considered, unless none is healthy, in which case all are
+// rather than failing the call. Slow start applies to every strategy: while
+// an instance is ramping, round-robin interleaves it in proportion to its
+// ramp.
+func (b *balancer) pick(service string, instances []Instance) Instance {
+	instances = b.healthy(service, instances)
+	ramp := b.ramp(service, instances)
+	if b.strategy == Random {
+		w := make([]float64, len(instances))
+		for i, inst := range instances {
+			w[i] = float64(inst.Weight()) * ramp[i]
+		}
+		return pickRandom(instances, w)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if slices.ContainsFunc(ramp, func(f float64) bool { return f < 1 }) {
+		return b.pickSmooth(service, instances, ramp)
+	}
+	delete(b.credit, service)
+	n := b.next[service]
+	b.next[service] = n + 1
+	return instances[n%uint64(len(instances))]
+}
+
+// pickSmooth is smooth weighted round-robin, as in nginx: each pick adds
+// every instance's weight to its credit, picks the instance with the most
+// credit and charges it the total, so picks interleave in proportion to
+// weight. The caller holds b.mu.
+func (b *balancer) pickSmooth(service string, instances []Instance, weights []float64) Instance {
+	prev := b.credit[service]
+	credit := make(map[string]float64, len(instances))
+	total, best := 0.0, 0
+	for i, inst := range instances {
+		credit[inst.ServiceID] = prev[inst.ServiceID] + weights[i]
+		total += weights[i]
+		if credit[inst.ServiceID] > credit[instances[best].ServiceID] {
+			best = i
+		}
+	}
+	credit[instances[best].ServiceID] -= total
+	// Replacing the map forgets instances that have gone away.
+	b.credit[service] = credit
+	return instances[best]
+}
+
+// healthy returns the instances the health source accepts, or all of them
+// if it accepts none.
+func (b *balancer) healthy(service string, instances []Instance) []Instance {
+	health := b.health
+	if health == nil {
+		health = DiscoveryHealth
+	}
+	ok := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		if health.Healthy(service, inst) {
+			ok = append(ok, inst)
+		}
+	}
+	if len(ok) == 0 {
+		return instances
+	}
+	return ok
+}
+
+// ramp returns the share of its weight each instance gets. During slow
+// start it ramps linearly from slowStartFloor to 1 over the window after
+// the balancer first saw the instance; otherwise it is 1.
+func (b *balancer) ramp(service string, instances []Instance) []float64 {
+	w := make([]float64, len(instances))
+	for i := range w {
+		w[i] = 1
+	}
+	if b.slowStart <= 0 {
+		return w
+	}
+
+	now := b.now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prev := b.seen[service]
+	seen := make(map[string]time.Time, len(instances))
+	for i, inst := range instances {
+		first, ok := prev[inst.ServiceID]
+		if !ok {
+			first = now
+		}
+		seen[inst.ServiceID] = first
+		if age := now.Sub(first); age < b.slowStart {
+			w[i] *= max(float64(age)/float64(b.slowStart), slowStartFloor)
+		}
+	}
+	// Replacing the map forgets instances that have gone away.
+	b.seen[service] = seen
+	return w
+}
+
+// pickRandom selects an instance with probability proportional to its
+// weight.
+func pickRandom(instances []Instance, weights []float64) Instance {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	n := rand.Float64() * total
+	for i, w := range weights {
+		if n -= w; n < 0 {
+			return instances[i]
+		}
+	}
+	return instances[len(instances)-1]
+}
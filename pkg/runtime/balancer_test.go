@@ -0,0 +1,154 @@
+package runtime
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+)
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b := newBalancer(RoundRobin, 0)
+	instances := []Instance{{ServiceID: "a"}, {ServiceID: "b"}, {ServiceID: "c"}}
+
+	var got []string
+	for range 6 {
+		got = append(got, b.pick("svc", instances).ServiceID)
+	}
+
+	want := []string{"a", "b", "c", "a", "b", "c"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("pick sequence = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBalancer_RoundRobinPerService(t *testing.T) {
+	b := newBalancer(RoundRobin, 0)
+	instances := []Instance{{ServiceID: "a"}, {ServiceID: "b"}}
+
+	b.pick("one", instances)
+	if got := b.pick("two", instances).ServiceID; got != "a" {
+		t.Fatalf("expected independent cursor per service, got %q", got)
+	}
+}
+
+func TestBalancer_RandomStaysInRange(t *testing.T) {
+	b := newBalancer(Random, 0)
+	instances := []Instance{{ServiceID: "a"}, {ServiceID: "b"}}
+
+	seen := map[string]bool{}
+	for range 100 {
+		seen[b.pick("svc", instances).ServiceID] = true
+	}
+	if !seen["a"] || !seen["b"] || len(seen) != 2 {
+		t.Fatalf("unexpected picks %v", seen)
+	}
+}
+
+func TestBalancer_RandomSkipsUnhealthy(t *testing.T) {
+	b := newBalancer(Random, 0)
+	instances := []Instance{
+		{ServiceID: "up", Status: pb.HealthStatus_HEALTH_STATUS_HEALTHY},
+		{ServiceID: "down", Status: pb.HealthStatus_HEALTH_STATUS_UNHEALTHY},
+		{ServiceID: "new", Status: pb.HealthStatus_HEALTH_STATUS_UNKNOWN},
+	}
+
+	for range 1000 {
+		if got := b.pick("svc", instances).ServiceID; got == "down" {
+			t.Fatal("picked an unhealthy instance")
+		}
+	}
+}
+
+func TestBalancer_RandomAllUnhealthy(t *testing.T) {
+	b := newBalancer(Random, 0)
+	instances := []Instance{{ServiceID: "a", Status: pb.HealthStatus_HEALTH_STATUS_UNHEALTHY}}
+
+	if got := b.pick("svc", instances).ServiceID; got != "a" {
+		t.Fatalf("pick = %q, want fallback to a", got)
+	}
+}
+
+func TestBalancer_RandomWeighted(t *testing.T) {
+	b := newBalancer(Random, 0)
+	instances := []Instance{
+		{ServiceID: "light", Metadata: map[string]string{"weight": "1"}},
+		{ServiceID: "heavy", Metadata: map[string]string{"weight": "3"}},
+	}
+
+	const samples = 20000
+	counts := map[string]int{}
+	for range samples {
+		counts[b.pick("svc", instances).ServiceID]++
+	}
+
+	if got := float64(counts["heavy"]) / samples; math.Abs(got-0.75) > 0.03 {
+		t.Fatalf("heavy share = %.3f, want ~0.75 (counts %v)", got, counts)
+	}
+}
+
+func TestBalancer_SlowStart(t *testing.T) {
+	b := newBalancer(Random, 10*time.Second)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	b.pick("svc", []Instance{{ServiceID: "old"}})
+	now = now.Add(time.Minute)
+	instances := []Instance{{ServiceID: "old"}, {ServiceID: "new"}}
+
+	newShare := func() float64 {
+		const samples = 10000
+		n := 0
+		for range samples {
+			if b.pick("svc", instances).ServiceID == "new" {
+				n++
+			}
+		}
+		return float64(n) / samples
+	}
+
+	// Just discovered: weight is slowStartFloor of old's, ~9% of traffic.
+	if got := newShare(); got > 0.15 {
+		t.Fatalf("new instance share = %.3f right after discovery, want ~0.09", got)
+	}
+	now = now.Add(10 * time.Second)
+	if got := newShare(); math.Abs(got-0.5) > 0.03 {
+		t.Fatalf("new instance share = %.3f after slow start, want ~0.5", got)
+	}
+}
+
+func TestBalancer_SlowStartRoundRobin(t *testing.T) {
+	b := newBalancer(DefaultClientOptions().Strategy, 10*time.Second)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	b.pick("svc", []Instance{{ServiceID: "old"}})
+	now = now.Add(time.Minute)
+	instances := []Instance{{ServiceID: "old"}, {ServiceID: "new"}}
+
+	newPicks := func(n int) int {
+		got := 0
+		for range n {
+			if b.pick("svc", instances).ServiceID == "new" {
+				got++
+			}
+		}
+		return got
+	}
+
+	// Just discovered: ramp is slowStartFloor, so 1 pick in 11.
+	if got := newPicks(110); got < 9 || got > 11 {
+		t.Fatalf("new instance got %d of 110 picks right after discovery, want ~10", got)
+	}
+	now = now.Add(5 * time.Second)
+	if got := newPicks(150); got < 48 || got > 52 {
+		t.Fatalf("new instance got %d of 150 picks half-way through, want ~50", got)
+	}
+	now = now.Add(5 * time.Second)
+	if got := newPicks(100); got != 50 {
+		t.Fatalf("new instance got %d of 100 picks after slow start, want 50", got)
+	}
+}
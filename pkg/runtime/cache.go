@@ -0,0 +1,95 @@
+package runtime
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Cache holds resolved instances per service so Clients making many calls
+// do not ask Discovery every time. One Cache may be shared by several
+// Clients via WithClientCache. It is safe for concurrent use.
+type Cache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time // swapped in tests
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	instances []Instance
+	expires   time.Time
+}
+
+// CacheStats counts cache lookups.
+type CacheStats struct {
+	Hits         uint64 // lookups answered from a cached instance list
+	NegativeHits uint64 // lookups answered from a cached "no instances"
+	Misses       uint64 // lookups that went to Discovery
+	Entries      int    // services currently cached, including expired ones
+}
+
+// NewCache creates a Cache that keeps instance lists for ttl and, if
+// negativeTTL is positive, remembers services with no instances for
+// negativeTTL.
+func NewCache(ttl, negativeTTL time.Duration) *Cache {
+	return &Cache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     make(map[string]cacheEntry),
+	}
+}
+
+// get returns the cached instances of service, if fresh.
+func (c *Cache) get(service string) ([]Instance, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[service]
+	if !ok || !c.now().Before(e.expires) {
+		c.stats.Misses++
+		return nil, false
+	}
+	if len(e.instances) == 0 {
+		c.stats.NegativeHits++
+	} else {
+		c.stats.Hits++
+	}
+	return slices.Clone(e.instances), true
+}
+
+// put records instances freshly resolved from Discovery.
+func (c *Cache) put(service string, instances []Instance) {
+	ttl := c.ttl
+	if len(instances) == 0 {
+		ttl = c.negativeTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl <= 0 {
+		delete(c.entries, service)
+		return
+	}
+	c.entries[service] = cacheEntry{instances: slices.Clone(instances), expires: c.now().Add(ttl)}
+}
+
+// Invalidate drops service from the cache, so the next lookup goes to
+// Discovery. Use it after a call to a cached instance fails.
+func (c *Cache) Invalidate(service string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, service)
+}
+
+// Stats returns the lookup counters.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Entries = len(c.entries)
+	return st
+}
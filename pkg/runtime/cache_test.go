@@ -0,0 +1,94 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+)
+
+func TestCache(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	fd.addInstance(&pb.ServiceInstance{ServiceName: "orders", ServiceId: "orders-1"})
+
+	now := time.Unix(1000, 0)
+	cache := NewCache(10*time.Second, 2*time.Second)
+	cache.now = func() time.Time { return now }
+
+	c, err := NewClient(WithClientDiscoveryAddress(fd.addr), WithClientCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Each step resolves "orders" after adjusting Discovery and the clock.
+	steps := []struct {
+		name      string
+		setup     func()
+		wantCount int
+		wantStats CacheStats
+	}{
+		{name: "cold miss", wantCount: 1, wantStats: CacheStats{Misses: 1, Entries: 1}},
+		{
+			name:      "hit despite Discovery change",
+			setup:     func() { fd.removeInstance("orders-1") },
+			wantCount: 1,
+			wantStats: CacheStats{Hits: 1, Misses: 1, Entries: 1},
+		},
+		{
+			name:      "TTL expiry",
+			setup:     func() { now = now.Add(10 * time.Second) },
+			wantCount: 0,
+			wantStats: CacheStats{Hits: 1, Misses: 2, Entries: 1},
+		},
+		{
+			name: "negative hit",
+			setup: func() {
+				fd.addInstance(&pb.ServiceInstance{ServiceName: "orders", ServiceId: "orders-2"})
+				now = now.Add(time.Second)
+			},
+			wantCount: 0,
+			wantStats: CacheStats{Hits: 1, NegativeHits: 1, Misses: 2, Entries: 1},
+		},
+		{
+			name:      "negative TTL expiry",
+			setup:     func() { now = now.Add(time.Second) },
+			wantCount: 1,
+			wantStats: CacheStats{Hits: 1, NegativeHits: 1, Misses: 3, Entries: 1},
+		},
+		{
+			name:      "invalidate",
+			setup:     func() { fd.removeInstance("orders-2"); cache.Invalidate("orders") },
+			wantCount: 0,
+			wantStats: CacheStats{Hits: 1, NegativeHits: 1, Misses: 4, Entries: 1},
+		},
+	}
+
+	for _, st := range steps {
+		if st.setup != nil {
+			st.setup()
+		}
+		instances, err := c.Resolve(context.Background(), "orders")
+		if err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		if len(instances) != st.wantCount {
+			t.Fatalf("%s: got %d instances, want %d", st.name, len(instances), st.wantCount)
+		}
+		if got := cache.Stats(); got != st.wantStats {
+			t.Fatalf("%s: stats = %+v, want %+v", st.name, got, st.wantStats)
+		}
+	}
+}
+
+func TestCache_NoNegativeCaching(t *testing.T) {
+	cache := NewCache(time.Minute, 0)
+	cache.put("orders", nil)
+	if _, ok := cache.get("orders"); ok {
+		t.Fatal("empty result cached with negative caching off")
+	}
+	if st := cache.Stats(); st.Entries != 0 || st.Misses != 1 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
@@ -0,0 +1,483 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// ErrNoInstances is returned when Discovery knows no instances of a service.
+var ErrNoInstances = errors.New("runtime: no instances available")
+
+// Instance is a service instance resolved from Discovery.
+//
+// Instances registered by older SDKs or other tools may lack some of the
+// routing metadata this package writes. Missing or malformed keys never
+// make an instance unroutable; the accessors fall back to defaults:
+// "scheme" to http, "weight" to 1 and "lb_strategy" to RoundRobin.
+type Instance struct {
+	ServiceName string
+	ServiceID   string
+	Address     string
+	Port        int
+	Status      pb.HealthStatus
+	Metadata    map[string]string
+}
+
+// URL returns an absolute URL for path on this instance, using the scheme
+// from its metadata (default "http"). IPv6 addresses are bracketed.
+func (i Instance) URL(path string) string {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return i.scheme() + "://" + i.HostPort() + path
+}
+
+// HostPort returns the instance's address and port joined as host:port.
+func (i Instance) HostPort() string {
+	return net.JoinHostPort(i.Address, strconv.Itoa(i.Port))
+}
+
+// Weight returns the advertised routing weight, or 1 when the metadata key
+// is absent, malformed, or not positive.
+func (i Instance) Weight() int {
+	w, err := strconv.Atoi(i.Metadata["weight"])
+	if err != nil || w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// ZoneWeights returns the advertised per-zone weights, or nil when the
+// instance advertises none or the metadata is malformed.
+func (i Instance) ZoneWeights() map[string]int {
+	raw := i.Metadata["zone_weights"]
+	if raw == "" {
+		return nil
+	}
+	var zw map[string]int
+	if err := json.Unmarshal([]byte(raw), &zw); err != nil {
+		return nil
+	}
+	return zw
+}
+
+// MetadataList returns the comma-separated list stored under key, as
+// written by WithMetadataList. It returns nil when key is absent.
+func (i Instance) MetadataList(key string) []string {
+	return splitMetadataList(i.Metadata[key])
+}
+
+// HasMetadataValue reports whether value is one of the list entries under
+// key. Use it to select instances by tag.
+func (i Instance) HasMetadataValue(key, value string) bool {
+	return slices.Contains(i.MetadataList(key), value)
+}
+
+func splitMetadataList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	list := strings.Split(s, ",")
+	for i := range list {
+		list[i] = strings.TrimSpace(list[i])
+	}
+	return list
+}
+
+// Strategy returns the advertised load balancing strategy, or RoundRobin
+// when the metadata key is absent or not a known strategy.
+func (i Instance) Strategy() LoadBalancingStrategy {
+	switch s := LoadBalancingStrategy(strings.TrimSpace(i.Metadata["lb_strategy"])); s {
+	case RoundRobin, LeastConnections, Random, WeightedRoundRobin, IPHash:
+		return s
+	}
+	return RoundRobin
+}
+
+// IsHealthy reports whether Discovery considers the instance able to take
+// traffic. Instances not yet checked (UNKNOWN) are given the benefit of the
+// doubt.
+func (i Instance) IsHealthy() bool {
+	switch i.Status {
+	case pb.HealthStatus_HEALTH_STATUS_HEALTHY, pb.HealthStatus_HEALTH_STATUS_UNKNOWN:
+		return true
+	}
+	return false
+}
+
+// scheme returns the advertised URL scheme, lower-cased, or "http" when
+// the metadata key is absent or blank.
+func (i Instance) scheme() string {
+	if s := strings.ToLower(strings.TrimSpace(i.Metadata["scheme"])); s != "" {
+		return s
+	}
+	return "http"
+}
+
+func instanceFromProto(si *pb.ServiceInstance) Instance {
+	return Instance{
+		ServiceName: si.GetServiceName(),
+		ServiceID:   si.GetServiceId(),
+		Address:     si.GetAddress(),
+		Port:        int(si.GetPort()),
+		Status:      si.GetStatus(),
+		Metadata:    si.GetMetadata(),
+	}
+}
+
+// ClientOptions configures a Client.
+type ClientOptions struct {
+	DiscoveryAddress string                // gRPC address of discovery service. Default: "localhost:8080".
+	Strategy         LoadBalancingStrategy // Instance selection strategy. Default: RoundRobin.
+	RefreshInterval  time.Duration         // Poll period for watched services. Default: 10s.
+	Logger           *slog.Logger          // Default: slog.Default().
+
+	// SlowStart ramps the share of traffic sent to an instance over this
+	// long after the client first sees it, whatever the Strategy. 0 = off.
+	SlowStart time.Duration
+
+	// StaticFallback holds seed instances per service, returned by Resolve
+	// when Discovery cannot be reached.
+	StaticFallback map[string][]Instance
+
+	Cache *Cache // Consulted by Resolve before Discovery. nil = no caching.
+
+	// ResolveWait makes Resolve, ResolveFiltered and Pick keep polling
+	// Discovery for up to this long when a service has no instances, e.g.
+	// during a rollout gap. Polls back off from 50ms to RefreshInterval and
+	// bypass the Cache. 0 = return the empty answer immediately.
+	ResolveWait time.Duration
+
+	// Resolver resolves the Discovery host name instead of gRPC's built-in
+	// DNS resolver. nil = the system resolver.
+	Resolver *net.Resolver
+
+	// Outliers receives call outcomes from ReportResult and the reverse
+	// proxy. nil = NewOutlierDetector(5, 30*time.Second).
+	Outliers *OutlierDetector
+
+	// HealthSource decides which instances Pick may choose; if it rejects
+	// all of them, all are used. nil = AllHealthy(DiscoveryHealth, Outliers).
+	HealthSource HealthSource
+
+	// RequestModifiers run, in order, on each request the reverse proxy
+	// sends, before an instance is picked. See RequestModifier.
+	RequestModifiers []RequestModifier
+
+	// MaxRetries is how many times the reverse proxy retries an idempotent
+	// request on another pick after a connection error or a 502, 503 or
+	// 504. Default: 0.
+	MaxRetries int
+
+	// RetryBudget limits retries across all requests to this fraction of
+	// successful ones (0.2 = one retry per five successes), with a reserve
+	// of 10 for bursts. Once it is spent, failures are returned without
+	// retrying. 0 = no limit beyond MaxRetries.
+	RetryBudget float64
+}
+
+// RequestModifier decorates an outbound request, e.g. with an auth header
+// or tenant ID taken from ctx, the context of the request being proxied.
+// Returning an error aborts the call; the reverse proxy then answers 502.
+type RequestModifier func(ctx context.Context, req *http.Request) error
+
+// ClientOption is a functional option for configuring a Client.
+type ClientOption func(*ClientOptions)
+
+// DefaultClientOptions returns ClientOptions with sensible defaults.
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		DiscoveryAddress: "localhost:8080",
+		Strategy:         RoundRobin,
+		RefreshInterval:  10 * time.Second,
+	}
+}
+
+func WithClientDiscoveryAddress(addr string) ClientOption {
+	return func(o *ClientOptions) { o.DiscoveryAddress = addr }
+}
+
+func WithClientStrategy(s LoadBalancingStrategy) ClientOption {
+	return func(o *ClientOptions) { o.Strategy = s }
+}
+
+func WithClientRefreshInterval(d time.Duration) ClientOption {
+	return func(o *ClientOptions) { o.RefreshInterval = d }
+}
+
+func WithClientLogger(l *slog.Logger) ClientOption {
+	return func(o *ClientOptions) { o.Logger = l }
+}
+
+func WithClientSlowStart(d time.Duration) ClientOption {
+	return func(o *ClientOptions) { o.SlowStart = d }
+}
+
+func WithClientCache(c *Cache) ClientOption {
+	return func(o *ClientOptions) { o.Cache = c }
+}
+
+func WithResolveWait(d time.Duration) ClientOption {
+	return func(o *ClientOptions) { o.ResolveWait = d }
+}
+
+func WithClientOutlierDetector(d *OutlierDetector) ClientOption {
+	return func(o *ClientOptions) { o.Outliers = d }
+}
+
+func WithClientHealthSource(hs HealthSource) ClientOption {
+	return func(o *ClientOptions) { o.HealthSource = hs }
+}
+
+func WithClientResolver(r *net.Resolver) ClientOption {
+	return func(o *ClientOptions) { o.Resolver = r }
+}
+
+func WithClientRetries(n int) ClientOption {
+	return func(o *ClientOptions) { o.MaxRetries = n }
+}
+
+func WithRetryBudget(ratio float64) ClientOption {
+	return func(o *ClientOptions) { o.RetryBudget = ratio }
+}
+
+// WithClientRequestModifier adds fn to the modifiers run on each outbound
+// request, after those added before it.
+func WithClientRequestModifier(fn RequestModifier) ClientOption {
+	return func(o *ClientOptions) { o.RequestModifiers = append(o.RequestModifiers, fn) }
+}
+
+// WithStaticFallback makes Resolve return instances for service when the
+// Discovery call fails, so critical paths keep working through a Discovery
+// outage. It does not apply when Discovery answers with no instances.
+func WithStaticFallback(service string, instances []Instance) ClientOption {
+	return func(o *ClientOptions) {
+		if o.StaticFallback == nil {
+			o.StaticFallback = make(map[string][]Instance)
+		}
+		o.StaticFallback[service] = instances
+	}
+}
+
+// Client resolves mesh services through Discovery and picks an instance per
+// call using its load balancing strategy. A Client is safe for concurrent use.
+type Client struct {
+	opts      ClientOptions
+	conn      *grpc.ClientConn
+	discovery pb.DiscoveryRegistryClient
+	balancer  *balancer
+	retries   *retryBudget // nil = unlimited
+
+	mu         sync.Mutex
+	onFallback map[string]bool // services currently served from StaticFallback
+}
+
+// NewClient creates a Client with the given functional options.
+func NewClient(opts ...ClientOption) (*Client, error) {
+	o := DefaultClientOptions()
+	for _, fn := range opts {
+		fn(&o)
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	if o.Outliers == nil {
+		o.Outliers = NewOutlierDetector(5, 30*time.Second)
+	}
+	if o.HealthSource == nil {
+		o.HealthSource = AllHealthy(DiscoveryHealth, o.Outliers)
+	}
+	addr, err := normalizeDiscoveryAddress(o.DiscoveryAddress)
+	if err != nil {
+		return nil, err
+	}
+	o.DiscoveryAddress = addr
+
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUserAgent(defaultUserAgent("")),
+	}
+	if o.Resolver != nil {
+		dialOpts = append(dialOpts, resolverDialer(o.Resolver))
+	}
+	conn, err := grpc.NewClient(resolverTarget(o.DiscoveryAddress, o.Resolver), dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("runtime: connect to discovery %s: %w", o.DiscoveryAddress, err)
+	}
+
+	b := newBalancer(o.Strategy, o.SlowStart)
+	b.health = o.HealthSource
+	var retries *retryBudget
+	if o.RetryBudget > 0 {
+		retries = newRetryBudget(o.RetryBudget)
+	}
+	return &Client{
+		opts:       o,
+		conn:       conn,
+		discovery:  pb.NewDiscoveryRegistryClient(conn),
+		balancer:   b,
+		retries:    retries,
+		onFallback: make(map[string]bool),
+	}, nil
+}
+
+// Close releases the Discovery connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// InstanceFilterHeader is the gRPC request header carrying ResolveFiltered's
+// metadata filter, one "key=value" per value. Discovery may use it to
+// return only matching instances.
+const InstanceFilterHeader = "x-instance-filter"
+
+// Resolve returns all instances of service known to Discovery, or its
+// static fallback seeds if Discovery cannot be reached. With a Cache, a
+// fresh cached answer is returned without asking Discovery.
+func (c *Client) Resolve(ctx context.Context, service string) ([]Instance, error) {
+	return c.resolve(ctx, service, nil)
+}
+
+// ResolveFiltered is like Resolve but returns only instances whose metadata
+// has every key-value pair in filter. The filter is sent to Discovery in
+// InstanceFilterHeader and applied again locally, so results are the same
+// whether or not Discovery supports it.
+func (c *Client) ResolveFiltered(ctx context.Context, service string, filter map[string]string) ([]Instance, error) {
+	return c.resolve(ctx, service, filter)
+}
+
+func (c *Client) resolve(ctx context.Context, service string, filter map[string]string) ([]Instance, error) {
+	instances, err := c.resolveOnce(ctx, service, filter, true)
+	if err != nil || len(instances) > 0 || c.opts.ResolveWait <= 0 {
+		return instances, err
+	}
+	return c.awaitInstances(ctx, service, filter)
+}
+
+// awaitInstances polls Discovery until service has a matching instance or
+// ResolveWait elapses, in which case it returns the empty answer.
+func (c *Client) awaitInstances(ctx context.Context, service string, filter map[string]string) ([]Instance, error) {
+	wait := time.NewTimer(c.opts.ResolveWait)
+	defer wait.Stop()
+
+	backoff := 50 * time.Millisecond
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("runtime: resolve %s: %w", service, ctx.Err())
+		case <-wait.C:
+			return nil, nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, max(c.opts.RefreshInterval, 50*time.Millisecond))
+
+		instances, err := c.resolveOnce(ctx, service, filter, false)
+		if err != nil || len(instances) > 0 {
+			return instances, err
+		}
+	}
+}
+
+// resolveOnce asks Discovery once, consulting the Cache first if useCache.
+func (c *Client) resolveOnce(ctx context.Context, service string, filter map[string]string, useCache bool) ([]Instance, error) {
+	if c.opts.Cache != nil && useCache {
+		if instances, ok := c.opts.Cache.get(service); ok {
+			return matchMetadata(instances, filter), nil
+		}
+	}
+
+	if len(filter) > 0 {
+		for _, k := range slices.Sorted(maps.Keys(filter)) {
+			ctx = metadata.AppendToOutgoingContext(ctx, InstanceFilterHeader, k+"="+filter[k])
+		}
+	}
+	resp, err := c.discovery.GetInstances(ctx, &pb.GetInstancesRequest{ServiceName: service})
+	if err != nil {
+		if seeds, ok := c.opts.StaticFallback[service]; ok && ctx.Err() == nil {
+			c.setFallback(service, true, err)
+			return matchMetadata(slices.Clone(seeds), filter), nil
+		}
+		return nil, fmt.Errorf("runtime: resolve %s: %w", service, err)
+	}
+	c.setFallback(service, false, nil)
+
+	instances := make([]Instance, 0, len(resp.Instances))
+	for _, si := range resp.Instances {
+		instances = append(instances, instanceFromProto(si))
+	}
+	// A filtered answer may be partial, so only full ones are cached.
+	if c.opts.Cache != nil && len(filter) == 0 {
+		c.opts.Cache.put(service, instances)
+	}
+	return matchMetadata(instances, filter), nil
+}
+
+// matchMetadata removes the instances whose metadata lacks any pair in
+// filter, reusing the slice.
+func matchMetadata(instances []Instance, filter map[string]string) []Instance {
+	if len(filter) == 0 {
+		return instances
+	}
+	return slices.DeleteFunc(instances, func(i Instance) bool {
+		for k, v := range filter {
+			if got, ok := i.Metadata[k]; !ok || got != v {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// setFallback records whether service is being served from static seeds,
+// logging only on transitions.
+func (c *Client) setFallback(service string, active bool, cause error) {
+	c.mu.Lock()
+	changed := c.onFallback[service] != active
+	c.onFallback[service] = active
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+	if active {
+		c.opts.Logger.Warn("discovery unavailable, using static fallback", "service", service, "error", cause)
+	} else {
+		c.opts.Logger.Info("discovery reachable again, leaving static fallback", "service", service)
+	}
+}
+
+// ReportResult tells the client's OutlierDetector how a call to inst, an
+// instance of service, went; a nil err is a success. Callers that pick
+// instances themselves should report every call so failing instances are
+// ejected.
+func (c *Client) ReportResult(service string, inst Instance, err error) {
+	c.opts.Outliers.Observe(service, inst, err)
+}
+
+// Pick resolves service and selects one instance using the client's
+// strategy, among those its HealthSource deems healthy.
+func (c *Client) Pick(ctx context.Context, service string) (Instance, error) {
+	instances, err := c.Resolve(ctx, service)
+	if err != nil {
+		return Instance{}, err
+	}
+	if len(instances) == 0 {
+		return Instance{}, fmt.Errorf("%w: %s", ErrNoInstances, service)
+	}
+	return c.balancer.pick(service, instances), nil
+}
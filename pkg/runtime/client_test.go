@@ -0,0 +1,369 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestDefaultClientOptions(t *testing.T) {
+	o := DefaultClientOptions()
+
+	if o.DiscoveryAddress != "localhost:8080" {
+		t.Fatalf("expected DiscoveryAddress=localhost:8080, got %q", o.DiscoveryAddress)
+	}
+	if o.Strategy != RoundRobin {
+		t.Fatalf("expected Strategy=RoundRobin, got %q", o.Strategy)
+	}
+	if o.RefreshInterval != 10*time.Second {
+		t.Fatalf("expected RefreshInterval=10s, got %v", o.RefreshInterval)
+	}
+}
+
+func TestClient_Resolve(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	fd.addInstance(&pb.ServiceInstance{
+		ServiceName: "orders",
+		ServiceId:   "orders-1",
+		Address:     "10.0.0.1",
+		Port:        8080,
+		Status:      pb.HealthStatus_HEALTH_STATUS_HEALTHY,
+		Metadata:    map[string]string{"scheme": "https"},
+	})
+	fd.addInstance(&pb.ServiceInstance{ServiceName: "billing", ServiceId: "billing-1"})
+
+	c, err := NewClient(WithClientDiscoveryAddress(fd.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	instances, err := c.Resolve(context.Background(), "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(instances))
+	}
+
+	inst := instances[0]
+	if inst.ServiceID != "orders-1" || inst.Address != "10.0.0.1" || inst.Port != 8080 {
+		t.Fatalf("unexpected instance %+v", inst)
+	}
+	if inst.Metadata["scheme"] != "https" {
+		t.Fatalf("expected metadata to be carried over, got %v", inst.Metadata)
+	}
+}
+
+func TestClient_ResolveFiltered(t *testing.T) {
+	for _, honor := range []bool{true, false} {
+		t.Run(fmt.Sprintf("server filters %v", honor), func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			fd.honorFilter = honor
+			var sent []string
+			fd.instancesHook = func(ctx context.Context, _ *pb.GetInstancesRequest) error {
+				md, _ := metadata.FromIncomingContext(ctx)
+				sent = md.Get(InstanceFilterHeader)
+				return nil
+			}
+			for id, md := range map[string]map[string]string{
+				"orders-1": {"version": "2", "zone": "a"},
+				"orders-2": {"version": "2", "zone": "b"},
+				"orders-3": {"version": "1", "zone": "a"},
+			} {
+				fd.addInstance(&pb.ServiceInstance{ServiceName: "orders", ServiceId: id, Metadata: md})
+			}
+
+			c, err := NewClient(WithClientDiscoveryAddress(fd.addr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			instances, err := c.ResolveFiltered(context.Background(), "orders", map[string]string{"version": "2", "zone": "a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) != 1 || instances[0].ServiceID != "orders-1" {
+				t.Fatalf("ResolveFiltered = %+v, want only orders-1", instances)
+			}
+			if want := []string{"version=2", "zone=a"}; !reflect.DeepEqual(sent, want) {
+				t.Fatalf("filter header = %q, want %q", sent, want)
+			}
+		})
+	}
+}
+
+func TestClient_PickNoInstances(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	c, err := NewClient(WithClientDiscoveryAddress(fd.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Pick(context.Background(), "missing"); !errors.Is(err, ErrNoInstances) {
+		t.Fatalf("expected ErrNoInstances, got %v", err)
+	}
+}
+
+func TestClient_ResolveWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		appearIn time.Duration // 0 = never
+		wantErr  error
+	}{
+		{name: "instance appears within the wait", appearIn: 150 * time.Millisecond},
+		{name: "wait elapses", wantErr: ErrNoInstances},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			// A negative cache entry must not hide the new instance.
+			c, err := NewClient(
+				WithClientDiscoveryAddress(fd.addr),
+				WithClientCache(NewCache(time.Minute, time.Minute)),
+				WithResolveWait(500*time.Millisecond),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if tt.appearIn > 0 {
+				time.AfterFunc(tt.appearIn, func() {
+					fd.addInstance(&pb.ServiceInstance{ServiceName: "orders", ServiceId: "orders-1", Address: "10.0.0.1", Port: 80})
+				})
+			}
+
+			start := time.Now()
+			inst, err := c.Pick(context.Background(), "orders")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Pick = %v, want %v", err, tt.wantErr)
+				}
+				if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+					t.Fatalf("gave up after %v, before the wait", elapsed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Pick = %v", err)
+			}
+			if inst.ServiceID != "orders-1" {
+				t.Fatalf("picked %q", inst.ServiceID)
+			}
+		})
+	}
+}
+
+func TestClient_StaticFallback(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from seed"))
+	}))
+	defer backend.Close()
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	seed := Instance{ServiceName: "orders", ServiceID: "seed-1", Address: host, Port: p}
+
+	// Nothing listens here, so every Discovery call fails.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	var logs syncBuffer
+	c, err := NewClient(
+		WithClientDiscoveryAddress(deadAddr),
+		WithClientLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithStaticFallback("orders", []Instance{seed}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	instances, err := c.Resolve(ctx, "orders")
+	if err != nil {
+		t.Fatalf("Resolve with fallback: %v", err)
+	}
+	if len(instances) != 1 || instances[0].ServiceID != "seed-1" {
+		t.Fatalf("expected seed instance, got %+v", instances)
+	}
+	if !strings.Contains(logs.String(), "using static fallback") {
+		t.Fatalf("fallback not logged:\n%s", logs.String())
+	}
+
+	if _, err := c.Resolve(ctx, "billing"); err == nil {
+		t.Fatal("expected error for service without fallback")
+	}
+
+	srv := httptest.NewServer(c.ReverseProxy("orders"))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "from seed" {
+		t.Fatalf("proxied body = %q, want request routed to seed", body)
+	}
+}
+
+func TestInstance_URL(t *testing.T) {
+	tests := []struct {
+		name string
+		inst Instance
+		path string
+		want string
+	}{
+		{"default http", Instance{Address: "10.0.0.1", Port: 8080}, "/orders", "http://10.0.0.1:8080/orders"},
+		{"https from metadata", Instance{Address: "api.internal", Port: 443, Metadata: map[string]string{"scheme": "https"}}, "/v1", "https://api.internal:443/v1"},
+		{"ipv6 bracketed", Instance{Address: "2001:db8::1", Port: 9000}, "/x", "http://[2001:db8::1]:9000/x"},
+		{"missing slash", Instance{Address: "10.0.0.1", Port: 80}, "health", "http://10.0.0.1:80/health"},
+		{"empty path", Instance{Address: "10.0.0.1", Port: 80}, "", "http://10.0.0.1:80"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.inst.URL(tt.path); got != tt.want {
+				t.Fatalf("URL(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstance_Weight(t *testing.T) {
+	tests := []struct {
+		md   map[string]string
+		want int
+	}{
+		{nil, 1},
+		{map[string]string{"weight": "5"}, 5},
+		{map[string]string{"weight": "heavy"}, 1},
+		{map[string]string{"weight": "0"}, 1},
+		{map[string]string{"weight": "-3"}, 1},
+	}
+
+	for _, tt := range tests {
+		if got := (Instance{Metadata: tt.md}).Weight(); got != tt.want {
+			t.Errorf("Weight() with %v = %d, want %d", tt.md, got, tt.want)
+		}
+	}
+}
+
+func TestInstance_PartialMetadata(t *testing.T) {
+	tests := []struct {
+		name         string
+		md           map[string]string
+		wantURL      string
+		wantWeight   int
+		wantStrategy LoadBalancingStrategy
+	}{
+		{name: "no metadata", md: nil, wantURL: "http://10.0.0.1:80/", wantWeight: 1, wantStrategy: RoundRobin},
+		{name: "empty values", md: map[string]string{"scheme": " ", "weight": "", "lb_strategy": ""}, wantURL: "http://10.0.0.1:80/", wantWeight: 1, wantStrategy: RoundRobin},
+		{name: "unknown strategy", md: map[string]string{"lb_strategy": "Fastest"}, wantURL: "http://10.0.0.1:80/", wantWeight: 1, wantStrategy: RoundRobin},
+		{name: "upper-case scheme", md: map[string]string{"scheme": "HTTPS", "weight": "3", "lb_strategy": "Random"}, wantURL: "https://10.0.0.1:80/", wantWeight: 3, wantStrategy: Random},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inst := Instance{Address: "10.0.0.1", Port: 80, Metadata: tt.md}
+			if got := inst.URL("/"); got != tt.wantURL {
+				t.Fatalf("URL = %q, want %q", got, tt.wantURL)
+			}
+			if got := inst.Weight(); got != tt.wantWeight {
+				t.Fatalf("Weight = %d, want %d", got, tt.wantWeight)
+			}
+			if got := inst.Strategy(); got != tt.wantStrategy {
+				t.Fatalf("Strategy = %q, want %q", got, tt.wantStrategy)
+			}
+		})
+	}
+}
+
+func TestClient_PickPartialMetadata(t *testing.T) {
+	for _, strategy := range []LoadBalancingStrategy{RoundRobin, Random} {
+		t.Run(string(strategy), func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			// Registered by an older SDK: no scheme, weight or strategy.
+			fd.addInstance(&pb.ServiceInstance{ServiceName: "legacy", ServiceId: "legacy-1", Address: "10.0.0.1", Port: 8080})
+			fd.addInstance(&pb.ServiceInstance{ServiceName: "legacy", ServiceId: "legacy-2", Address: "10.0.0.2", Port: 8080,
+				Metadata: map[string]string{"version": "0.1"}})
+
+			c, err := NewClient(WithClientDiscoveryAddress(fd.addr), WithClientStrategy(strategy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			seen := map[string]bool{}
+			for range 50 {
+				inst, err := c.Pick(context.Background(), "legacy")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(inst.URL("/"), "http://") {
+					t.Fatalf("URL = %q, want the http default", inst.URL("/"))
+				}
+				seen[inst.ServiceID] = true
+			}
+			if len(seen) != 2 {
+				t.Fatalf("picked %v, want both instances", seen)
+			}
+		})
+	}
+}
+
+func TestInstance_MetadataList(t *testing.T) {
+	inst := Instance{Metadata: map[string]string{"tags": "gpu, ssd"}}
+
+	if got := inst.MetadataList("tags"); !reflect.DeepEqual(got, []string{"gpu", "ssd"}) {
+		t.Fatalf("MetadataList(tags) = %q", got)
+	}
+	if got := inst.MetadataList("missing"); got != nil {
+		t.Fatalf("MetadataList(missing) = %q, want nil", got)
+	}
+	if !inst.HasMetadataValue("tags", "ssd") || inst.HasMetadataValue("tags", "gp") {
+		t.Fatal("HasMetadataValue should match whole list entries only")
+	}
+}
+
+func TestInstance_IsHealthy(t *testing.T) {
+	tests := []struct {
+		status pb.HealthStatus
+		want   bool
+	}{
+		{pb.HealthStatus_HEALTH_STATUS_HEALTHY, true},
+		{pb.HealthStatus_HEALTH_STATUS_UNKNOWN, true},
+		{pb.HealthStatus_HEALTH_STATUS_DEGRADED, false},
+		{pb.HealthStatus_HEALTH_STATUS_UNHEALTHY, false},
+	}
+
+	for _, tt := range tests {
+		if got := (Instance{Status: tt.status}).IsHealthy(); got != tt.want {
+			t.Errorf("IsHealthy() with %v = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
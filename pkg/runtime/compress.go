@@ -0,0 +1,221 @@
+package runtime
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compress encodes responses of at least minSize bytes with gzip or deflate
+// when the client accepts it. Paths in skip are passed through untouched.
+func compress(minSize int, skip ...string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range skip {
+				if r.URL.Path == p {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			w.Header().Add("Vary", "Accept-Encoding")
+			enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if enc == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: enc, minSize: minSize}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip on a tie. It returns "" if neither is acceptable.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+		if q > bestQ || (q == bestQ && name == "gzip") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressedTypes are media types that do not shrink further.
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/zip":              true,
+	"application/x-gzip":           true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-bzip2":          true,
+	"application/vnd.rar":          true,
+	"application/x-rar-compressed": true,
+}
+
+func isCompressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	switch {
+	case mt == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mt, "image/"), strings.HasPrefix(mt, "video/"), strings.HasPrefix(mt, "audio/"):
+		return false
+	case mt == "text/event-stream":
+		return false
+	}
+	return !compressedTypes[mt]
+}
+
+// compressWriter buffers the start of a response until it knows whether to
+// compress it: once minSize bytes have been written, on Flush, or when the
+// handler returns.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser // nil when passing through
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	cw.status = code
+	// Bodiless and informational responses are never compressed.
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified {
+		cw.passThrough()
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.minSize {
+			return len(p), nil
+		}
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been written so far, deciding on compression early
+// if needed, so streaming handlers keep working.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.decide()
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+// Hijack is forwarded so protocol upgrades still work; the connection is
+// handed over uncompressed.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.decided = true
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+// decide commits to compressing or not based on the buffered body and the
+// headers set so far, then writes the header and buffered bytes.
+func (cw *compressWriter) decide() error {
+	h := cw.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if len(cw.buf) < cw.minSize || h.Get("Content-Encoding") != "" || !isCompressible(h.Get("Content-Type")) {
+		return cw.passThrough()
+	}
+
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	cw.decided = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if cw.encoding == "gzip" {
+		cw.enc = gzip.NewWriter(cw.ResponseWriter)
+	} else {
+		// HTTP "deflate" is the zlib format (RFC 9110 section 8.4.1.2),
+		// not raw DEFLATE.
+		cw.enc = zlib.NewWriter(cw.ResponseWriter)
+	}
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.enc.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) passThrough() error {
+	cw.decided = true
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// close finishes the response once the handler has returned.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			// Nothing written; let net/http send its default response.
+			cw.decided = true
+			return
+		}
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.passThrough()
+		return
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+	}
+}
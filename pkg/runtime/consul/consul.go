@@ -0,0 +1,245 @@
+// Package consul provides a runtime.Registrar that registers services with
+// a Consul agent instead of ToskaMesh Discovery, so teams already running
+// Consul can adopt the SDK incrementally.
+//
+// Usage:
+//
+//	svc, err := runtime.New(
+//	    runtime.WithServiceName("my-service"),
+//	    runtime.WithRegistrar(consul.New(
+//	        consul.WithAgentAddress("http://consul:8500"),
+//	        consul.WithTTLCheck(30*time.Second),
+//	    )),
+//	    runtime.WithLeaseTTL(30*time.Second),
+//	)
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/toska-mesh/toska-mesh-go/pkg/runtime"
+)
+
+// Options configures a Registrar.
+type Options struct {
+	AgentAddress string       // Base URL of the Consul agent HTTP API. Default: "http://127.0.0.1:8500".
+	Token        string       // ACL token sent as X-Consul-Token. Empty = none.
+	HTTPClient   *http.Client // Default: http.DefaultClient.
+	Tags         []string     // Extra tags on the service entry.
+
+	// TTL switches the health check from Consul probing the service's
+	// health endpoint (the default) to a TTL check renewed by heartbeats.
+	// Use runtime.WithLeaseTTL with the same value so heartbeats keep up.
+	TTL time.Duration
+
+	// DeregisterCriticalAfter makes Consul remove the service once its
+	// check has been critical this long. 0 = never.
+	DeregisterCriticalAfter time.Duration
+}
+
+// Option is a functional option for configuring a Registrar.
+type Option func(*Options)
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	return Options{AgentAddress: "http://127.0.0.1:8500"}
+}
+
+func WithAgentAddress(addr string) Option {
+	return func(o *Options) { o.AgentAddress = addr }
+}
+
+func WithToken(token string) Option {
+	return func(o *Options) { o.Token = token }
+}
+
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *Options) { o.HTTPClient = c }
+}
+
+func WithTags(tags ...string) Option {
+	return func(o *Options) { o.Tags = append(o.Tags, tags...) }
+}
+
+func WithTTLCheck(ttl time.Duration) Option {
+	return func(o *Options) { o.TTL = ttl }
+}
+
+func WithDeregisterCriticalAfter(d time.Duration) Option {
+	return func(o *Options) { o.DeregisterCriticalAfter = d }
+}
+
+// Registrar registers services with the local Consul agent.
+type Registrar struct {
+	opts   Options
+	client *http.Client
+}
+
+var _ runtime.Registrar = (*Registrar)(nil)
+
+// New creates a Registrar with the given functional options.
+func New(opts ...Option) *Registrar {
+	o := DefaultOptions()
+	for _, fn := range opts {
+		fn(&o)
+	}
+	client := o.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Registrar{opts: o, client: client}
+}
+
+// agentService is the body of PUT /v1/agent/service/register.
+type agentService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Weights *agentWeights     `json:"Weights,omitempty"`
+	Check   agentCheck        `json:"Check"`
+}
+
+type agentWeights struct {
+	Passing int `json:"Passing"`
+	Warning int `json:"Warning"`
+}
+
+type agentCheck struct {
+	CheckID                        string `json:"CheckID"`
+	Name                           string `json:"Name"`
+	HTTP                           string `json:"HTTP,omitempty"`
+	Method                         string `json:"Method,omitempty"`
+	Interval                       string `json:"Interval,omitempty"`
+	Timeout                        string `json:"Timeout,omitempty"`
+	TTL                            string `json:"TTL,omitempty"`
+	FailuresBeforeCritical         int    `json:"FailuresBeforeCritical,omitempty"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+// checkID is the ID of the health check registered with the service.
+func checkID(serviceID string) string { return "service:" + serviceID }
+
+// Register registers the service and its health check. Metadata, including
+// the routing keys, becomes service meta; the routing weight also sets the
+// passing weight, and the scheme is added as a tag.
+func (r *Registrar) Register(ctx context.Context, reg runtime.Registration) error {
+	svc := agentService{
+		ID:      reg.ServiceID,
+		Name:    reg.ServiceName,
+		Address: reg.Address,
+		Port:    reg.Port,
+		Tags:    append([]string(nil), r.opts.Tags...),
+		Meta:    reg.Metadata,
+		Check: agentCheck{
+			CheckID: checkID(reg.ServiceID),
+			Name:    reg.ServiceName + " health",
+		},
+	}
+	if scheme := reg.Metadata["scheme"]; scheme != "" {
+		svc.Tags = append(svc.Tags, scheme)
+	}
+	if w, err := strconv.Atoi(reg.Metadata["weight"]); err == nil && w > 0 {
+		svc.Weights = &agentWeights{Passing: w, Warning: 1}
+	}
+
+	if r.opts.TTL > 0 {
+		svc.Check.TTL = r.opts.TTL.String()
+	} else {
+		scheme := reg.Metadata["scheme"]
+		if scheme == "" {
+			scheme = "http"
+		}
+		port := reg.Port
+		if reg.HealthCheck.Port != 0 {
+			port = reg.HealthCheck.Port
+		}
+		u := url.URL{
+			Scheme: scheme,
+			Host:   net.JoinHostPort(reg.Address, strconv.Itoa(port)),
+			Path:   reg.HealthCheck.Endpoint,
+		}
+		svc.Check.HTTP = u.String()
+		svc.Check.Method = http.MethodGet
+		svc.Check.Interval = reg.HealthCheck.Interval.String()
+		svc.Check.Timeout = reg.HealthCheck.Timeout.String()
+		svc.Check.FailuresBeforeCritical = reg.HealthCheck.UnhealthyThreshold
+	}
+	if d := r.opts.DeregisterCriticalAfter; d > 0 {
+		svc.Check.DeregisterCriticalServiceAfter = d.String()
+	}
+
+	return r.put(ctx, "/v1/agent/service/register", svc, false)
+}
+
+// Heartbeat renews the TTL check with the reported status. With an HTTP
+// check Consul probes the service itself and Heartbeat does nothing.
+func (r *Registrar) Heartbeat(ctx context.Context, hb runtime.Heartbeat) error {
+	if r.opts.TTL <= 0 {
+		return nil
+	}
+	status := "passing"
+	switch hb.Status {
+	case runtime.StatusDegraded:
+		status = "warning"
+	case runtime.StatusUnhealthy:
+		status = "critical"
+	}
+	body := map[string]string{"Status": status, "Output": hb.Output}
+	return r.put(ctx, "/v1/agent/check/update/"+url.PathEscape(checkID(hb.ServiceID)), body, false)
+}
+
+// Deregister removes the service and its check. An unknown service counts
+// as success.
+func (r *Registrar) Deregister(ctx context.Context, serviceID string) error {
+	return r.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(serviceID), nil, true)
+}
+
+// put sends a PUT to the agent API, with body encoded as JSON when non-nil.
+func (r *Registrar) put(ctx context.Context, path string, body any, notFoundOK bool) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("consul: %w", err)
+		}
+		rd = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.opts.AgentAddress+path, rd)
+	if err != nil {
+		return fmt.Errorf("consul: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.opts.Token != "" {
+		req.Header.Set("X-Consul-Token", r.opts.Token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("consul: PUT %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode == http.StatusNotFound && notFoundOK {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul: PUT %s: %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toska-mesh/toska-mesh-go/pkg/runtime"
+)
+
+// mockAgent is a minimal Consul agent HTTP API that records requests.
+type mockAgent struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []agentRequest
+	status   int // response status; 0 = 200
+}
+
+type agentRequest struct {
+	Method string
+	Path   string
+	Token  string
+	Body   map[string]any
+}
+
+func startMockAgent(t *testing.T) *mockAgent {
+	t.Helper()
+	a := &mockAgent{}
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := agentRequest{Method: r.Method, Path: r.URL.EscapedPath(), Token: r.Header.Get("X-Consul-Token")}
+		if b, _ := io.ReadAll(r.Body); len(b) > 0 {
+			if err := json.Unmarshal(b, &req.Body); err != nil {
+				t.Errorf("invalid JSON body: %v", err)
+			}
+		}
+
+		a.mu.Lock()
+		a.requests = append(a.requests, req)
+		status := a.status
+		a.mu.Unlock()
+
+		if status != 0 {
+			http.Error(w, "agent says no", status)
+		}
+	}))
+	t.Cleanup(a.Close)
+	return a
+}
+
+func (a *mockAgent) Requests() []agentRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]agentRequest(nil), a.requests...)
+}
+
+func (a *mockAgent) setStatus(code int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status = code
+}
+
+var testRegistration = runtime.Registration{
+	ServiceName: "orders",
+	ServiceID:   "orders-1",
+	Address:     "10.0.0.5",
+	Port:        9090,
+	Metadata:    map[string]string{"scheme": "http", "weight": "5", "lb_strategy": "RoundRobin"},
+	HealthCheck: runtime.HealthCheck{
+		Endpoint:           "/health",
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		UnhealthyThreshold: 3,
+	},
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		reg       func(*runtime.Registration)
+		wantCheck map[string]any
+	}{
+		{
+			name: "HTTP check",
+			wantCheck: map[string]any{
+				"CheckID":                "service:orders-1",
+				"Name":                   "orders health",
+				"HTTP":                   "http://10.0.0.5:9090/health",
+				"Method":                 "GET",
+				"Interval":               "10s",
+				"Timeout":                "2s",
+				"FailuresBeforeCritical": float64(3),
+			},
+		},
+		{
+			name: "HTTP check on probe port",
+			reg:  func(r *runtime.Registration) { r.HealthCheck.Port = 9901 },
+			wantCheck: map[string]any{
+				"CheckID":                "service:orders-1",
+				"Name":                   "orders health",
+				"HTTP":                   "http://10.0.0.5:9901/health",
+				"Method":                 "GET",
+				"Interval":               "10s",
+				"Timeout":                "2s",
+				"FailuresBeforeCritical": float64(3),
+			},
+		},
+		{
+			name: "TTL check",
+			opts: []Option{WithTTLCheck(30 * time.Second), WithDeregisterCriticalAfter(time.Minute)},
+			wantCheck: map[string]any{
+				"CheckID":                        "service:orders-1",
+				"Name":                           "orders health",
+				"TTL":                            "30s",
+				"DeregisterCriticalServiceAfter": "1m0s",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := startMockAgent(t)
+			r := New(append([]Option{
+				WithAgentAddress(agent.URL),
+				WithToken("secret"),
+				WithTags("team-a"),
+			}, tt.opts...)...)
+
+			reg := testRegistration
+			if tt.reg != nil {
+				tt.reg(&reg)
+			}
+			if err := r.Register(context.Background(), reg); err != nil {
+				t.Fatal(err)
+			}
+
+			reqs := agent.Requests()
+			if len(reqs) != 1 {
+				t.Fatalf("expected 1 request, got %d", len(reqs))
+			}
+			req := reqs[0]
+			if req.Method != http.MethodPut || req.Path != "/v1/agent/service/register" || req.Token != "secret" {
+				t.Fatalf("request = %s %s (token %q)", req.Method, req.Path, req.Token)
+			}
+
+			want := map[string]any{
+				"ID":      "orders-1",
+				"Name":    "orders",
+				"Address": "10.0.0.5",
+				"Port":    float64(9090),
+				"Tags":    []any{"team-a", "http"},
+				"Meta":    map[string]any{"scheme": "http", "weight": "5", "lb_strategy": "RoundRobin"},
+				"Weights": map[string]any{"Passing": float64(5), "Warning": float64(1)},
+				"Check":   tt.wantCheck,
+			}
+			if !reflect.DeepEqual(req.Body, want) {
+				t.Fatalf("body = %v\nwant %v", req.Body, want)
+			}
+		})
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	tests := []struct {
+		status runtime.HealthStatus
+		want   string
+	}{
+		{runtime.StatusHealthy, "passing"},
+		{runtime.StatusDegraded, "warning"},
+		{runtime.StatusUnhealthy, "critical"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			agent := startMockAgent(t)
+			r := New(WithAgentAddress(agent.URL), WithTTLCheck(30*time.Second))
+
+			err := r.Heartbeat(context.Background(), runtime.Heartbeat{ServiceID: "orders-1", Status: tt.status, Output: "detail"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reqs := agent.Requests()
+			if len(reqs) != 1 || reqs[0].Path != "/v1/agent/check/update/service:orders-1" {
+				t.Fatalf("requests = %+v", reqs)
+			}
+			if got := reqs[0].Body["Status"]; got != tt.want {
+				t.Fatalf("Status = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeartbeat_HTTPCheckIsNoop(t *testing.T) {
+	agent := startMockAgent(t)
+	r := New(WithAgentAddress(agent.URL))
+
+	if err := r.Heartbeat(context.Background(), runtime.Heartbeat{ServiceID: "orders-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(agent.Requests()); n != 0 {
+		t.Fatalf("expected no requests, got %d", n)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "removed", status: http.StatusOK},
+		{name: "unknown service", status: http.StatusNotFound},
+		{name: "agent error", status: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := startMockAgent(t)
+			agent.setStatus(tt.status)
+			r := New(WithAgentAddress(agent.URL))
+
+			err := r.Deregister(context.Background(), "orders-1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Deregister error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if reqs := agent.Requests(); len(reqs) != 1 || reqs[0].Path != "/v1/agent/service/deregister/orders-1" {
+				t.Fatalf("requests = %+v", reqs)
+			}
+		})
+	}
+}
+
+func TestWithMeshService(t *testing.T) {
+	agent := startMockAgent(t)
+	svc, err := runtime.New(
+		runtime.WithServiceName("orders"),
+		runtime.WithServiceID("orders-1"),
+		runtime.WithAddress("127.0.0.1"),
+		runtime.WithPort(0),
+		runtime.WithHeartbeat(false),
+		runtime.WithRegistrar(New(WithAgentAddress(agent.URL))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.SelfTest(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, req := range agent.Requests() {
+		paths = append(paths, req.Path)
+	}
+	want := []string{"/v1/agent/service/register", "/v1/agent/service/deregister/orders-1"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("agent calls = %v, want %v", paths, want)
+	}
+}
@@ -0,0 +1,287 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+)
+
+// DiscoveryMode controls how the runtime uses multiple Discovery endpoints.
+type DiscoveryMode string
+
+const (
+	// DiscoveryBroadcast sends every call to all endpoints. A call succeeds
+	// if at least one endpoint accepts it.
+	DiscoveryBroadcast DiscoveryMode = "Broadcast"
+	// DiscoveryFailover sends each call to a single endpoint, moving on to
+	// the next one in order when it fails. The last working endpoint is
+	// remembered for subsequent calls.
+	DiscoveryFailover DiscoveryMode = "Failover"
+)
+
+// bearerToken is a PerRPCCredentials that sends a static bearer token. The
+// Discovery connection is plaintext, so it does not demand transport
+// security.
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (bearerToken) RequireTransportSecurity() bool { return false }
+
+// ServiceIDHeader is the gRPC request header carrying the caller's service
+// ID on every Discovery RPC a MeshService makes.
+const ServiceIDHeader = "x-service-id"
+
+// modulePath is this SDK's module path, used to find its version.
+const modulePath = "github.com/toska-mesh/toska-mesh-go"
+
+// sdkVersion returns the version of this module the binary was built with,
+// or "devel" when it is unknown, e.g. in tests or when built from a local
+// checkout.
+func sdkVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	version := info.Main.Version
+	if info.Main.Path != modulePath {
+		version = ""
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+				break
+			}
+		}
+	}
+	if version == "" || version == "(devel)" {
+		return "devel"
+	}
+	return version
+}
+
+// defaultUserAgent identifies the SDK, and the service if named, to
+// Discovery. gRPC appends its own "grpc-go/<version>".
+func defaultUserAgent(service string) string {
+	ua := "toska-mesh-go/" + sdkVersion()
+	if service != "" {
+		ua += " " + service
+	}
+	return ua
+}
+
+// withServiceID attaches id to every RPC in ServiceIDHeader.
+func withServiceID(id string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, ServiceIDHeader, id)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// normalizeDiscoveryAddress checks that addr is host:port, with IPv6
+// literals bracketed, and returns it in canonical form. Targets with a gRPC
+// resolver scheme (e.g. "dns:///discovery:8080") are passed through.
+func normalizeDiscoveryAddress(addr string) (string, error) {
+	if strings.Contains(addr, ":///") {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return "", fmt.Errorf("runtime: invalid discovery address %q: want host:port, with IPv6 literals in brackets (e.g. \"[::1]:8080\")", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("runtime: invalid discovery address %q: bad port %q", addr, port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// resolverTarget returns the gRPC target for addr. With a custom resolver,
+// a target without a scheme uses "passthrough" so the host name reaches
+// resolverDialer instead of being resolved by gRPC's own DNS resolver.
+func resolverTarget(addr string, r *net.Resolver) string {
+	if r == nil || strings.Contains(addr, ":///") {
+		return addr
+	}
+	return "passthrough:///" + addr
+}
+
+// resolverDialer dials Discovery, resolving host names with r.
+func resolverDialer(r *net.Resolver) grpc.DialOption {
+	d := &net.Dialer{Resolver: r}
+	return grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", addr)
+	})
+}
+
+// reconnectingConn is a grpc.ClientConnInterface whose underlying
+// connection can be replaced while RPCs are in flight.
+type reconnectingConn struct {
+	cur atomic.Pointer[grpc.ClientConn]
+}
+
+func (c *reconnectingConn) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	return c.cur.Load().Invoke(ctx, method, args, reply, opts...)
+}
+
+func (c *reconnectingConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return c.cur.Load().NewStream(ctx, desc, method, opts...)
+}
+
+// watchDiscoveryConn replaces the i'th Discovery connection with a new one
+// when it has been failing for longer than HealthInterval. A new
+// connection resolves target afresh, picking up DNS changes that gRPC's
+// own reconnect backoff would be slow to act on. It returns when ctx is
+// done; the connection in use then is left for start to close.
+func (s *MeshService) watchDiscoveryConn(ctx context.Context, i int, target string, rc *reconnectingConn) {
+	after := s.opts.HealthInterval
+	var failingSince time.Time
+	for {
+		conn := rc.cur.Load()
+		st := conn.GetState()
+		switch st {
+		case connectivity.TransientFailure:
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			}
+		case connectivity.Connecting:
+			// A retry between failures; the failure is still ongoing.
+		default:
+			failingSince = time.Time{}
+		}
+		if !failingSince.IsZero() && time.Since(failingSince) >= after {
+			next, err := grpc.NewClient(resolverTarget(target, s.opts.Resolver), s.discoveryDialOptions()...)
+			if err != nil {
+				s.logger.Warn("discovery reconnect failed", "discovery", target, "error", err)
+			} else {
+				rc.cur.Store(next)
+				s.mu.Lock()
+				// Copy on write: DiscoveryConnState reads a snapshot unlocked.
+				conns := slices.Clone(s.discoveryConns)
+				conns[i] = next
+				s.discoveryConns = conns
+				s.mu.Unlock()
+				conn.Close()
+				next.Connect()
+				s.logger.Warn("reconnected to discovery", "discovery", target, "failingFor", time.Since(failingSince))
+				failingSince = time.Time{}
+				continue
+			}
+		}
+
+		// Wake on a state change, or in time to act on a failure that
+		// persists without one.
+		waitCtx, cancel := context.WithTimeout(ctx, after)
+		conn.WaitForStateChange(waitCtx, st)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// multiDiscovery is a DiscoveryRegistryClient backed by several Discovery
+// endpoints. With a single endpoint it behaves exactly like that endpoint.
+type multiDiscovery struct {
+	clients []pb.DiscoveryRegistryClient
+	mode    DiscoveryMode
+
+	mu      sync.Mutex
+	current int // index of the preferred endpoint in failover mode
+}
+
+var _ pb.DiscoveryRegistryClient = (*multiDiscovery)(nil)
+
+func newMultiDiscovery(mode DiscoveryMode, clients ...pb.DiscoveryRegistryClient) *multiDiscovery {
+	return &multiDiscovery{clients: clients, mode: mode}
+}
+
+func (m *multiDiscovery) Register(ctx context.Context, in *pb.RegisterServiceRequest, opts ...grpc.CallOption) (*pb.RegisterServiceResponse, error) {
+	return dispatch(m, m.mode, func(c pb.DiscoveryRegistryClient) (*pb.RegisterServiceResponse, error) {
+		return c.Register(ctx, in, opts...)
+	})
+}
+
+func (m *multiDiscovery) Deregister(ctx context.Context, in *pb.DeregisterServiceRequest, opts ...grpc.CallOption) (*pb.DeregisterServiceResponse, error) {
+	return dispatch(m, m.mode, func(c pb.DiscoveryRegistryClient) (*pb.DeregisterServiceResponse, error) {
+		return c.Deregister(ctx, in, opts...)
+	})
+}
+
+func (m *multiDiscovery) ReportHealth(ctx context.Context, in *pb.ReportHealthRequest, opts ...grpc.CallOption) (*pb.ReportHealthResponse, error) {
+	return dispatch(m, m.mode, func(c pb.DiscoveryRegistryClient) (*pb.ReportHealthResponse, error) {
+		return c.ReportHealth(ctx, in, opts...)
+	})
+}
+
+// Reads only need one answer, so they always fail over.
+
+func (m *multiDiscovery) GetInstances(ctx context.Context, in *pb.GetInstancesRequest, opts ...grpc.CallOption) (*pb.GetInstancesResponse, error) {
+	return dispatch(m, DiscoveryFailover, func(c pb.DiscoveryRegistryClient) (*pb.GetInstancesResponse, error) {
+		return c.GetInstances(ctx, in, opts...)
+	})
+}
+
+func (m *multiDiscovery) GetServices(ctx context.Context, in *pb.GetServicesRequest, opts ...grpc.CallOption) (*pb.GetServicesResponse, error) {
+	return dispatch(m, DiscoveryFailover, func(c pb.DiscoveryRegistryClient) (*pb.GetServicesResponse, error) {
+		return c.GetServices(ctx, in, opts...)
+	})
+}
+
+// dispatch runs call against the endpoints of m according to mode. Errors
+// from every endpoint are joined when none succeeds.
+func dispatch[T any](m *multiDiscovery, mode DiscoveryMode, call func(pb.DiscoveryRegistryClient) (T, error)) (T, error) {
+	var (
+		first T
+		ok    bool
+		errs  []error
+	)
+
+	if mode == DiscoveryBroadcast {
+		for _, c := range m.clients {
+			resp, err := call(c)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if !ok {
+				first, ok = resp, true
+			}
+		}
+		if ok {
+			return first, nil
+		}
+		return first, errors.Join(errs...)
+	}
+
+	m.mu.Lock()
+	start := m.current
+	m.mu.Unlock()
+
+	for i := range m.clients {
+		idx := (start + i) % len(m.clients)
+		resp, err := call(m.clients[idx])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.mu.Lock()
+		m.current = idx
+		m.mu.Unlock()
+		return resp, nil
+	}
+	return first, errors.Join(errs...)
+}
@@ -0,0 +1,538 @@
+package runtime
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeDiscovery is an in-process DiscoveryRegistry server that records every
+// request it receives.
+type fakeDiscovery struct {
+	pb.UnimplementedDiscoveryRegistryServer
+
+	addr string
+	srv  *grpc.Server // current server; see stop and serve
+
+	mu          sync.Mutex
+	registers   []*pb.RegisterServiceRequest
+	deregisters []*pb.DeregisterServiceRequest
+	reports     []*pb.ReportHealthRequest
+	instances   map[string]*pb.ServiceInstance // by service ID
+
+	// Optional hooks run before each RPC is recorded; a non-nil error fails
+	// the call. Set them before the service under test starts.
+	registerHook   func(ctx context.Context, req *pb.RegisterServiceRequest) error
+	deregisterHook func(ctx context.Context, req *pb.DeregisterServiceRequest) error
+	reportHook     func(ctx context.Context, req *pb.ReportHealthRequest) error
+	instancesHook  func(ctx context.Context, req *pb.GetInstancesRequest) error
+
+	// honorFilter makes GetInstances apply InstanceFilterHeader, like a
+	// Discovery that supports server-side filtering.
+	honorFilter bool
+}
+
+// startFakeDiscovery serves a fakeDiscovery on an ephemeral loopback port
+// until the test ends.
+func startFakeDiscovery(t *testing.T) *fakeDiscovery {
+	t.Helper()
+
+	fd := &fakeDiscovery{
+		addr:      "127.0.0.1:0",
+		instances: make(map[string]*pb.ServiceInstance),
+	}
+	fd.serve(t)
+	return fd
+}
+
+// serve starts a gRPC server for f on f.addr, taking the port again after
+// stop so clients see Discovery come back at the same address.
+func (f *fakeDiscovery) serve(t *testing.T) {
+	t.Helper()
+	ln, err := net.Listen("tcp", f.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.addr = ln.Addr().String()
+
+	srv := grpc.NewServer()
+	pb.RegisterDiscoveryRegistryServer(srv, f)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	f.srv = srv
+}
+
+// stop takes f down, closing open connections. Recorded state is kept.
+func (f *fakeDiscovery) stop() {
+	f.srv.Stop()
+}
+
+func (f *fakeDiscovery) Register(ctx context.Context, req *pb.RegisterServiceRequest) (*pb.RegisterServiceResponse, error) {
+	if f.registerHook != nil {
+		if err := f.registerHook(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.registers = append(f.registers, req)
+	f.instances[req.ServiceId] = &pb.ServiceInstance{
+		ServiceName: req.ServiceName,
+		ServiceId:   req.ServiceId,
+		Address:     req.Address,
+		Port:        req.Port,
+		Status:      pb.HealthStatus_HEALTH_STATUS_HEALTHY,
+		Metadata:    req.Metadata,
+	}
+	return &pb.RegisterServiceResponse{Success: true, ServiceId: req.ServiceId}, nil
+}
+
+func (f *fakeDiscovery) Deregister(ctx context.Context, req *pb.DeregisterServiceRequest) (*pb.DeregisterServiceResponse, error) {
+	if f.deregisterHook != nil {
+		if err := f.deregisterHook(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deregisters = append(f.deregisters, req)
+	_, ok := f.instances[req.ServiceId]
+	delete(f.instances, req.ServiceId)
+	return &pb.DeregisterServiceResponse{Removed: ok}, nil
+}
+
+func (f *fakeDiscovery) GetInstances(ctx context.Context, req *pb.GetInstancesRequest) (*pb.GetInstancesResponse, error) {
+	if f.instancesHook != nil {
+		if err := f.instancesHook(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	var filter []string
+	if f.honorFilter {
+		md, _ := metadata.FromIncomingContext(ctx)
+		filter = md.Get(InstanceFilterHeader)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &pb.GetInstancesResponse{}
+	for _, si := range f.instances {
+		if si.ServiceName == req.ServiceName && matchesFilter(si.Metadata, filter) {
+			resp.Instances = append(resp.Instances, si)
+		}
+	}
+	return resp, nil
+}
+
+func matchesFilter(md map[string]string, filter []string) bool {
+	for _, kv := range filter {
+		k, v, _ := strings.Cut(kv, "=")
+		if md[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// addInstance seeds the registry as if the instance had registered itself.
+func (f *fakeDiscovery) addInstance(si *pb.ServiceInstance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances[si.ServiceId] = si
+}
+
+// removeInstance drops an instance from the registry.
+func (f *fakeDiscovery) removeInstance(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.instances, id)
+}
+
+func (f *fakeDiscovery) ReportHealth(ctx context.Context, req *pb.ReportHealthRequest) (*pb.ReportHealthResponse, error) {
+	if f.reportHook != nil {
+		if err := f.reportHook(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reports = append(f.reports, req)
+	return &pb.ReportHealthResponse{Success: true}, nil
+}
+
+// Registers returns a snapshot of the Register requests received so far.
+func (f *fakeDiscovery) Registers() []*pb.RegisterServiceRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*pb.RegisterServiceRequest(nil), f.registers...)
+}
+
+// Deregisters returns a snapshot of the Deregister requests received so far.
+func (f *fakeDiscovery) Deregisters() []*pb.DeregisterServiceRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*pb.DeregisterServiceRequest(nil), f.deregisters...)
+}
+
+// Reports returns a snapshot of the ReportHealth requests received so far.
+func (f *fakeDiscovery) Reports() []*pb.ReportHealthRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*pb.ReportHealthRequest(nil), f.reports...)
+}
+
+func TestDiscoveryBroadcast_AllEndpointsReceiveHeartbeats(t *testing.T) {
+	fd1 := startFakeDiscovery(t)
+	fd2 := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("ha"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddresses(fd1.addr, fd2.addr),
+		WithHealthInterval(20*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop := runService(t, svc)
+	for _, fd := range []*fakeDiscovery{fd1, fd2} {
+		waitFor(t, 2*time.Second, func() bool {
+			return len(fd.Registers()) == 1 && len(fd.Reports()) >= 2
+		})
+	}
+
+	stop()
+	for _, fd := range []*fakeDiscovery{fd1, fd2} {
+		if n := len(fd.Deregisters()); n != 1 {
+			t.Fatalf("expected 1 deregistration per endpoint, got %d", n)
+		}
+	}
+}
+
+func TestDiscoveryFailover_SkipsUnreachableEndpoint(t *testing.T) {
+	// Grab a free port and release it so nothing is listening there.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+
+	fd := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("ha"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddresses(dead, fd.addr),
+		WithDiscoveryMode(DiscoveryFailover),
+		WithHealthInterval(20*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool {
+		return len(fd.Registers()) == 1 && len(fd.Reports()) >= 2
+	})
+}
+
+func TestDiscoveryToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		wantAdmit bool
+	}{
+		{name: "no token", wantAdmit: false},
+		{name: "wrong token", opts: []Option{WithDiscoveryToken("nope")}, wantAdmit: false},
+		{name: "valid token", opts: []Option{WithDiscoveryToken("s3cret")}, wantAdmit: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			var attempts atomic.Int32
+			fd.registerHook = func(ctx context.Context, _ *pb.RegisterServiceRequest) error {
+				attempts.Add(1)
+				md, _ := metadata.FromIncomingContext(ctx)
+				if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Bearer s3cret" {
+					return status.Error(codes.Unauthenticated, "missing or invalid token")
+				}
+				return nil
+			}
+
+			opts := append([]Option{
+				WithServiceName("secured"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHeartbeat(false),
+			}, tt.opts...)
+			svc, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runService(t, svc)
+			waitFor(t, 2*time.Second, func() bool { return attempts.Load() == 1 })
+
+			if admitted := len(fd.Registers()) == 1; admitted != tt.wantAdmit {
+				t.Fatalf("admitted=%v, want %v", admitted, tt.wantAdmit)
+			}
+		})
+	}
+}
+
+func TestDiscoveryInterceptors(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(tag string) grpc.UnaryClientInterceptor {
+		return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			mu.Lock()
+			calls = append(calls, tag+" "+method)
+			mu.Unlock()
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+	}
+
+	svc, err := New(
+		WithServiceName("intercepted"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(20*time.Millisecond),
+		WithDiscoveryInterceptors(record("outer"), record("inner")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Reports()) >= 1 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"outer " + pb.DiscoveryRegistry_Register_FullMethodName,
+		"inner " + pb.DiscoveryRegistry_Register_FullMethodName,
+		"outer " + pb.DiscoveryRegistry_ReportHealth_FullMethodName,
+		"inner " + pb.DiscoveryRegistry_ReportHealth_FullMethodName,
+	}
+	if len(calls) < len(want) {
+		t.Fatalf("interceptor calls = %v", calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("interceptor calls = %v, want prefix %v", calls, want)
+		}
+	}
+}
+
+func TestDiscoveryUserAgent(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		wantPrefix string
+	}{
+		{name: "default", wantPrefix: "toska-mesh-go/devel identified "},
+		{name: "override", opts: []Option{WithDiscoveryUserAgent("billing-sidecar/2")}, wantPrefix: "billing-sidecar/2 "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			got := make(chan metadata.MD, 1)
+			fd.registerHook = func(ctx context.Context, _ *pb.RegisterServiceRequest) error {
+				md, _ := metadata.FromIncomingContext(ctx)
+				select {
+				case got <- md:
+				default:
+				}
+				return nil
+			}
+
+			opts := append([]Option{
+				WithServiceName("identified"),
+				WithServiceID("identified-1"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHeartbeat(false),
+			}, tt.opts...)
+			svc, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runService(t, svc)
+
+			var md metadata.MD
+			select {
+			case md = <-got:
+			case <-time.After(2 * time.Second):
+				t.Fatal("no Register call")
+			}
+			if ua := md.Get("user-agent"); len(ua) != 1 || !strings.HasPrefix(ua[0], tt.wantPrefix) || !strings.Contains(ua[0], "grpc-go/") {
+				t.Fatalf("user-agent = %q, want prefix %q", ua, tt.wantPrefix)
+			}
+			if id := md.Get(ServiceIDHeader); len(id) != 1 || id[0] != "identified-1" {
+				t.Fatalf("%s = %q, want identified-1", ServiceIDHeader, id)
+			}
+		})
+	}
+}
+
+func TestNew_DiscoveryAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    string
+		wantErr string
+	}{
+		{name: "ipv4", addr: "10.0.0.1:8080", want: "10.0.0.1:8080"},
+		{name: "bracketed ipv6", addr: "[::1]:8080", want: "[::1]:8080"},
+		{name: "hostname", addr: "discovery:8080", want: "discovery:8080"},
+		{name: "resolver scheme", addr: "dns:///discovery:8080", want: "dns:///discovery:8080"},
+		{name: "bare ipv6", addr: "::1:8080", wantErr: "bracket"},
+		{name: "missing port", addr: "discovery", wantErr: "want host:port"},
+		{name: "bad port", addr: "discovery:http", wantErr: "bad port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := New(WithServiceName("addr"), WithDiscoveryAddress(tt.addr))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("New(%q) error = %v, want containing %q", tt.addr, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := svc.opts.DiscoveryAddress; got != tt.want {
+				t.Fatalf("DiscoveryAddress = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeResolver returns a Go resolver that answers A queries for every name
+// with ip and AAAA queries with no records, without touching the network.
+func fakeResolver(ip net.IP) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveFakeDNS(server, ip.To4())
+			return client, nil
+		},
+	}
+}
+
+// serveFakeDNS answers length-prefixed (TCP-style) DNS queries on c.
+func serveFakeDNS(c net.Conn, ip net.IP) {
+	defer c.Close()
+	for {
+		var n [2]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return
+		}
+		q := make([]byte, int(n[0])<<8|int(n[1]))
+		if _, err := io.ReadFull(c, q); err != nil {
+			return
+		}
+
+		// The question is the name's labels, a zero byte, type and class.
+		end := 12
+		for q[end] != 0 {
+			end += int(q[end]) + 1
+		}
+		end += 5
+		qtype := int(q[end-4])<<8 | int(q[end-3])
+
+		resp := append([]byte{q[0], q[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, q[12:end]...)
+		if qtype == 1 { // A
+			resp[7] = 1
+			resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			resp = append(resp, ip...)
+		}
+		if _, err := c.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestDiscoveryResolver(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	_, port, _ := net.SplitHostPort(fd.addr)
+
+	svc, err := New(
+		WithServiceName("resolved"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(net.JoinHostPort("discovery.mesh.test", port)),
+		WithResolver(fakeResolver(net.IPv4(127, 0, 0, 1))),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) > 0 })
+
+	client, err := NewClient(
+		WithClientDiscoveryAddress(net.JoinHostPort("discovery.mesh.test", port)),
+		WithClientResolver(fakeResolver(net.IPv4(127, 0, 0, 1))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Resolve(context.Background(), "resolved"); err != nil {
+		t.Fatalf("Resolve through the custom resolver: %v", err)
+	}
+}
+
+func TestDiscoveryReconnect(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	var logs syncBuffer
+	svc, err := New(
+		WithServiceName("reconnect"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(100*time.Millisecond),
+		WithHealthTimeout(50*time.Millisecond),
+		WithDiscoveryReconnect(true),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Reports()) > 0 })
+
+	fd.stop()
+	waitFor(t, 3*time.Second, func() bool { return strings.Contains(logs.String(), "reconnected to discovery") })
+
+	fd.serve(t)
+	before := len(fd.Reports())
+	waitFor(t, 3*time.Second, func() bool { return len(fd.Reports()) > before })
+}
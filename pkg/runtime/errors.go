@@ -0,0 +1,83 @@
+package runtime
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// RequestIDHeader carries the request ID. Incoming values are kept so IDs
+// propagate across services; otherwise one is generated. It is echoed on
+// every response.
+const RequestIDHeader = "X-Request-ID"
+
+// Context keys are unexported types so they cannot collide with keys set
+// by applications or other packages; use the accessor functions.
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request being served, or "" outside a
+// MeshService handler.
+func RequestID(ctx context.Context) string {
+	id, _ := RequestIDFromContext(ctx)
+	return id
+}
+
+// RequestIDFromContext returns the ID of the request being served and
+// whether ctx carries one.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// requestID assigns each request an ID, available through RequestID and
+// the RequestIDHeader response header.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// errorEnvelope is the JSON error body shared by mesh services.
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteError writes the standard mesh error envelope:
+//
+//	{"error":{"code":"...","message":"...","request_id":"..."}}
+//
+// The request ID is taken from the RequestIDHeader response header, which
+// MeshService sets before any handler runs.
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	body, _ := json.Marshal(errorEnvelope{Error: errorBody{
+		Code:      code,
+		Message:   message,
+		RequestID: w.Header().Get(RequestIDHeader),
+	}})
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,147 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteError_Envelope(t *testing.T) {
+	svc, err := New(WithServiceName("errors"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.HandleFunc("GET /fail", func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, http.StatusConflict, "conflict", "already exists")
+	})
+	h := svc.handler()
+
+	tests := []struct {
+		name      string
+		requestID string // sent by the client; "" = generated
+	}{
+		{name: "propagated request ID", requestID: "req-123"},
+		{name: "generated request ID"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/fail", nil)
+			if tt.requestID != "" {
+				req.Header.Set(RequestIDHeader, tt.requestID)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusConflict {
+				t.Fatalf("got %d, want 409", rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("Content-Type = %q", ct)
+			}
+			var body map[string]map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			e := body["error"]
+			if e["code"] != "conflict" || e["message"] != "already exists" {
+				t.Fatalf("unexpected envelope %v", body)
+			}
+			want := rec.Header().Get(RequestIDHeader)
+			if tt.requestID != "" && want != tt.requestID {
+				t.Fatalf("%s = %q, want %q", RequestIDHeader, want, tt.requestID)
+			}
+			if want == "" || e["request_id"] != want {
+				t.Fatalf("request_id = %q, want %q", e["request_id"], want)
+			}
+		})
+	}
+}
+
+func TestWriteError_WithoutRequestID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteError(rec, http.StatusBadRequest, "bad_request", "nope")
+	if got := rec.Body.String(); strings.Contains(got, "request_id") {
+		t.Fatalf("request_id should be omitted when unknown: %s", got)
+	}
+}
+
+func TestContextAccessors(t *testing.T) {
+	svc, err := New(WithServiceName("ctx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		gotSvc *MeshService
+		gotID  string
+		raw    []any
+	)
+	svc.HandleFunc("GET /ctx", func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		gotSvc, _ = ServiceFromContext(ctx)
+		gotID, _ = RequestIDFromContext(ctx)
+		for _, key := range []string{"service", "request_id", "requestID", RequestIDHeader} {
+			if v := ctx.Value(key); v != nil {
+				raw = append(raw, v)
+			}
+		}
+	})
+
+	req := httptest.NewRequest("GET", "/ctx", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	svc.handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	if gotSvc != svc || gotID != "abc" {
+		t.Fatalf("ServiceFromContext = %p, RequestIDFromContext = %q; want %p, abc", gotSvc, gotID, svc)
+	}
+	if len(raw) > 0 {
+		t.Fatalf("string keys retrieved runtime values: %v", raw)
+	}
+
+	if _, ok := ServiceFromContext(context.Background()); ok {
+		t.Fatal("ServiceFromContext found a service outside a handler")
+	}
+	if _, ok := RequestIDFromContext(context.Background()); ok {
+		t.Fatal("RequestIDFromContext found an ID outside a handler")
+	}
+}
+
+func TestBuiltinErrorsUseEnvelope(t *testing.T) {
+	svc, err := New(WithServiceName("errors"), WithMaxRequestBodyBytes(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.HandleFunc("POST /upload", func(w http.ResponseWriter, r *http.Request) {})
+	svc.mux.HandleFunc("GET /ready", svc.readinessHandler)
+	svc.draining.Store(true)
+	h := svc.handler()
+
+	tests := []struct {
+		req      *http.Request
+		wantCode int
+		wantErr  string
+	}{
+		{httptest.NewRequest("POST", "/upload", strings.NewReader("too large")), http.StatusRequestEntityTooLarge, "request_too_large"},
+		{httptest.NewRequest("GET", "/ready", nil), http.StatusServiceUnavailable, "not_ready"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantErr, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, tt.req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got %d, want %d", rec.Code, tt.wantCode)
+			}
+			var body map[string]map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if e := body["error"]; e["code"] != tt.wantErr || e["request_id"] == "" {
+				t.Fatalf("unexpected envelope %v", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Group runs several MeshServices hosted by one process, e.g. APIs on
+// different ports, with a shared lifecycle: they start together, and when
+// one stops, fails or a shutdown signal arrives, all of them shut down.
+type Group struct {
+	services []*MeshService
+}
+
+// NewGroup returns a Group of services. Each service keeps its own
+// options, registration and heartbeats.
+func NewGroup(services ...*MeshService) *Group {
+	return &Group{services: services}
+}
+
+// Services returns the group's services.
+func (g *Group) Services() []*MeshService {
+	return append([]*MeshService(nil), g.services...)
+}
+
+// Run is like MeshService.Run for the whole group: it starts every service
+// and blocks until ctx is cancelled, a SIGINT/SIGTERM is received, or any
+// service stops, then shuts them all down; a second signal hurries them as
+// it does for Run. One signal handler serves the whole group; per-service
+// LameDuckSignal and ConfigReload are not handled.
+func (g *Group) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	sigCh := make(chan os.Signal, 1)
+	notifySignals(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigCh:
+				if ctx.Err() == nil {
+					cancel(signalCause{sig})
+					continue
+				}
+				for _, s := range g.services {
+					s.hurryShutdown()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return g.Start(ctx)
+}
+
+// Start is like Run but does not install signal handlers. The services
+// start concurrently; Start returns once all have stopped, with the errors
+// of those that failed joined.
+func (g *Group) Start(ctx context.Context) error {
+	if len(g.services) == 0 {
+		return errors.New("runtime: empty group")
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	errs := make([]error, len(g.services))
+	var wg sync.WaitGroup
+	for i, s := range g.services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.start(ctx)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", s.opts.ServiceName, err)
+			}
+			// The first service to stop takes the rest down with it.
+			cancel(fmt.Errorf("group member %s stopped", s.opts.ServiceName))
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Ready reports whether every service in the group is ready for traffic.
+func (g *Group) Ready() bool {
+	for _, s := range g.services {
+		if s.notReadyReason(context.Background()) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadinessHandler serves the group's aggregate readiness: 200 when every
+// service is ready, otherwise 503 naming the services that are not, for a
+// process-level probe.
+func (g *Group) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notReady := make(map[string]string)
+		for _, s := range g.services {
+			if reason := s.notReadyReason(r.Context()); reason != "" {
+				notReady[s.opts.ServiceName] = reason
+			}
+		}
+		code, body := http.StatusOK, any(map[string]string{"status": "Ready"})
+		if len(notReady) > 0 {
+			code, body = http.StatusServiceUnavailable, map[string]any{"status": "NotReady", "services": notReady}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	})
+}
@@ -0,0 +1,92 @@
+package runtime
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	newSvc := func(name string) *MeshService {
+		svc, err := New(
+			WithServiceName(name),
+			WithAddress("127.0.0.1"),
+			WithPort(0),
+			WithDiscoveryAddress(fd.addr),
+			WithHeartbeat(false),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc
+	}
+	orders, billing := newSvc("orders"), newSvc("billing")
+	g := NewGroup(orders, billing)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- g.Start(ctx) }()
+
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 2 })
+	if orders.Addr() == billing.Addr() {
+		t.Fatalf("both services bound %s", orders.Addr())
+	}
+	rec := httptest.NewRecorder()
+	g.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK || !g.Ready() {
+		t.Fatalf("group readiness = %d, want 200", rec.Code)
+	}
+
+	// Stopping one member stops the whole group.
+	if err := billing.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Start = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("group still running after a member stopped")
+	}
+
+	if n := len(fd.Deregisters()); n != 2 {
+		t.Fatalf("deregistrations = %d, want 2", n)
+	}
+	if got := orders.ShutdownReason(); !strings.Contains(got, "billing") {
+		t.Fatalf("orders ShutdownReason = %q, want it to name billing", got)
+	}
+	rec = httptest.NewRecorder()
+	g.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readiness after stop = %d, want 503", rec.Code)
+	}
+}
+
+func TestGroup_FailedMemberStopsOthers(t *testing.T) {
+	ok, err := New(WithServiceName("ok"), WithAddress("127.0.0.1"), WithPort(0), WithAutoRegister(false), WithHeartbeat(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := New(WithServiceName("bad"), WithAddress("127.0.0.1"), WithPort(0), WithAutoRegister(false), WithHeartbeat(false),
+		WithHealthEndpoint("/probe"), WithReadinessEndpoint("/probe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- NewGroup(ok, bad).Start(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "bad:") {
+			t.Fatalf("Start = %v, want the failing member's error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("group still running after a member failed")
+	}
+}
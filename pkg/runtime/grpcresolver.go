@@ -0,0 +1,120 @@
+package runtime
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// MeshScheme is the gRPC target scheme handled by the mesh resolver, as in
+// grpc.NewClient("mesh:///orders").
+const MeshScheme = "mesh"
+
+// roundRobinConfig asks gRPC to spread calls across every resolved instance
+// instead of pinning to the first one.
+const roundRobinConfig = `{"loadBalancingConfig":[{"round_robin":{}}]}`
+
+// GRPCResolverBuilder returns a gRPC resolver.Builder for MeshScheme targets.
+// Instances are resolved through c and re-polled every RefreshInterval, so
+// topology changes reach gRPC's load balancer without redialing. Pass it to
+// grpc.WithResolvers, or install it process-wide with RegisterGRPCResolver.
+func (c *Client) GRPCResolverBuilder() resolver.Builder {
+	return &meshResolverBuilder{client: c}
+}
+
+// RegisterGRPCResolver registers c's resolver builder globally under
+// MeshScheme. Like resolver.Register, it must be called during
+// initialization, before any mesh:/// targets are dialed.
+func RegisterGRPCResolver(c *Client) {
+	resolver.Register(c.GRPCResolverBuilder())
+}
+
+type meshResolverBuilder struct {
+	client *Client
+}
+
+func (b *meshResolverBuilder) Scheme() string { return MeshScheme }
+
+func (b *meshResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &meshResolver{
+		client:  b.client,
+		service: target.Endpoint(),
+		cc:      cc,
+		cancel:  cancel,
+		now:     make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go r.watch(ctx)
+	return r, nil
+}
+
+// meshResolver polls Discovery for one service and pushes the instance
+// addresses to a gRPC ClientConn.
+type meshResolver struct {
+	client  *Client
+	service string
+	cc      resolver.ClientConn
+	cancel  context.CancelFunc
+	now     chan struct{}
+	done    chan struct{}
+}
+
+func (r *meshResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.now <- struct{}{}:
+	default:
+	}
+}
+
+func (r *meshResolver) Close() {
+	r.cancel()
+	<-r.done
+}
+
+func (r *meshResolver) watch(ctx context.Context) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.client.opts.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		r.update(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.now:
+		}
+	}
+}
+
+func (r *meshResolver) update(ctx context.Context) {
+	instances, err := r.client.Resolve(ctx, r.service)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.cc.ReportError(err)
+		}
+		return
+	}
+	if len(instances) == 0 {
+		r.cc.ReportError(ErrNoInstances)
+		return
+	}
+
+	endpoints := make([]resolver.Endpoint, 0, len(instances))
+	for _, inst := range instances {
+		addr := net.JoinHostPort(inst.Address, strconv.Itoa(inst.Port))
+		endpoints = append(endpoints, resolver.Endpoint{
+			Addresses: []resolver.Address{{Addr: addr}},
+		})
+	}
+
+	r.cc.UpdateState(resolver.State{
+		Endpoints:     endpoints,
+		ServiceConfig: r.cc.ParseServiceConfig(roundRobinConfig),
+	})
+}
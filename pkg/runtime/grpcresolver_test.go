@@ -0,0 +1,117 @@
+package runtime
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// recordingClientConn captures the state pushed by a resolver.
+type recordingClientConn struct {
+	resolver.ClientConn // unused methods panic
+
+	mu     sync.Mutex
+	states []resolver.State
+}
+
+func (r *recordingClientConn) UpdateState(s resolver.State) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, s)
+	return nil
+}
+
+func (r *recordingClientConn) ReportError(error) {}
+
+func (r *recordingClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return nil
+}
+
+func (r *recordingClientConn) lastAddrs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.states) == 0 {
+		return nil
+	}
+	var addrs []string
+	for _, ep := range r.states[len(r.states)-1].Endpoints {
+		for _, a := range ep.Addresses {
+			addrs = append(addrs, a.Addr)
+		}
+	}
+	return addrs
+}
+
+func TestGRPCResolver_PushesAddresses(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	fd.addInstance(&pb.ServiceInstance{ServiceName: "orders", ServiceId: "orders-1", Address: "10.0.0.1", Port: 9000})
+
+	c, err := NewClient(WithClientDiscoveryAddress(fd.addr), WithClientRefreshInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cc := &recordingClientConn{}
+	target := resolver.Target{}
+	target.URL.Scheme = MeshScheme
+	target.URL.Path = "/orders"
+	r, err := c.GRPCResolverBuilder().Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	waitFor(t, 2*time.Second, func() bool {
+		addrs := cc.lastAddrs()
+		return len(addrs) == 1 && addrs[0] == "10.0.0.1:9000"
+	})
+
+	// Topology changes are picked up on the next poll.
+	fd.addInstance(&pb.ServiceInstance{ServiceName: "orders", ServiceId: "orders-2", Address: "10.0.0.2", Port: 9000})
+	waitFor(t, 2*time.Second, func() bool { return len(cc.lastAddrs()) == 2 })
+}
+
+func TestGRPCResolver_DialsMeshTarget(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	// The fake Discovery doubles as the gRPC service being dialed.
+	host, port, _ := net.SplitHostPort(fd.addr)
+	p, _ := strconv.Atoi(port)
+	fd.addInstance(&pb.ServiceInstance{ServiceName: "registry", ServiceId: "registry-1", Address: host, Port: int32(p)})
+
+	c, err := NewClient(WithClientDiscoveryAddress(fd.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn, err := grpc.NewClient(
+		MeshScheme+":///registry",
+		grpc.WithResolvers(c.GRPCResolverBuilder()),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := pb.NewDiscoveryRegistryClient(conn).GetInstances(ctx, &pb.GetInstancesRequest{ServiceName: "registry"})
+	if err != nil {
+		t.Fatalf("call through mesh resolver: %v", err)
+	}
+	if len(resp.Instances) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(resp.Instances))
+	}
+}
@@ -0,0 +1,422 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// HealthFormat is the body schema of the health and readiness endpoints.
+type HealthFormat string
+
+const (
+	// HealthFormatSimple is the runtime's own flat schema, e.g.
+	// {"status":"Healthy","service":"orders","id":"orders-1"}.
+	HealthFormatSimple HealthFormat = "simple"
+	// HealthFormatIETF is the application/health+json schema of the IETF
+	// health check draft (draft-inadarei-api-health-check): "status" is
+	// "pass" or "fail", with the reason in "output" and one entry per
+	// health checker under "checks".
+	HealthFormatIETF HealthFormat = "health+json"
+)
+
+func (s *MeshService) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if s.opts.HealthQueryKey != "" {
+		switch r.URL.Query().Get(s.opts.HealthQueryKey) {
+		case "ready", "readiness":
+			s.readinessHandler(w, r)
+			return
+		}
+	}
+	if s.opts.HealthFormat == HealthFormatIETF {
+		s.healthJSONHandler(w, r)
+		return
+	}
+
+	if s.draining.Load() {
+		s.writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status":  "Draining",
+			"service": s.opts.ServiceName,
+			"id":      s.opts.ServiceID,
+		})
+		return
+	}
+	if reason := s.unhealthy.Load(); reason != nil {
+		s.writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status":  "Unhealthy",
+			"service": s.opts.ServiceName,
+			"id":      s.opts.ServiceID,
+			"reason":  *reason,
+		})
+		return
+	}
+
+	err := s.runHealthCheckers(r.Context())
+	s.recordHealthChecks(err)
+	if err != nil {
+		s.writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status":  "Unhealthy",
+			"service": s.opts.ServiceName,
+			"id":      s.opts.ServiceID,
+			"reason":  err.Error(),
+		})
+		return
+	}
+
+	if s.opts.HealthResponse != nil {
+		s.writeJSON(w, http.StatusOK, s.opts.HealthResponse(r))
+		return
+	}
+
+	body := map[string]string{
+		"status":  "Healthy",
+		"service": s.opts.ServiceName,
+		"id":      s.opts.ServiceID,
+	}
+	if s.opts.Registrar == nil && (s.opts.AutoRegister || s.opts.HeartbeatEnabled) {
+		// Surfaces Discovery connection trouble that otherwise only shows
+		// up as heartbeat warnings.
+		body["discovery"] = s.DiscoveryConnState().String()
+	}
+	if s.opts.ReportRegistration {
+		body["registered"] = strconv.FormatBool(s.IsRegistered())
+	}
+	if c := s.capacityLabel(); c != "" {
+		body["capacity"] = c
+	}
+	s.writeJSON(w, http.StatusOK, body)
+}
+
+// HealthChecker reports why the service is unhealthy, or nil if it is
+// fine. See WithHealthChecker.
+type HealthChecker func(ctx context.Context) error
+
+// ErrFatal marks a health check failure the instance cannot recover from.
+// Checkers wrap it (fmt.Errorf("...: %w", runtime.ErrFatal)) to have the
+// service shut down when ShutdownOnFatalCheck is set.
+var ErrFatal = errors.New("runtime: fatal")
+
+// runHealthCheckers runs the configured checkers in name order and returns
+// the first failure, prefixed with the checker's name.
+func (s *MeshService) runHealthCheckers(ctx context.Context) error {
+	if len(s.opts.HealthCheckers) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.opts.HealthTimeout)
+	defer cancel()
+
+	for _, name := range slices.Sorted(maps.Keys(s.opts.HealthCheckers)) {
+		if err := s.runHealthChecker(ctx, name); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// runAllHealthCheckers runs every configured checker, in name order, and
+// returns each one's result.
+func (s *MeshService) runAllHealthCheckers(ctx context.Context) map[string]error {
+	if len(s.opts.HealthCheckers) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.opts.HealthTimeout)
+	defer cancel()
+
+	results := make(map[string]error, len(s.opts.HealthCheckers))
+	for _, name := range slices.Sorted(maps.Keys(s.opts.HealthCheckers)) {
+		results[name] = s.runHealthChecker(ctx, name)
+	}
+	return results
+}
+
+// runHealthChecker runs the named checker, shutting down on ErrFatal if
+// ShutdownOnFatalCheck is set.
+func (s *MeshService) runHealthChecker(ctx context.Context, name string) error {
+	err := s.opts.HealthCheckers[name](ctx)
+	if errors.Is(err, ErrFatal) && s.opts.ShutdownOnFatalCheck {
+		s.shutdownOnFatal(fmt.Errorf("%s: %w", name, err))
+	}
+	return err
+}
+
+// firstHealthFailure returns the first failure, in name order, among the
+// results of runAllHealthCheckers, or nil if all passed.
+func firstHealthFailure(results map[string]error) error {
+	for _, name := range slices.Sorted(maps.Keys(results)) {
+		if err := results[name]; err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// healthResult is a cached HealthCheckers outcome.
+type healthResult struct {
+	failure string // first failure; "" = all passed
+	at      time.Time
+}
+
+// recordHealthChecks caches the latest HealthCheckers result for
+// readiness and heartbeats, logging when it changes.
+func (s *MeshService) recordHealthChecks(err error) {
+	next := &healthResult{at: time.Now()}
+	if err != nil {
+		next.failure = err.Error()
+	}
+	prev := s.checks.Swap(next)
+	switch {
+	case err != nil && (prev == nil || prev.failure == ""):
+		s.logger.Warn("health check failing", "service", s.opts.ServiceName, "error", err)
+	case err == nil && prev != nil && prev.failure != "":
+		s.logger.Info("health checks passing", "service", s.opts.ServiceName)
+	}
+}
+
+// healthCheckFailure returns the cached HealthCheckers failure, running
+// the checkers again once the result is older than HealthCacheTTL.
+func (s *MeshService) healthCheckFailure(ctx context.Context) string {
+	if len(s.opts.HealthCheckers) == 0 {
+		return ""
+	}
+	if c := s.checks.Load(); c != nil && time.Since(c.at) < s.opts.HealthCacheTTL {
+		return c.failure
+	}
+	err := s.runHealthCheckers(ctx)
+	s.recordHealthChecks(err)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// RefreshHealth re-runs every health checker now rather than at the next
+// probe, heartbeat or HealthCacheTTL expiry, and updates the cached result
+// that readiness (with HealthGatesReadiness) and heartbeats (with
+// HealthGatesHeartbeat) report. With HealthGatesHeartbeat, a running
+// service that has not been withdrawn also sends Discovery an out-of-band
+// heartbeat so the new status propagates at once. It returns the first
+// failing checker's error, or nil if all pass; a failed heartbeat is
+// logged, not returned.
+func (s *MeshService) RefreshHealth(ctx context.Context) error {
+	err := firstHealthFailure(s.runAllHealthCheckers(ctx))
+	s.recordHealthChecks(err)
+
+	if r := s.currentRegistrar(); r != nil && s.opts.HealthGatesHeartbeat && s.opts.HeartbeatEnabled && !s.withdrawn.Load() {
+		hbCtx, cancel := context.WithTimeout(ctx, s.heartbeatTimeout())
+		defer cancel()
+		s.heartbeat(hbCtx, r)
+	}
+	return err
+}
+
+// shutdownOnFatal begins a graceful shutdown, as Stop does, without
+// waiting for it.
+func (s *MeshService) shutdownOnFatal(err error) {
+	s.mu.Lock()
+	stop := s.stopRun
+	s.mu.Unlock()
+	if stop != nil {
+		s.logger.Error("fatal health check; shutting down", "service", s.opts.ServiceName, "error", err)
+		stop(fmt.Errorf("fatal health check: %w", err))
+	}
+}
+
+// readinessHandler reports whether the instance should receive new traffic.
+func (s *MeshService) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if s.opts.HealthFormat == HealthFormatIETF {
+		s.writeHealthJSON(w, s.notReadyReason(r.Context()), nil)
+		return
+	}
+	if reason := s.notReadyReason(r.Context()); reason != "" {
+		WriteError(w, http.StatusServiceUnavailable, "not_ready", reason)
+		return
+	}
+	body := map[string]string{"status": "Ready"}
+	if s.opts.ReportRegistration {
+		body["registered"] = strconv.FormatBool(s.IsRegistered())
+	}
+	s.writeJSON(w, http.StatusOK, body)
+}
+
+// notReadyReason returns why the instance should not receive new traffic,
+// or "" if it should.
+func (s *MeshService) notReadyReason(ctx context.Context) string {
+	unhealthy := s.unhealthy.Load()
+	switch {
+	case s.draining.Load():
+		return "draining"
+	case s.lameDuck.Load():
+		return "lame duck"
+	case unhealthy != nil:
+		return "unhealthy: " + *unhealthy
+	case s.opts.ReadyAfterRegistration && s.opts.AutoRegister && !s.registered.Load():
+		return "not registered"
+	}
+	if s.opts.HealthGatesReadiness {
+		if failure := s.healthCheckFailure(ctx); failure != "" {
+			return "health check: " + failure
+		}
+	}
+	return ""
+}
+
+// healthJSON is the application/health+json body (HealthFormatIETF).
+type healthJSON struct {
+	Status      string                       `json:"status"`
+	Output      string                       `json:"output,omitempty"`
+	ServiceID   string                       `json:"serviceId,omitempty"`
+	Description string                       `json:"description,omitempty"`
+	Checks      map[string][]healthJSONCheck `json:"checks,omitempty"`
+}
+
+type healthJSONCheck struct {
+	ComponentType string `json:"componentType,omitempty"`
+	ObservedValue any    `json:"observedValue,omitempty"`
+	Status        string `json:"status"`
+	Output        string `json:"output,omitempty"`
+}
+
+// healthJSONHandler is the health endpoint for HealthFormatIETF. Unlike
+// the simple format it runs every checker, so all failures are reported.
+func (s *MeshService) healthJSONHandler(w http.ResponseWriter, r *http.Request) {
+	var reason string
+	if s.draining.Load() {
+		reason = "draining"
+	} else if unhealthy := s.unhealthy.Load(); unhealthy != nil {
+		reason = "unhealthy: " + *unhealthy
+	}
+
+	checks := make(map[string][]healthJSONCheck)
+	results := s.runAllHealthCheckers(r.Context())
+	failure := firstHealthFailure(results)
+	s.recordHealthChecks(failure)
+	if reason == "" && failure != nil {
+		reason = failure.Error()
+	}
+	for name, err := range results {
+		check := healthJSONCheck{Status: "pass"}
+		if err != nil {
+			check.Status, check.Output = "fail", err.Error()
+		}
+		checks[name] = []healthJSONCheck{check}
+	}
+
+	if reason == "" && s.opts.HealthResponse != nil {
+		s.writeJSON(w, http.StatusOK, s.opts.HealthResponse(r))
+		return
+	}
+	if c, ok := s.capacity(); ok {
+		checks["capacity:score"] = []healthJSONCheck{{ComponentType: "system", ObservedValue: c, Status: "pass"}}
+	}
+	s.writeHealthJSON(w, reason, checks)
+}
+
+// writeHealthJSON writes a health+json body that passes if reason is "".
+// The Discovery connection and registration state are added as
+// informational checks.
+func (s *MeshService) writeHealthJSON(w http.ResponseWriter, reason string, checks map[string][]healthJSONCheck) {
+	if checks == nil {
+		checks = make(map[string][]healthJSONCheck)
+	}
+	if s.opts.ReportRegistration {
+		registered := s.IsRegistered()
+		check := healthJSONCheck{ComponentType: "system", ObservedValue: registered, Status: "pass"}
+		if !registered {
+			check.Status = "warn"
+		}
+		checks["discovery:registered"] = []healthJSONCheck{check}
+	}
+
+	code, status := http.StatusOK, "pass"
+	if reason != "" {
+		code, status = http.StatusServiceUnavailable, "fail"
+	}
+	w.Header().Set("Content-Type", "application/health+json")
+	s.writeJSON(w, code, healthJSON{
+		Status:      status,
+		Output:      reason,
+		ServiceID:   s.opts.ServiceID,
+		Description: s.opts.ServiceName,
+		Checks:      checks,
+	})
+}
+
+type serviceKey struct{}
+
+// ServiceFromContext returns the MeshService handling the request in ctx,
+// and false outside a MeshService handler.
+func ServiceFromContext(ctx context.Context) (*MeshService, bool) {
+	s, ok := ctx.Value(serviceKey{}).(*MeshService)
+	return s, ok
+}
+
+// withService makes s available to handlers through the request context.
+func (s *MeshService) withService(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), serviceKey{}, s)))
+	})
+}
+
+// MarkUnhealthy marks the service handling the request in ctx as
+// unhealthy: health and readiness probes fail and heartbeats report
+// UNHEALTHY with reason, so the mesh routes away from it. Use it from a
+// handler that detects a fatal condition. Outside a MeshService handler it
+// does nothing.
+func MarkUnhealthy(ctx context.Context, reason string) {
+	if s, ok := ServiceFromContext(ctx); ok {
+		if s.unhealthy.Swap(&reason) == nil {
+			s.logger.Error("service marked unhealthy", "service", s.opts.ServiceName, "reason", reason)
+		}
+	}
+}
+
+// MarkHealthy undoes MarkUnhealthy.
+func MarkHealthy(ctx context.Context) {
+	if s, ok := ServiceFromContext(ctx); ok {
+		if s.unhealthy.Swap(nil) != nil {
+			s.logger.Info("service marked healthy", "service", s.opts.ServiceName)
+		}
+	}
+}
+
+// enterLameDuck stops the instance from attracting new traffic without
+// shutting it down: readiness fails and heartbeats report DEGRADED.
+func (s *MeshService) enterLameDuck() {
+	if s.lameDuck.CompareAndSwap(false, true) {
+		s.logger.Info("entering lame-duck mode", "service", s.opts.ServiceName)
+	}
+}
+
+// writeJSON encodes v before writing anything, so an encoding failure turns
+// into a clean 500 instead of a 200 with a truncated body.
+func (s *MeshService) writeJSON(w http.ResponseWriter, status int, v any) {
+	var buf bytes.Buffer
+	if err := s.newJSONEncoder(&buf).Encode(v); err != nil {
+		s.logger.Error("encode response failed", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func (s *MeshService) newJSONEncoder(w io.Writer) JSONEncoder {
+	if s.opts.JSONEncoder != nil {
+		return s.opts.JSONEncoder(w)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(!s.opts.DisableHTMLEscape)
+	return enc
+}
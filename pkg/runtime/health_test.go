@@ -0,0 +1,640 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+)
+
+func TestHealthHandler_CustomResponse(t *testing.T) {
+	svc, err := New(
+		WithServiceName("custom-health"),
+		WithHealthResponse(func(r *http.Request) any {
+			return map[string]any{"status": "Healthy", "queue_depth": 3}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	svc.healthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body["queue_depth"] != float64(3) {
+		t.Fatalf("expected custom body, got %v", body)
+	}
+}
+
+func TestHealthHandler_EncodeFailureReturns500(t *testing.T) {
+	svc, err := New(
+		WithServiceName("broken-health"),
+		WithHealthResponse(func(r *http.Request) any {
+			return map[string]any{"status": "Healthy", "bad": make(chan int)}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	svc.healthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+	if json.Valid(rec.Body.Bytes()) {
+		t.Fatalf("expected no partial JSON body, got %q", rec.Body.String())
+	}
+}
+
+func TestReadiness_ReadyAfterRegistration(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	release := make(chan struct{})
+	fd.registerHook = func(ctx context.Context, _ *pb.RegisterServiceRequest) error {
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	svc, err := New(
+		WithServiceName("gated"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithReadyAfterRegistration(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, _ := runService(t, svc)
+	ready := func() int {
+		resp, err := http.Get("http://" + addr + "/ready")
+		if err != nil {
+			t.Fatalf("GET /ready: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before registration, got %d", code)
+	}
+	close(release)
+	waitFor(t, 2*time.Second, func() bool { return ready() == http.StatusOK })
+}
+
+func TestProbes_Draining(t *testing.T) {
+	svc, err := New(WithServiceName("draining"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe := func(h http.HandlerFunc) int {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	if code := probe(svc.readinessHandler); code != http.StatusOK {
+		t.Fatalf("readiness before drain: got %d", code)
+	}
+
+	svc.draining.Store(true)
+
+	if code := probe(svc.readinessHandler); code != http.StatusServiceUnavailable {
+		t.Fatalf("readiness while draining: got %d, want 503", code)
+	}
+	if code := probe(svc.healthHandler); code != http.StatusServiceUnavailable {
+		t.Fatalf("health while draining: got %d, want 503", code)
+	}
+}
+
+func TestHealthHandler_QueryMode(t *testing.T) {
+	svc, err := New(WithServiceName("query-mode"), WithHealthQueryMode(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.enterLameDuck() // alive but not ready, so the two modes differ
+
+	tests := []struct {
+		target string
+		want   int
+		status string
+	}{
+		{target: "/health", want: http.StatusOK, status: "Healthy"},
+		{target: "/health?type=live", want: http.StatusOK, status: "Healthy"},
+		{target: "/health?type=ready", want: http.StatusServiceUnavailable, status: "not_ready"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			svc.healthHandler(rec, httptest.NewRequest("GET", tt.target, nil))
+			if rec.Code != tt.want {
+				t.Fatalf("got %d, want %d", rec.Code, tt.want)
+			}
+			var body struct {
+				Status string `json:"status"`
+				Error  struct {
+					Code string `json:"code"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			got := body.Status
+			if got == "" {
+				got = body.Error.Code
+			}
+			if got != tt.status {
+				t.Fatalf("status = %q, want %q", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestHealthHandler_JSONEncoding(t *testing.T) {
+	body := func(r *http.Request) any { return map[string]string{"status": "<ok>"} }
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{name: "default escapes HTML", want: `{"status":"\u003cok\u003e"}`},
+		{name: "HTML escape disabled", opts: []Option{WithDisableHTMLEscape(true)}, want: `{"status":"<ok>"}`},
+		{
+			name: "custom encoder",
+			opts: []Option{WithJSONEncoder(func(w io.Writer) JSONEncoder {
+				enc := json.NewEncoder(w)
+				enc.SetIndent("", " ")
+				return enc
+			})},
+			want: "{\n \"status\": \"\\u003cok\\u003e\"\n}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithServiceName("json"), WithHealthResponse(body)}, tt.opts...)
+			svc, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			svc.healthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+				t.Fatalf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkUnhealthy(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	svc, err := New(
+		WithServiceName("self-aware"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(20*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.HandleFunc("POST /corrupt", func(w http.ResponseWriter, r *http.Request) {
+		MarkUnhealthy(r.Context(), "index corrupted")
+	})
+	svc.HandleFunc("POST /repaired", func(w http.ResponseWriter, r *http.Request) {
+		MarkHealthy(r.Context())
+	})
+
+	addr, _ := runService(t, svc)
+	do := func(method, path string) int {
+		req, _ := http.NewRequest(method, "http://"+addr+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := do("GET", "/ready"); code != http.StatusOK {
+		t.Fatalf("readiness before: %d", code)
+	}
+	do("POST", "/corrupt")
+	if code := do("GET", "/ready"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readiness after MarkUnhealthy: %d, want 503", code)
+	}
+	if code := do("GET", "/health"); code != http.StatusServiceUnavailable {
+		t.Fatalf("health after MarkUnhealthy: %d, want 503", code)
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		reports := fd.Reports()
+		last := len(reports) - 1
+		return last >= 0 && reports[last].Status == pb.HealthStatus_HEALTH_STATUS_UNHEALTHY &&
+			reports[last].Output == "index corrupted"
+	})
+
+	do("POST", "/repaired")
+	if code := do("GET", "/ready"); code != http.StatusOK {
+		t.Fatalf("readiness after MarkHealthy: %d, want 200", code)
+	}
+}
+
+func TestHealthCheckers(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	failing := func(context.Context) error { return errors.New("disk full") }
+
+	tests := []struct {
+		name       string
+		checkers   map[string]HealthChecker
+		wantCode   int
+		wantReason string
+	}{
+		{name: "all pass", checkers: map[string]HealthChecker{"a": ok, "b": ok}, wantCode: http.StatusOK},
+		{
+			name:       "one fails",
+			checkers:   map[string]HealthChecker{"a": ok, "disk": failing},
+			wantCode:   http.StatusServiceUnavailable,
+			wantReason: "disk: disk full",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{WithServiceName("checked")}
+			for name, c := range tt.checkers {
+				opts = append(opts, WithHealthChecker(name, c))
+			}
+			svc, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			svc.healthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			var body map[string]string
+			json.NewDecoder(rec.Body).Decode(&body)
+			if body["reason"] != tt.wantReason {
+				t.Fatalf("reason = %q, want %q", body["reason"], tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestHealthCheckers_FatalShutsDown(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	svc, err := New(
+		WithServiceName("doomed"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithShutdownOnFatalCheck(true),
+		WithHealthChecker("db", func(context.Context) error {
+			return fmt.Errorf("schema mismatch: %w", ErrFatal)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- svc.Start(context.Background()) }()
+	waitFor(t, 2*time.Second, svc.registered.Load)
+
+	resp, err := http.Get("http://" + svc.Addr() + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("health = %d, want 503", resp.StatusCode)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrFatal) || !strings.Contains(err.Error(), "db: schema mismatch") {
+			t.Fatalf("Start = %v, want the fatal check error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("service did not shut down after a fatal check")
+	}
+	if n := len(fd.Deregisters()); n != 1 {
+		t.Fatalf("deregistered %d times, want 1", n)
+	}
+	if got := svc.ShutdownReason(); !strings.Contains(got, "fatal health check: db: schema mismatch") {
+		t.Fatalf("ShutdownReason = %q", got)
+	}
+}
+
+func TestRefreshHealth(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	var broken atomic.Bool
+	broken.Store(true)
+	svc, err := New(
+		WithServiceName("refreshed"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(time.Hour), // no scheduled heartbeat during the test
+		WithHealthGatesReadiness(true),
+		WithHealthGatesHeartbeat(true),
+		WithHealthCacheTTL(time.Hour),
+		WithHealthChecker("db", func(context.Context) error {
+			if broken.Load() {
+				return errors.New("connection refused")
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+
+	ready := func() int {
+		resp, err := http.Get("http://" + addr + "/ready")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	lastReport := func() *pb.ReportHealthRequest {
+		reports := fd.Reports()
+		if len(reports) == 0 {
+			t.Fatal("no heartbeat sent")
+		}
+		return reports[len(reports)-1]
+	}
+
+	if err := svc.RefreshHealth(context.Background()); err == nil || err.Error() != "db: connection refused" {
+		t.Fatalf("RefreshHealth = %v, want db: connection refused", err)
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("readiness while failing = %d, want 503", code)
+	}
+	if r := lastReport(); r.Status != pb.HealthStatus_HEALTH_STATUS_UNHEALTHY || r.Output != "db: connection refused" {
+		t.Fatalf("heartbeat = %v %q, want UNHEALTHY", r.Status, r.Output)
+	}
+
+	// The cached result stands until something re-runs the checkers.
+	broken.Store(false)
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("readiness before refresh = %d, want 503", code)
+	}
+	if err := svc.RefreshHealth(context.Background()); err != nil {
+		t.Fatalf("RefreshHealth = %v, want nil", err)
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("readiness after refresh = %d, want 200", code)
+	}
+	if r := lastReport(); r.Status != pb.HealthStatus_HEALTH_STATUS_HEALTHY {
+		t.Fatalf("heartbeat = %v, want HEALTHY", r.Status)
+	}
+	if n := len(fd.Reports()); n != 2 {
+		t.Fatalf("sent %d heartbeats, want 2 out-of-band ones", n)
+	}
+}
+
+func TestHealthGatesHeartbeat(t *testing.T) {
+	tests := []struct {
+		name       string
+		gate       bool
+		wantStatus pb.HealthStatus
+		wantOutput string
+		wantRuns   int32 // checker runs from one heartbeat and one RefreshHealth
+		wantSent   int   // heartbeats sent, counting RefreshHealth's
+	}{
+		{name: "off", gate: false, wantStatus: pb.HealthStatus_HEALTH_STATUS_DEGRADED, wantOutput: "warming up",
+			wantRuns: 1, wantSent: 1},
+		{name: "on", gate: true, wantStatus: pb.HealthStatus_HEALTH_STATUS_UNHEALTHY, wantOutput: "db: connection refused",
+			wantRuns: 2, wantSent: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			var runs atomic.Int32
+			svc, err := New(
+				WithServiceName("gated"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHealthInterval(time.Hour), // heartbeats are sent by hand below
+				WithHealthGatesHeartbeat(tt.gate),
+				WithHeartbeatPayload(func() (HealthStatus, string) { return StatusDegraded, "warming up" }),
+				WithHealthChecker("db", func(context.Context) error {
+					runs.Add(1)
+					return errors.New("connection refused")
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runService(t, svc)
+			waitFor(t, 2*time.Second, svc.registered.Load)
+
+			svc.sendHeartbeat(context.Background(), svc.currentRegistrar())
+			svc.RefreshHealth(context.Background())
+
+			reports := fd.Reports()
+			if len(reports) != tt.wantSent {
+				t.Fatalf("sent %d heartbeats, want %d", len(reports), tt.wantSent)
+			}
+			if r := reports[len(reports)-1]; r.Status != tt.wantStatus || r.Output != tt.wantOutput {
+				t.Fatalf("heartbeat = %v %q, want %v %q", r.Status, r.Output, tt.wantStatus, tt.wantOutput)
+			}
+			if n := runs.Load(); n != tt.wantRuns {
+				t.Fatalf("checker ran %d times, want %d", n, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestHealthGatesReadiness(t *testing.T) {
+	var broken atomic.Bool
+	broken.Store(true)
+	checker := WithHealthChecker("db", func(context.Context) error {
+		if broken.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	tests := []struct {
+		name      string
+		opts      []Option
+		wantFirst int // readiness while the checker fails
+		wantAfter int // readiness once it recovers, after the cache TTL
+	}{
+		{name: "off", opts: nil, wantFirst: http.StatusOK, wantAfter: http.StatusOK},
+		{name: "no cache", opts: []Option{WithHealthGatesReadiness(true)},
+			wantFirst: http.StatusServiceUnavailable, wantAfter: http.StatusOK},
+		{name: "cached", opts: []Option{WithHealthGatesReadiness(true), WithHealthCacheTTL(50 * time.Millisecond)},
+			wantFirst: http.StatusServiceUnavailable, wantAfter: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broken.Store(true)
+			svc, err := New(append([]Option{WithServiceName("gated"), checker}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ready := func() int {
+				rec := httptest.NewRecorder()
+				svc.readinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+				return rec.Code
+			}
+
+			if code := ready(); code != tt.wantFirst {
+				t.Fatalf("readiness while failing = %d, want %d", code, tt.wantFirst)
+			}
+			broken.Store(false)
+			time.Sleep(60 * time.Millisecond)
+			if code := ready(); code != tt.wantAfter {
+				t.Fatalf("readiness after recovery = %d, want %d", code, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func TestHealthFormat(t *testing.T) {
+	failing := func(context.Context) error { return errors.New("disk full") }
+
+	tests := []struct {
+		name       string
+		format     HealthFormat
+		checker    HealthChecker
+		wantCode   int
+		wantType   string
+		wantHealth string // expected body["status"] of the health endpoint
+		wantReady  string // expected body["status"] of the readiness endpoint
+		wantCheck  string // expected status of the "disk" check; "" = no checks
+		wantOutput bool   // whether "output" explains the failure
+	}{
+		{
+			name: "simple healthy", format: HealthFormatSimple, checker: nil,
+			wantCode: http.StatusOK, wantType: "application/json", wantHealth: "Healthy", wantReady: "Ready",
+		},
+		{
+			name: "ietf healthy", format: HealthFormatIETF, checker: func(context.Context) error { return nil },
+			wantCode: http.StatusOK, wantType: "application/health+json", wantHealth: "pass", wantReady: "pass",
+			wantCheck: "pass",
+		},
+		{
+			name: "ietf unhealthy", format: HealthFormatIETF, checker: failing,
+			wantCode: http.StatusServiceUnavailable, wantType: "application/health+json", wantHealth: "fail", wantReady: "pass",
+			wantCheck: "fail", wantOutput: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{WithServiceName("formatted"), WithServiceID("formatted-1"), WithHealthFormat(tt.format)}
+			if tt.checker != nil {
+				opts = append(opts, WithHealthChecker("disk", tt.checker))
+			}
+			svc, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			svc.healthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("health status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != tt.wantType {
+				t.Fatalf("Content-Type = %q, want %q", ct, tt.wantType)
+			}
+			var body struct {
+				Status    string `json:"status"`
+				Output    string `json:"output"`
+				ServiceID string `json:"serviceId"`
+				Checks    map[string][]struct {
+					Status string `json:"status"`
+					Output string `json:"output"`
+				} `json:"checks"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode %q: %v", rec.Body.String(), err)
+			}
+			if body.Status != tt.wantHealth {
+				t.Fatalf("health body status = %q, want %q", body.Status, tt.wantHealth)
+			}
+			if tt.format == HealthFormatIETF && body.ServiceID != "formatted-1" {
+				t.Fatalf("serviceId = %q, want formatted-1", body.ServiceID)
+			}
+			if tt.wantCheck != "" {
+				disk := body.Checks["disk"]
+				if len(disk) != 1 || disk[0].Status != tt.wantCheck {
+					t.Fatalf("checks = %+v, want disk %s", body.Checks, tt.wantCheck)
+				}
+			}
+			if got := strings.Contains(body.Output, "disk full"); got != tt.wantOutput {
+				t.Fatalf("output = %q, want failure explained = %v", body.Output, tt.wantOutput)
+			}
+
+			rec = httptest.NewRecorder()
+			svc.readinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+			var ready map[string]any
+			json.Unmarshal(rec.Body.Bytes(), &ready)
+			if rec.Code != http.StatusOK || ready["status"] != tt.wantReady {
+				t.Fatalf("readiness = %d %v, want 200 status %q", rec.Code, ready, tt.wantReady)
+			}
+		})
+	}
+}
+
+func TestHealthFormat_IETFNotReady(t *testing.T) {
+	svc, err := New(WithServiceName("formatted"), WithHealthFormat(HealthFormatIETF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.draining.Store(true)
+
+	rec := httptest.NewRecorder()
+	svc.readinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	var body map[string]any
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusServiceUnavailable || body["status"] != "fail" || body["output"] != "draining" {
+		t.Fatalf("readiness = %d %v, want 503 fail draining", rec.Code, body)
+	}
+
+	if _, err := New(WithHealthFormat("yaml")); err == nil {
+		t.Fatal("New accepted an unknown health format")
+	}
+}
@@ -0,0 +1,69 @@
+//go:build unix
+
+package runtime
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+)
+
+func TestReadiness_LameDuckSignal(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("lame-duck"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(20*time.Millisecond),
+		WithLameDuckSignal(syscall.SIGUSR1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- svc.Run(ctx) }()
+	waitFor(t, 2*time.Second, func() bool { return svc.Addr() != "" })
+
+	ready := func() int {
+		resp, err := http.Get("http://" + svc.Addr() + "/ready")
+		if err != nil {
+			t.Fatalf("GET /ready: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("expected 200 before signal, got %d", code)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, func() bool { return ready() == http.StatusServiceUnavailable })
+
+	// Still serving, and Discovery now hears DEGRADED.
+	resp, err := http.Get("http://" + svc.Addr() + "/health")
+	if err != nil {
+		t.Fatalf("server should keep serving in lame-duck mode: %v", err)
+	}
+	resp.Body.Close()
+	waitFor(t, 2*time.Second, func() bool {
+		reports := fd.Reports()
+		return len(reports) > 0 && reports[len(reports)-1].Status == pb.HealthStatus_HEALTH_STATUS_DEGRADED
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runService starts svc in the background and waits for it to bind. The
+// returned stop function cancels the service and returns the Start error.
+func runService(t *testing.T, svc *MeshService) (addr string, stop func() error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var startErr error
+	go func() {
+		defer close(done)
+		startErr = svc.Start(ctx)
+	}()
+
+	stop = func() error {
+		cancel()
+		<-done
+		return startErr
+	}
+	t.Cleanup(func() { stop() })
+
+	for range 200 {
+		if addr = svc.Addr(); addr != "" {
+			return addr, stop
+		}
+		select {
+		case <-done:
+			t.Fatalf("service exited before binding: %v", startErr)
+		default:
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("service did not bind")
+	return "", stop
+}
+
+// waitFor polls cond until it returns true or the timeout elapses.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes and reads, used to
+// capture log output from background goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
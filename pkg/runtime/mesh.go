@@ -16,78 +16,429 @@ package runtime
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
+// ErrNotStarted is returned by Stop when the service has not been started.
+var ErrNotStarted = errors.New("runtime: service not started")
+
+// errStopCalled is the cancellation cause recorded when Stop is called.
+var errStopCalled = errors.New("stop requested")
+
 // MeshService is a mesh-aware HTTP service that auto-registers with Discovery,
 // sends heartbeats, and deregisters on shutdown.
 type MeshService struct {
-	opts   ServiceOptions
-	mux    *http.ServeMux
-	logger *slog.Logger
+	opts     ServiceOptions
+	mux      *http.ServeMux
+	logger   *slog.Logger
+	logLevel *slog.LevelVar // level of the default logger
+	stats    StatsSink
 
 	// Set after Start; used by tests.
 	boundAddr string
 	mu        sync.Mutex
+
+	routes []string // patterns passed to Handle; guarded by mu
+
+	// Address and port advertised to Discovery, fixed once bound.
+	advertisedAddr string
+	advertisedPort int
+
+	// optsMu guards writes to the reloadable options and Options' snapshot
+	// of them. Writers also hold regMu; it is separate so Options can be
+	// called from a BeforeRegister hook, which runs under regMu.
+	optsMu sync.Mutex
+
+	// regMu serializes registration-state transitions (initial
+	// registration, heartbeat-driven refreshes, and explicit
+	// Deregister/Reregister) and guards the fields below.
+	regMu            sync.Mutex
+	advertisedWeight int  // weight sent in the last successful Register
+	regUncertain     bool // a Register was cut off and may have landed
+	registered       atomic.Bool
+	withdrawn        atomic.Bool // Deregister was called; only Reregister undoes it
+	deregistered     atomic.Bool // a Deregister succeeded and no Register has been sent since
+	lastRegistered   time.Time   // time of the last successful Register
+	advertisedCap    string      // "capacity" sent in the last successful Register
+
+	leaseTTL     atomic.Int64  // registration lease TTL in nanoseconds; 0 = unknown
+	leaseChanged chan struct{} // wakes the heartbeat loop to pick up a new TTL
+
+	heartbeatFailures int // consecutive failed heartbeats; heartbeat goroutine only
+
+	registrar      Registrar                  // set while running; guarded by mu
+	discovery      pb.DiscoveryRegistryClient // set while running with the default registrar; guarded by mu
+	discoveryConns []*grpc.ClientConn         // kept after stop; guarded by mu
+
+	shutdownReason string // guarded by mu
+
+	// When the listener was bound; guarded by mu. It carries a monotonic
+	// clock reading, so durations from it ignore wall-clock steps.
+	startedAt time.Time
+
+	// Set when start begins; guarded by mu. Used by Stop.
+	stopRun context.CancelCauseFunc
+	stopped chan struct{}
+
+	// hurry is closed when a second shutdown signal asks Run to skip the
+	// rest of the drain.
+	hurry     chan struct{}
+	hurryOnce sync.Once
+
+	lameDuck  atomic.Bool
+	unhealthy atomic.Pointer[string] // reason given to MarkUnhealthy; nil = healthy
+	draining  atomic.Bool            // set once shutdown begins; read on every probe
+
+	// weightDrained is set by a WeightedDrain at shutdown; weight then
+	// returns drainWeight.
+	weightDrained atomic.Bool
+
+	// checks is the latest HealthCheckers result, from a health probe,
+	// heartbeat, readiness probe or RefreshHealth; nil = never run.
+	checks atomic.Pointer[healthResult]
 }
 
 // New creates a MeshService with the given functional options.
+// It is shorthand for NewWithContext(context.Background(), opts...).
 func New(opts ...Option) (*MeshService, error) {
+	return NewWithContext(context.Background(), opts...)
+}
+
+// NewWithContext creates a MeshService with the given functional options.
+// Validation runs under ctx; if ctx is cancelled or expires before it
+// completes, NewWithContext returns the context error.
+func NewWithContext(ctx context.Context, opts ...Option) (*MeshService, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("runtime: %w", err)
+	}
+
 	o := DefaultOptions()
 	for _, fn := range opts {
 		fn(&o)
 	}
+	// An option may have replaced the options wholesale; metadata files
+	// and Reload write into the map.
+	if o.Metadata == nil {
+		o.Metadata = make(map[string]string)
+	}
 
 	if o.ServiceName == "" {
 		return nil, fmt.Errorf("runtime: ServiceName is required")
 	}
 
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(o.LogLevel)
+	logger := o.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
+	}
+	if len(o.LogAttrs) > 0 {
+		args := make([]any, len(o.LogAttrs))
+		for i, a := range o.LogAttrs {
+			args[i] = a
+		}
+		logger = logger.With(args...)
+	}
+
+	if o.HealthInterval <= 0 {
+		return nil, fmt.Errorf("runtime: HealthInterval must be positive, got %v", o.HealthInterval)
+	}
+	if o.HealthTimeout >= o.HealthInterval {
+		// A heartbeat that may outlive its interval lets calls pile up.
+		clamped := o.HealthInterval / 2
+		logger.Warn("HealthTimeout must be shorter than HealthInterval; clamping",
+			"healthTimeout", o.HealthTimeout,
+			"healthInterval", o.HealthInterval,
+			"clampedTo", clamped,
+		)
+		o.HealthTimeout = clamped
+	}
+	if o.HeartbeatTimeout <= 0 {
+		o.HeartbeatTimeout = o.HealthTimeout
+	}
+
+	if o.MaxAdvertisedRoutes <= 0 {
+		o.MaxAdvertisedRoutes = 50
+	}
+
 	if o.ServiceID == "" {
 		o.ServiceID = fmt.Sprintf("%s-%d", o.ServiceName, time.Now().UnixNano())
 	}
 
+	switch o.Network {
+	case "tcp", "tcp4":
+	case "tcp6":
+		// The IPv4 wildcard default cannot be bound on an IPv6-only socket.
+		if o.Address == "0.0.0.0" {
+			o.Address = "::"
+		}
+	default:
+		return nil, fmt.Errorf("runtime: unsupported network %q (want tcp, tcp4, or tcp6)", o.Network)
+	}
+
 	if o.AdvertisedAddress == "" {
 		o.AdvertisedAddress = o.Address
 	}
 
+	switch o.AdvertiseFamily {
+	case "":
+		o.AdvertiseFamily = FamilyAuto
+	case FamilyAuto:
+	case FamilyIPv4, FamilyIPv6:
+		// An address of the other family cannot reach a single-family socket.
+		if detectNetwork(o.Network, o.AdvertiseFamily) != o.Network && o.Network != "tcp" {
+			return nil, fmt.Errorf("runtime: advertise family %s conflicts with network %s", o.AdvertiseFamily, o.Network)
+		}
+	default:
+		return nil, fmt.Errorf("runtime: unsupported advertise family %q (want auto, ipv4, or ipv6)", o.AdvertiseFamily)
+	}
+
+	switch o.HealthFormat {
+	case "":
+		o.HealthFormat = HealthFormatSimple
+	case HealthFormatSimple, HealthFormatIETF:
+	default:
+		return nil, fmt.Errorf("runtime: unsupported health format %q", o.HealthFormat)
+	}
+
+	if o.Registrar == nil {
+		var err error
+		if o.DiscoveryAddress, err = normalizeDiscoveryAddress(o.DiscoveryAddress); err != nil {
+			return nil, err
+		}
+		o.DiscoveryAddresses = slices.Clone(o.DiscoveryAddresses)
+		for i, addr := range o.DiscoveryAddresses {
+			if o.DiscoveryAddresses[i], err = normalizeDiscoveryAddress(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The probe paths are turned into "GET <path>" mux patterns.
+	for _, ep := range []*string{&o.HealthEndpoint, &o.ReadinessEndpoint} {
+		p, err := normalizeEndpoint(*ep)
+		if err != nil {
+			return nil, err
+		}
+		*ep = p
+	}
+
+	if err := checkScheme(o, logger); err != nil {
+		return nil, err
+	}
+	if o.H2C && o.TLSConfig != nil {
+		return nil, fmt.Errorf("runtime: H2C requires a plaintext server; HTTP/2 over TLS is negotiated already")
+	}
+
+	for zone, w := range o.Routing.ZoneWeights {
+		if zone == "" || w < 0 {
+			return nil, fmt.Errorf("runtime: invalid zone weight %q=%d", zone, w)
+		}
+	}
+
 	if o.Routing.HealthCheckEndpoint == "" {
 		o.Routing.HealthCheckEndpoint = o.HealthEndpoint
 	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	if o.ProbePath == "" {
+		o.ProbePath = o.HealthEndpoint
+	}
+	if o.ProbePort < 0 || o.ProbePort > 65535 {
+		return nil, fmt.Errorf("runtime: invalid probe port %d", o.ProbePort)
+	}
+	if o.AdvertisedPort < 0 || o.AdvertisedPort > 65535 {
+		return nil, fmt.Errorf("runtime: invalid advertised port %d", o.AdvertisedPort)
+	}
+	if o.ProbeInterval == 0 {
+		o.ProbeInterval = o.HealthInterval
+	}
+	if o.ProbeTimeout == 0 {
+		o.ProbeTimeout = o.HealthTimeout
+	}
 
 	mux := http.NewServeMux()
 
-	return &MeshService{
-		opts:   o,
-		mux:    mux,
-		logger: logger,
-	}, nil
+	stats := o.Stats
+	if stats == nil {
+		stats = noopStats{}
+	}
+
+	s := &MeshService{
+		opts:         o,
+		mux:          mux,
+		logger:       logger,
+		logLevel:     logLevel,
+		stats:        stats,
+		leaseChanged: make(chan struct{}, 1),
+		hurry:        make(chan struct{}),
+	}
+
+	if err := s.checkMetadataSize(); err != nil {
+		return nil, err
+	}
+
+	if o.LeaseTTL > 0 {
+		s.setLeaseTTL(o.LeaseTTL)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("runtime: %w", err)
+	}
+
+	return s, nil
+}
+
+// normalizeEndpoint ensures p is a plain path with exactly one leading
+// slash. Empty paths, and anything that looks like a mux pattern with a
+// method or host, are rejected.
+func normalizeEndpoint(p string) (string, error) {
+	if strings.TrimSpace(p) == "" {
+		return "", fmt.Errorf("runtime: endpoint path must not be empty")
+	}
+	if strings.ContainsAny(p, " \t\r\n?#") {
+		return "", fmt.Errorf("runtime: invalid endpoint path %q (want a path such as \"/health\")", p)
+	}
+	return "/" + strings.TrimLeft(p, "/"), nil
 }
 
 // Handle registers an HTTP handler on the service's mux.
 // Pattern follows Go 1.22+ enhanced ServeMux syntax (e.g. "GET /hello").
+// Handlers for patterns given a route timeout are wrapped accordingly.
+// A pattern that cannot be registered (see HandleErr) is logged and
+// ignored, keeping any handler already registered for it.
+//
+// Handle may be called at any time, including concurrently with serving:
+// a route added after Start is served as soon as Handle returns. It is
+// advertised to Discovery (see AdvertiseRoutes) from the next
+// registration on, e.g. after Reregister or a ReregisterInterval tick.
 func (s *MeshService) Handle(pattern string, handler http.Handler) {
-	s.mux.Handle(pattern, handler)
+	if err := s.HandleErr(pattern, handler); err != nil {
+		s.logger.Error("handler not registered", "pattern", pattern, "error", err)
+	}
 }
 
 // HandleFunc registers an HTTP handler function on the service's mux.
 func (s *MeshService) HandleFunc(pattern string, handler http.HandlerFunc) {
-	s.mux.HandleFunc(pattern, handler)
+	s.Handle(pattern, handler)
+}
+
+// HandleErr is like Handle but returns an error instead of logging it when
+// pattern is invalid, already registered, conflicts with another pattern,
+// or is taken by a built-in endpoint.
+func (s *MeshService) HandleErr(pattern string, handler http.Handler) error {
+	if slices.Contains(s.builtinRoutes(), pattern) {
+		return fmt.Errorf("runtime: pattern %q is reserved for a built-in endpoint", pattern)
+	}
+	if d, ok := s.opts.RouteTimeouts[pattern]; ok && d > 0 {
+		handler = withTimeout(d, handler)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Contains(s.routes, pattern) {
+		return fmt.Errorf("runtime: pattern %q is already registered", pattern)
+	}
+	if err := muxHandle(s.mux, pattern, handler); err != nil {
+		return err
+	}
+	s.routes = append(s.routes, pattern)
+	return nil
+}
+
+// HandleFuncErr is HandleErr for a handler function.
+func (s *MeshService) HandleFuncErr(pattern string, handler http.HandlerFunc) error {
+	return s.HandleErr(pattern, handler)
+}
+
+// muxHandle registers pattern on mux, turning ServeMux's panic on a bad or
+// conflicting pattern into an error.
+func muxHandle(mux *http.ServeMux, pattern string, handler http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("runtime: register %q: %v", pattern, r)
+		}
+	}()
+	mux.Handle(pattern, handler)
+	return nil
+}
+
+// builtinRoutes returns the patterns of the runtime's own endpoints.
+func (s *MeshService) builtinRoutes() []string {
+	routes := []string{"GET " + s.opts.HealthEndpoint, "GET " + s.opts.ReadinessEndpoint}
+	if s.opts.AdvertiseRoutes {
+		routes = append(routes, "GET "+RoutesEndpoint)
+	}
+	return routes
+}
+
+// Routes returns the patterns registered with Handle and HandleFunc plus
+// the built-in health and readiness routes, sorted and de-duplicated.
+func (s *MeshService) Routes() []string {
+	s.mu.Lock()
+	routes := append([]string(nil), s.routes...)
+	s.mu.Unlock()
+
+	routes = append(routes, s.builtinRoutes()...)
+	sort.Strings(routes)
+	return slices.Compact(routes)
+}
+
+// RoutesEndpoint serves the full route list when AdvertiseRoutes is set.
+const RoutesEndpoint = "/mesh/routes"
+
+func (s *MeshService) routesHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"service": s.opts.ServiceName,
+		"routes":  s.Routes(),
+	})
+}
+
+// Options returns the effective options: those passed to New after
+// defaults, ID generation and address defaulting, plus any changes applied
+// by a config reload. Maps and slices are copies, so modifying them does
+// not affect the service. It is safe to call from a BeforeRegister hook.
+func (s *MeshService) Options() ServiceOptions {
+	s.optsMu.Lock()
+	defer s.optsMu.Unlock()
+	return s.opts.clone()
+}
+
+// Uptime returns how long the service has been listening, or 0 before
+// Start. It is measured on the monotonic clock, so it never goes backwards
+// when the wall clock is adjusted (e.g. by NTP).
+func (s *MeshService) Uptime() time.Duration {
+	s.mu.Lock()
+	started := s.startedAt
+	s.mu.Unlock()
+	if started.IsZero() {
+		return 0
+	}
+	return time.Since(started)
 }
 
 // Addr returns the bound address after Start. Empty before Start.
@@ -99,81 +450,296 @@ func (s *MeshService) Addr() string {
 
 // Run starts the service, registers with Discovery, runs the heartbeat loop,
 // and blocks until ctx is cancelled or a SIGINT/SIGTERM is received.
-// On shutdown it deregisters from Discovery.
+// On shutdown it deregisters from Discovery. Another SIGINT/SIGTERM during
+// shutdown skips what remains of the post-deregister delay and the HTTP
+// drain: in-flight requests are cut off and Run returns promptly.
 func (s *MeshService) Run(ctx context.Context) error {
-	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	signals := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	if s.opts.LameDuckSignal != nil {
+		signals = append(signals, s.opts.LameDuckSignal)
+	}
+	if s.opts.ConfigReload != nil {
+		signals = append(signals, syscall.SIGHUP)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	notifySignals(sigCh, signals...)
+	defer signal.Stop(sigCh)
+
+	// The handler outlives ctx so it can catch a second signal during
+	// shutdown.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigCh:
+				if sig == s.opts.LameDuckSignal {
+					s.enterLameDuck()
+					continue
+				}
+				if sig == syscall.SIGHUP && s.opts.ConfigReload != nil {
+					if err := s.reload(ctx); err != nil {
+						s.logger.Error("config reload failed", "error", err)
+					}
+					continue
+				}
+				if ctx.Err() != nil {
+					s.logger.Warn("signal received during shutdown; skipping the rest of the drain", "signal", sig.String())
+					s.hurryShutdown()
+					continue
+				}
+				cancel(signalCause{sig})
+			case <-done:
+				return
+			}
+		}
+	}()
 
 	return s.start(ctx)
 }
 
+// hurryShutdown makes an ongoing or future shutdown skip its remaining
+// post-deregister delay and drain.
+func (s *MeshService) hurryShutdown() {
+	s.hurryOnce.Do(func() { close(s.hurry) })
+}
+
+// hurried reports whether hurryShutdown has been called.
+func (s *MeshService) hurried() bool {
+	select {
+	case <-s.hurry:
+		return true
+	default:
+		return false
+	}
+}
+
+// notifySignals is signal.Notify. Swapped in tests.
+var notifySignals = signal.Notify
+
+// signalCause is the cancellation cause recorded when Run receives a signal.
+type signalCause struct{ sig os.Signal }
+
+func (c signalCause) Error() string { return "received signal " + c.sig.String() }
+
+// ShutdownReason reports why the service began shutting down: a received
+// signal, cancellation of the caller's context, or a fatal server error.
+// Empty while the service is running.
+func (s *MeshService) ShutdownReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdownReason
+}
+
+// Stop triggers the same graceful shutdown as cancelling the context passed
+// to Run or Start, and blocks until the service has stopped or ctx is done.
+// It returns ErrNotStarted if the service was never started, and is safe to
+// call more than once.
+func (s *MeshService) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	stop, stopped := s.stopRun, s.stopped
+	s.mu.Unlock()
+	if stop == nil {
+		return ErrNotStarted
+	}
+
+	stop(errStopCalled)
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Start is like Run but does not install signal handlers. Useful for testing
 // and embedding. The caller must cancel ctx to trigger shutdown.
 func (s *MeshService) Start(ctx context.Context) error {
 	return s.start(ctx)
 }
 
-func (s *MeshService) start(ctx context.Context) error {
-	// Register the health endpoint.
-	s.mux.HandleFunc("GET "+s.opts.HealthEndpoint, s.healthHandler)
+func (s *MeshService) start(parent context.Context) error {
+	// ctx is also cancelled on a fatal server error, so background loops
+	// stop regardless of what triggered shutdown.
+	ctx, stop := context.WithCancelCause(parent)
+	defer stop(nil)
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	s.mu.Lock()
+	s.stopRun, s.stopped = stop, stopped
+	s.mu.Unlock()
+
+	// Register the built-in endpoints, in builtinRoutes order. This fails
+	// rather than panics if they collide, e.g. when the health and
+	// readiness endpoints share a path.
+	handlers := []http.Handler{
+		http.HandlerFunc(s.healthHandler),
+		http.HandlerFunc(s.readinessHandler),
+		s.adminOnly(http.HandlerFunc(s.routesHandler)),
+	}
+	for i, pattern := range s.builtinRoutes() {
+		if err := muxHandle(s.mux, pattern, handlers[i]); err != nil {
+			return err
+		}
+	}
+	if s.opts.Pprof {
+		if err := s.handlePprof(); err != nil {
+			return err
+		}
+	}
+
+	// File contents count towards MaxMetadataBytes like any other value.
+	s.regMu.Lock()
+	s.optsMu.Lock()
+	err := readMetadataFiles(s.opts.MetadataFiles, s.opts.Metadata)
+	s.optsMu.Unlock()
+	if err == nil {
+		err = s.checkMetadataSize()
+	}
+	s.regMu.Unlock()
+	if err != nil {
+		return err
+	}
 
 	// Bind listener.
-	addr := net.JoinHostPort(s.opts.Address, strconv.Itoa(s.opts.Port))
-	ln, err := net.Listen("tcp", addr)
+	ln, err := s.listen(ctx)
 	if err != nil {
-		return fmt.Errorf("runtime: listen %s: %w", addr, err)
+		return err
+	}
+	if s.opts.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.opts.TLSConfig)
 	}
 
 	s.mu.Lock()
 	s.boundAddr = ln.Addr().String()
+	s.startedAt = time.Now()
 	s.mu.Unlock()
 
-	// Resolve actual port if ephemeral.
+	// Advertise, in order of precedence, a port given by the template,
+	// AdvertisedPort, or the bound port, which may be ephemeral.
 	_, portStr, _ := net.SplitHostPort(s.boundAddr)
 	actualPort, _ := strconv.Atoi(portStr)
+	s.advertisedAddr, s.advertisedPort = s.opts.AdvertisedAddress, actualPort
+	if s.opts.AdvertisedPort > 0 {
+		s.advertisedPort = s.opts.AdvertisedPort
+	}
 
-	s.logger.Info("service starting",
+	if tmpl := s.opts.AdvertisedAddressTemplate; tmpl != "" {
+		host, port, err := expandAdvertiseTemplate(tmpl, actualPort)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		s.advertisedAddr = host
+		if port != 0 {
+			s.advertisedPort = port
+		}
+	}
+
+	// A wildcard address is not reachable, whether it came from the bind
+	// address or the template; advertise a real interface.
+	if isUnspecified(s.advertisedAddr) {
+		if s.advertisedAddr, err = detectAddress(detectNetwork(s.opts.Network, s.opts.AdvertiseFamily)); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	s.checkAdvertisedHost(ctx)
+
+	attrs := []any{
 		"service", s.opts.ServiceName,
 		"id", s.opts.ServiceID,
 		"addr", s.boundAddr,
-	)
+	}
+	if s.opts.StartupSummary {
+		attrs = append(attrs, s.startupSummary()...)
+	}
+	s.logger.Info("service starting", attrs...)
 
-	// gRPC connection to Discovery.
-	var discoveryClient pb.DiscoveryRegistryClient
-	var grpcConn *grpc.ClientConn
-	if s.opts.AutoRegister || s.opts.HeartbeatEnabled {
-		grpcConn, err = grpc.NewClient(
-			s.opts.DiscoveryAddress,
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-		)
-		if err != nil {
-			ln.Close()
-			return fmt.Errorf("runtime: connect to discovery %s: %w", s.opts.DiscoveryAddress, err)
+	// gRPC connections to Discovery, unless another registrar replaces it.
+	registrar := s.opts.Registrar
+	var grpcConns []*grpc.ClientConn
+	var watchers sync.WaitGroup
+	if registrar == nil && (s.opts.AutoRegister || s.opts.HeartbeatEnabled) {
+		clients := make([]pb.DiscoveryRegistryClient, 0, len(s.discoveryAddresses()))
+		for i, target := range s.discoveryAddresses() {
+			conn, err := grpc.NewClient(resolverTarget(target, s.opts.Resolver), s.discoveryDialOptions()...)
+			if err != nil {
+				for _, c := range grpcConns {
+					c.Close()
+				}
+				ln.Close()
+				return fmt.Errorf("runtime: connect to discovery %s: %w", target, err)
+			}
+			grpcConns = append(grpcConns, conn)
+			rc := &reconnectingConn{}
+			rc.cur.Store(conn)
+			clients = append(clients, pb.NewDiscoveryRegistryClient(rc))
+			if s.opts.DiscoveryReconnect {
+				watchers.Add(1)
+				go func() {
+					defer watchers.Done()
+					s.watchDiscoveryConn(ctx, i, target, rc)
+				}()
+			}
 		}
-		discoveryClient = pb.NewDiscoveryRegistryClient(grpcConn)
+		discoveryClient := newMultiDiscovery(s.opts.DiscoveryMode, clients...)
+		registrar = &discoveryRegistrar{
+			client:         discoveryClient,
+			beforeRegister: s.opts.BeforeRegister,
+			onLeaseTTL:     s.setLeaseTTL,
+		}
+		s.mu.Lock()
+		s.discovery = discoveryClient
+		s.discoveryConns = grpcConns
+		s.mu.Unlock()
 	}
+	s.mu.Lock()
+	s.registrar = registrar
+	s.mu.Unlock()
 
-	// Register with Discovery.
-	if s.opts.AutoRegister && discoveryClient != nil {
-		if regErr := s.register(ctx, discoveryClient, actualPort); regErr != nil {
-			s.logger.Error("registration failed", "error", regErr)
-			// Continue running — service may work without registration.
-		}
+	// Register with Discovery in the background, retrying until it
+	// succeeds. The service serves traffic meanwhile.
+	registerDone := make(chan struct{})
+	if s.opts.AutoRegister && registrar != nil {
+		go func() {
+			defer close(registerDone)
+			s.registerLoop(ctx, registrar)
+		}()
+	} else {
+		close(registerDone)
 	}
 
-	// Start heartbeat goroutine.
+	// Start heartbeat goroutine, which also runs periodic re-registration.
 	heartbeatDone := make(chan struct{})
-	if s.opts.HeartbeatEnabled && discoveryClient != nil {
+	if (s.opts.HeartbeatEnabled || s.reregisterInterval() > 0) && registrar != nil {
 		go func() {
 			defer close(heartbeatDone)
-			s.heartbeatLoop(ctx, discoveryClient)
+			s.heartbeatLoop(ctx, registrar)
 		}()
 	} else {
 		close(heartbeatDone)
 	}
 
 	// Start HTTP server.
-	server := &http.Server{Handler: s.mux}
+	conns := newConnTracker()
+	server := &http.Server{
+		Handler:        s.handler(),
+		MaxHeaderBytes: s.opts.MaxHeaderBytes,
+		ConnState:      conns.track,
+		ConnContext:    conns.connContext,
+	}
+	if s.opts.H2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
 
 	serverErr := make(chan error, 1)
 	go func() {
@@ -184,139 +750,1004 @@ func (s *MeshService) start(ctx context.Context) error {
 	}()
 
 	// Wait for shutdown signal.
+	var fatalErr error
 	select {
 	case <-ctx.Done():
-	case err := <-serverErr:
-		if err != nil {
-			return err
-		}
+	case fatalErr = <-serverErr:
+		stop(fmt.Errorf("server error: %w", fatalErr))
 	}
 
-	s.logger.Info("shutting down", "service", s.opts.ServiceName)
+	// Fail probes from here on so nothing new is routed to us while we
+	// deregister and drain.
+	s.draining.Store(true)
+	s.emitPhase(PhaseDraining)
+	// Close idle keep-alive connections and answer further requests
+	// with "Connection: close", so clients reconnect elsewhere.
+	server.SetKeepAlivesEnabled(false)
 
-	// Deregister from Discovery.
-	if s.opts.AutoRegister && discoveryClient != nil {
-		deregCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	cause := context.Cause(ctx)
+	reason := cause.Error()
+	s.mu.Lock()
+	s.shutdownReason = reason
+	s.mu.Unlock()
+	// A fatal health check is a failure, not a clean exit, so supervisors
+	// can tell the two apart.
+	if fatalErr == nil && errors.Is(cause, ErrFatal) {
+		fatalErr = cause
+	}
+
+	s.logger.Info("shutting down", "service", s.opts.ServiceName, "reason", reason)
+	deregTimeout, drainTimeout := s.shutdownTimeouts()
+
+	// Advertise the minimum weight and give gateways time to shift traffic
+	// away before the instance disappears from Discovery altogether. Under
+	// a ShutdownBudget the time spent comes out of the drain share, and a
+	// second signal skips the step.
+	if s.opts.WeightedDrain && s.opts.AutoRegister && registrar != nil && !s.hurried() {
+		start := time.Now()
+		lowered := s.lowerWeight(registrar, deregTimeout)
+		if s.opts.ShutdownBudget > 0 {
+			drainTimeout -= time.Since(start)
+		}
+		if lowered {
+			if d := s.postDeregisterDelay(drainTimeout); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-s.hurry:
+				}
+				if s.opts.ShutdownBudget > 0 {
+					drainTimeout -= d
+				}
+			}
+		}
+	}
+
+	// Deregister from Discovery. An in-flight Register is allowed to finish
+	// first (for up to half the deregister timeout) so it cannot land after
+	// our Deregister and leave a ghost entry. If it is still pending we
+	// deregister anyway, as it may yet succeed.
+	if s.opts.AutoRegister && registrar != nil {
+		s.emitPhase(PhaseDeregistering)
+		deregCtx, cancel := context.WithTimeout(context.Background(), deregTimeout)
 		defer cancel()
-		s.deregister(deregCtx, discoveryClient)
+
+		pending := false
+		select {
+		case <-registerDone:
+		case <-time.After(deregTimeout / 2):
+			pending = true
+		case <-s.hurry:
+			pending = true
+		}
+		if pending || s.mayBeRegistered() {
+			s.deregister(deregCtx, registrar)
+		}
+	}
+
+	// Give gateways time to observe the deregistration before we stop
+	// accepting connections.
+	if d := s.postDeregisterDelay(drainTimeout); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-s.hurry:
+		}
+		if s.opts.ShutdownBudget > 0 {
+			drainTimeout -= d
+		}
 	}
 
-	// Graceful HTTP shutdown.
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Graceful HTTP shutdown, draining in-flight requests.
+	s.emitPhase(PhaseServerStopping)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 	defer cancel()
-	server.Shutdown(shutdownCtx)
+	go func() {
+		select {
+		case <-s.hurry:
+			cancel()
+		case <-shutdownCtx.Done():
+		}
+	}()
+	if d := s.opts.ShortRequestDrain; d > 0 && d < drainTimeout {
+		// Cut off ordinary requests early; long-running ones keep the
+		// rest of the drain.
+		cut := time.AfterFunc(d, func() {
+			for _, remote := range conns.closeShort() {
+				s.logger.Warn("closing connection after short-request drain", "remote", remote)
+			}
+		})
+		defer cut.Stop()
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		s.logger.Warn("http drain incomplete", "error", err)
+		if s.opts.ForceCloseAfter > 0 || s.hurried() {
+			for _, remote := range conns.active() {
+				s.logger.Warn("force-closing connection", "remote", remote)
+			}
+			server.Close()
+		}
+	}
 
 	// Wait for heartbeat to stop.
 	<-heartbeatDone
 
-	// Close gRPC connection.
-	if grpcConn != nil {
-		grpcConn.Close()
+	// Close gRPC connections, including any replaced by reconnection.
+	watchers.Wait()
+	s.mu.Lock()
+	s.registrar, s.discovery = nil, nil
+	grpcConns = s.discoveryConns
+	s.mu.Unlock()
+	for _, conn := range grpcConns {
+		conn.Close()
 	}
 
 	s.logger.Info("stopped", "service", s.opts.ServiceName)
+	s.emitPhase(PhaseStopped)
+	return fatalErr
+}
+
+// startupSummary returns the effective settings logged at start with
+// StartupSummary, as slog key-value pairs.
+func (s *MeshService) startupSummary() []any {
+	discovery := "off"
+	switch {
+	case s.opts.Registrar != nil:
+		discovery = fmt.Sprintf("%T", s.opts.Registrar)
+	case s.opts.AutoRegister || s.opts.HeartbeatEnabled:
+		discovery = strings.Join(s.discoveryAddresses(), ",")
+	}
+	var heartbeat time.Duration // 0 = off
+	if s.opts.HeartbeatEnabled {
+		heartbeat = s.heartbeatInterval()
+	}
+	return []any{
+		"advertised", net.JoinHostPort(s.advertisedAddr, strconv.Itoa(s.advertisedPort)),
+		"discovery", discovery,
+		"strategy", string(s.opts.Routing.Strategy),
+		"tls", s.opts.TLSConfig != nil,
+		"heartbeatInterval", heartbeat,
+	}
+}
+
+// shutdownTimeouts returns the time allotted to deregistration and to the
+// HTTP drain. Under a ShutdownBudget deregistration gets at most a quarter
+// of it and the drain the rest, so the whole sequence fits inside the
+// orchestrator's grace period. ForceCloseAfter, when set, replaces the
+// default drain and caps a budget-derived one.
+func (s *MeshService) shutdownTimeouts() (deregister, drain time.Duration) {
+	deregister, drain = s.opts.DeregisterTimeout, 10*time.Second
+	if b := s.opts.ShutdownBudget; b > 0 {
+		deregister = min(deregister, b/4)
+		drain = b - deregister
+		if f := s.opts.ForceCloseAfter; f > 0 {
+			drain = min(drain, f)
+		}
+		return deregister, drain
+	}
+	if f := s.opts.ForceCloseAfter; f > 0 {
+		drain = f
+	}
+	return deregister, drain
+}
+
+// postDeregisterDelay returns the settle time between deregistering and
+// stopping the server. It adds to the shutdown time, except under a
+// ShutdownBudget, where it is taken from the drain share and capped at half
+// of it.
+func (s *MeshService) postDeregisterDelay(drain time.Duration) time.Duration {
+	d := s.opts.PostDeregisterDelay
+	if s.opts.ShutdownBudget > 0 {
+		d = min(d, drain/2)
+	}
+	return d
+}
+
+// Phase marks a step of the shutdown sequence, in the order they occur.
+type Phase string
+
+const (
+	PhaseDraining       Phase = "draining"        // probes fail; keep-alives disabled
+	PhaseDeregistering  Phase = "deregistering"   // withdrawing from discovery (AutoRegister only)
+	PhaseServerStopping Phase = "server_stopping" // HTTP server draining in-flight requests
+	PhaseStopped        Phase = "stopped"         // shutdown complete
+)
+
+// emitPhase sends p on the configured phase channel without blocking; the
+// marker is dropped if nobody is ready to receive it.
+func (s *MeshService) emitPhase(p Phase) {
+	if s.opts.PhaseChannel == nil {
+		return
+	}
+	select {
+	case s.opts.PhaseChannel <- p:
+	default:
+	}
+}
+
+// connTracker records the state of server connections so lingering ones
+// can be reported when they are force-closed.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+	long  map[net.Conn]int // requests in flight marked with MarkLongRunning
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[net.Conn]http.ConnState),
+		long:  make(map[net.Conn]int),
+	}
+}
+
+// track is an http.Server ConnState hook.
+func (t *connTracker) track(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, c)
+		delete(t.long, c)
+	default:
+		t.conns[c] = state
+	}
+}
+
+type connKey struct{}
+
+// connRef identifies a request's connection to MarkLongRunning.
+type connRef struct {
+	tracker *connTracker
+	conn    net.Conn
+}
+
+// connContext is an http.Server ConnContext hook.
+func (t *connTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, connRef{t, c})
+}
+
+// closeShort closes the connections with a request in flight, none of
+// them long-running, and returns their remote addresses.
+func (t *connTracker) closeShort() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var addrs []string
+	for c, state := range t.conns {
+		if state == http.StateActive && t.long[c] == 0 {
+			c.Close()
+			addrs = append(addrs, c.RemoteAddr().String())
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// MarkLongRunning tags the request whose context is ctx as long-running
+// until it completes. With ShortRequestDrain set, shutdown then lets it use
+// the whole drain instead of cutting it off with ordinary requests. ctx
+// must be the request's context (or derived from it without an earlier
+// cancellation). Outside a MeshService handler it does nothing.
+func MarkLongRunning(ctx context.Context) {
+	ref, ok := ctx.Value(connKey{}).(connRef)
+	if !ok {
+		return
+	}
+	t := ref.tracker
+	t.mu.Lock()
+	t.long[ref.conn]++
+	t.mu.Unlock()
+	// The request context is cancelled when its handler returns.
+	context.AfterFunc(ctx, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.long[ref.conn] > 0 {
+			t.long[ref.conn]--
+		}
+	})
+}
+
+// active returns the remote addresses of connections with a request in
+// flight.
+func (t *connTracker) active() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var addrs []string
+	for c, state := range t.conns {
+		if state == http.StateActive {
+			addrs = append(addrs, c.RemoteAddr().String())
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// registerLoop registers with Discovery, retrying with exponential backoff
+// until it succeeds or ctx is cancelled. Cancelling ctx stops further
+// attempts but lets one already in flight complete, so shutdown learns its
+// outcome instead of guessing.
+func (s *MeshService) registerLoop(ctx context.Context, r Registrar) {
+	backoff := 500 * time.Millisecond
+	for {
+		err := s.register(context.WithoutCancel(ctx), r)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		s.logger.Error("registration failed", "error", err, "retryIn", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// setRegistered records the registration state and reports it to the
+// stats sink.
+func (s *MeshService) setRegistered(v bool) {
+	s.registered.Store(v)
+	g := 0.0
+	if v {
+		g = 1
+	}
+	s.stats.SetGauge(MetricRegistered, g, nil)
+}
+
+// IsRegistered reports whether Discovery holds the instance, as far as the
+// service knows: it is set by a successful Register and cleared by
+// Deregister, by shutdown, and when a heartbeat is answered with NotFound
+// because Discovery evicted the entry.
+func (s *MeshService) IsRegistered() bool {
+	return s.registered.Load()
+}
+
+// mayBeRegistered reports whether Discovery may hold an entry for us: either
+// a Register succeeded, or one was cut off without a definite answer.
+func (s *MeshService) mayBeRegistered() bool {
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+	return s.registered.Load() || s.regUncertain
+}
+
+// register performs automatic (re-)registration. It is a no-op once
+// Deregister has withdrawn the instance.
+func (s *MeshService) register(ctx context.Context, r Registrar) error {
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+	if s.withdrawn.Load() {
+		return nil
+	}
+	return s.registerLocked(ctx, r)
+}
+
+// Deregister removes the instance from Discovery while the service keeps
+// running, e.g. to take it out of rotation for maintenance. It stays out,
+// with automatic re-registration suppressed, until Reregister is called.
+// Concurrent Deregister and Reregister calls are serialized with each
+// other and with automatic registration; the last one wins. A failed
+// Deregister leaves the instance as it was. Once it has
+// succeeded, further calls and the deregistration at shutdown send
+// nothing until the instance is registered again.
+func (s *MeshService) Deregister(ctx context.Context) error {
+	r := s.currentRegistrar()
+	if r == nil {
+		return ErrNotStarted
+	}
+
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+	wasWithdrawn := s.withdrawn.Swap(true)
+	if s.deregistered.Load() {
+		return nil
+	}
+	if err := s.sendDeregister(ctx, r); err != nil {
+		// Still registered, so automatic re-registration must carry on.
+		s.withdrawn.Store(wasWithdrawn)
+		return fmt.Errorf("runtime: deregister: %w", err)
+	}
+	s.deregistered.Store(true)
+	s.setRegistered(false)
+	s.regUncertain = false
 	return nil
 }
 
-func (s *MeshService) register(ctx context.Context, client pb.DiscoveryRegistryClient, actualPort int) error {
-	metadata := s.buildMetadata()
+// Reregister registers the instance with Discovery again, undoing
+// Deregister. See Deregister for ordering guarantees.
+func (s *MeshService) Reregister(ctx context.Context) error {
+	r := s.currentRegistrar()
+	if r == nil {
+		return ErrNotStarted
+	}
 
-	req := &pb.RegisterServiceRequest{
-		ServiceName: s.opts.ServiceName,
-		ServiceId:   s.opts.ServiceID,
-		Address:     s.opts.AdvertisedAddress,
-		Port:        int32(actualPort),
-		Metadata:    metadata,
-		HealthCheck: &pb.HealthCheckConfig{
-			Endpoint:           s.opts.HealthEndpoint,
-			IntervalSeconds:    int32(s.opts.HealthInterval.Seconds()),
-			TimeoutSeconds:     int32(s.opts.HealthTimeout.Seconds()),
-			UnhealthyThreshold: int32(s.opts.UnhealthyThreshold),
-		},
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+	s.withdrawn.Store(false)
+	if err := s.registerLocked(ctx, r); err != nil {
+		return fmt.Errorf("runtime: %w", err)
 	}
+	return nil
+}
 
-	resp, err := client.Register(ctx, req)
-	if err != nil {
-		return fmt.Errorf("gRPC Register: %w", err)
+// DiscoveryConnState reports the state of the gRPC connection to Discovery.
+// With several endpoints it reports the healthiest one. Before Start it is
+// Idle, and after the service stops it is Shutdown.
+func (s *MeshService) DiscoveryConnState() connectivity.State {
+	s.mu.Lock()
+	conns := s.discoveryConns
+	s.mu.Unlock()
+
+	if len(conns) == 0 {
+		return connectivity.Idle
 	}
-	if !resp.Success {
-		return fmt.Errorf("registration rejected: %s", resp.ErrorMessage)
+	best := connectivity.Shutdown
+	for _, c := range conns {
+		if st := c.GetState(); connStateRank(st) < connStateRank(best) {
+			best = st
+		}
 	}
+	return best
+}
+
+// connStateRank orders connection states from healthiest to least healthy.
+func connStateRank(st connectivity.State) int {
+	switch st {
+	case connectivity.Ready:
+		return 0
+	case connectivity.Idle:
+		return 1
+	case connectivity.Connecting:
+		return 2
+	case connectivity.TransientFailure:
+		return 3
+	}
+	return 4
+}
 
+// discoveryClient returns the Discovery client while the service runs
+// with the default registrar.
+func (s *MeshService) discoveryClient() pb.DiscoveryRegistryClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.discovery
+}
+
+// currentRegistrar returns the registrar while the service runs.
+func (s *MeshService) currentRegistrar() Registrar {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registrar
+}
+
+func (s *MeshService) registerLocked(ctx context.Context, r Registrar) error {
+	if d := s.opts.RegisterTimeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	reg := s.registration()
+	// Even a failed Register may land, so Deregister must not be skipped.
+	s.deregistered.Store(false)
+	err := r.Register(ctx, reg)
+	s.stats.IncCounter(MetricRegistrations, resultLabel(err))
+	if err != nil {
+		if maybeApplied(err) {
+			s.regUncertain = true
+		}
+		return err
+	}
+	s.advertisedWeight, _ = strconv.Atoi(reg.Metadata["weight"])
+	s.advertisedCap = reg.Metadata["capacity"]
+	s.lastRegistered = time.Now()
+	s.setRegistered(true)
+
+	if s.opts.Registrar != nil {
+		s.logger.Info("registered", "serviceId", reg.ServiceID)
+		return nil
+	}
 	s.logger.Info("registered with discovery",
-		"serviceId", resp.ServiceId,
-		"discovery", s.opts.DiscoveryAddress,
+		"serviceId", reg.ServiceID,
+		"discovery", strings.Join(s.discoveryAddresses(), ","),
 	)
 	return nil
 }
 
-func (s *MeshService) deregister(ctx context.Context, client pb.DiscoveryRegistryClient) {
+func (s *MeshService) deregister(ctx context.Context, r Registrar) {
+	s.withdrawn.Store(true)
+	if s.deregistered.Load() {
+		s.logger.Debug("already deregistered", "serviceId", s.opts.ServiceID)
+		return
+	}
+
 	// Report degraded status first (like C# SDK).
-	_, _ = client.ReportHealth(ctx, &pb.ReportHealthRequest{
-		ServiceId: s.opts.ServiceID,
-		Status:    pb.HealthStatus_HEALTH_STATUS_DEGRADED,
-		Output:    "shutting down",
+	_ = r.Heartbeat(ctx, Heartbeat{
+		ServiceID: s.opts.ServiceID,
+		Status:    StatusDegraded,
+		Output:    "shutting down: " + s.ShutdownReason(),
 	})
 
-	resp, err := client.Deregister(ctx, &pb.DeregisterServiceRequest{
-		ServiceId: s.opts.ServiceID,
-	})
-	if err != nil {
+	if err := s.sendDeregister(ctx, r); err != nil {
 		s.logger.Error("deregistration failed", "error", err)
 		return
 	}
-	if resp.Removed {
-		s.logger.Info("deregistered from discovery", "serviceId", s.opts.ServiceID)
+	s.deregistered.Store(true)
+	s.setRegistered(false)
+}
+
+// sendDeregister sends Deregister, retrying transient failures within ctx;
+// a leftover entry would keep attracting traffic until Discovery expires
+// it. NotFound counts as success.
+func (s *MeshService) sendDeregister(ctx context.Context, r Registrar) error {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := r.Deregister(ctx, s.opts.ServiceID)
+		if err == nil {
+			s.logger.Info("deregistered from discovery", "serviceId", s.opts.ServiceID)
+			return nil
+		}
+		if attempt >= s.opts.DeregisterRetries || ctx.Err() != nil {
+			return fmt.Errorf("after %d attempts: %w", attempt+1, err)
+		}
+
+		s.logger.Warn("deregistration failed, retrying", "error", err, "retryIn", backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("after %d attempts: %w", attempt+1, err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
 }
 
-func (s *MeshService) heartbeatLoop(ctx context.Context, client pb.DiscoveryRegistryClient) {
-	ticker := time.NewTicker(s.opts.HealthInterval)
-	defer ticker.Stop()
+func (s *MeshService) heartbeatLoop(ctx context.Context, r Registrar) {
+	// The interval is re-read every round, as a lease TTL learned at
+	// registration may shorten it.
+	timer := time.NewTimer(s.heartbeatInterval())
+	defer timer.Stop()
+	refresh := time.NewTimer(s.reregisterInterval())
+	defer refresh.Stop()
+
+	// A nil channel disables its case.
+	var heartbeat, reregister <-chan time.Time
+	if s.opts.HeartbeatEnabled {
+		heartbeat = timer.C
+	}
+	if s.reregisterInterval() > 0 {
+		reregister = refresh.C
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			s.sendHeartbeat(ctx, client)
+		case <-heartbeat:
+			s.sendHeartbeat(ctx, r)
+			timer.Reset(s.heartbeatInterval())
+		case <-s.leaseChanged:
+			timer.Reset(s.heartbeatInterval())
+		case <-reregister:
+			refresh.Reset(s.refreshRegistration(ctx, r))
 		}
 	}
 }
 
-func (s *MeshService) sendHeartbeat(ctx context.Context, client pb.DiscoveryRegistryClient) {
-	reqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+// reregisterInterval returns ReregisterInterval, or 0 if periodic
+// re-registration does not apply.
+func (s *MeshService) reregisterInterval() time.Duration {
+	if !s.opts.AutoRegister {
+		return 0
+	}
+	return max(s.opts.ReregisterInterval, 0)
+}
+
+// refreshRegistration re-registers if ReregisterInterval has passed since
+// the last successful Register, whether initial, failure-driven or from a
+// weight change, and returns how long to wait before checking again. It
+// skips instances that were never registered (registerLoop is still
+// retrying) or have been withdrawn with Deregister, but restores evicted
+// ones.
+func (s *MeshService) refreshRegistration(ctx context.Context, r Registrar) time.Duration {
+	interval := s.reregisterInterval()
+
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+	if s.lastRegistered.IsZero() || s.withdrawn.Load() {
+		return interval
+	}
+	if since := time.Since(s.lastRegistered); s.registered.Load() && since < interval {
+		return interval - since
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, s.opts.HeartbeatTimeout)
 	defer cancel()
+	if err := s.registerLocked(reqCtx, r); err != nil {
+		s.logger.Warn("periodic re-registration failed", "error", err, "serviceId", s.opts.ServiceID)
+		return interval
+	}
+	s.heartbeatFailures = 0
+	return interval
+}
 
-	_, err := client.ReportHealth(reqCtx, &pb.ReportHealthRequest{
-		ServiceId: s.opts.ServiceID,
-		Status:    pb.HealthStatus_HEALTH_STATUS_HEALTHY,
-		Output:    "heartbeat",
-	})
+// LeaseTTLHeader is the gRPC response header in which Discovery may
+// announce the registration lease TTL, as a Go duration ("30s") or whole
+// seconds ("30").
+const LeaseTTLHeader = "x-lease-ttl"
+
+func parseLeaseTTL(v []string) (time.Duration, bool) {
+	if len(v) == 0 {
+		return 0, false
+	}
+	if d, err := time.ParseDuration(v[0]); err == nil && d > 0 {
+		return d, true
+	}
+	if n, err := strconv.Atoi(v[0]); err == nil && n > 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	return 0, false
+}
+
+// setLeaseTTL records a TTL announced by Discovery, logging if it forces
+// heartbeats to run more often than HealthInterval.
+func (s *MeshService) setLeaseTTL(ttl time.Duration) {
+	if time.Duration(s.leaseTTL.Swap(int64(ttl))) == ttl {
+		return
+	}
+	select {
+	case s.leaseChanged <- struct{}{}:
+	default:
+	}
+	if ttl/2 < s.opts.HealthInterval {
+		s.logger.Warn("heartbeat interval clamped to half the lease TTL",
+			"healthInterval", s.opts.HealthInterval,
+			"leaseTTL", ttl,
+			"heartbeatInterval", ttl/2,
+		)
+	}
+}
+
+// heartbeatInterval returns HealthInterval, clamped to half the lease TTL
+// so the lease is renewed comfortably before it expires.
+func (s *MeshService) heartbeatInterval() time.Duration {
+	d := s.opts.HealthInterval
+	if ttl := time.Duration(s.leaseTTL.Load()); ttl > 0 {
+		d = min(d, ttl/2)
+	}
+	return d
+}
+
+// heartbeatTimeout returns HeartbeatTimeout, capped at the heartbeat
+// interval so a slow heartbeat cannot delay the next one and let the lease
+// lapse.
+func (s *MeshService) heartbeatTimeout() time.Duration {
+	return min(s.opts.HeartbeatTimeout, s.heartbeatInterval())
+}
+
+func (s *MeshService) sendHeartbeat(ctx context.Context, r Registrar) {
+	if s.withdrawn.Load() {
+		return // deliberately out of the registry
+	}
+
+	if s.opts.HealthGatesHeartbeat && len(s.opts.HealthCheckers) > 0 {
+		s.recordHealthChecks(s.runHealthCheckers(ctx))
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, s.heartbeatTimeout())
+	err := s.heartbeat(reqCtx, r)
+	cancel()
+
+	// The follow-up RPCs get their own deadlines: after a timed-out
+	// heartbeat, reqCtx has already expired.
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			s.evicted()
+		}
+		s.heartbeatFailed(ctx, r)
+	} else {
+		s.heartbeatFailures = 0
+	}
+
+	if s.opts.AutoRegister && (s.opts.Routing.DynamicWeight != nil || s.opts.Routing.SlowStart > 0 ||
+		s.opts.Routing.CapacityReporter != nil) {
+		refreshCtx, cancel := context.WithTimeout(ctx, s.opts.HeartbeatTimeout)
+		defer cancel()
+		s.refreshWeight(refreshCtx, r)
+	}
+}
+
+// heartbeat sends one heartbeat carrying the current status and records
+// its metrics.
+func (s *MeshService) heartbeat(ctx context.Context, r Registrar) error {
+	hb := Heartbeat{ServiceID: s.opts.ServiceID, Status: StatusHealthy, Output: "heartbeat"}
+	if s.opts.HeartbeatPayload != nil {
+		hb.Status, hb.Output = s.opts.HeartbeatPayload()
+		if hb.Status == "" {
+			hb.Status = StatusHealthy
+		}
+	}
+	if s.lameDuck.Load() {
+		hb.Status, hb.Output = StatusDegraded, "lame duck"
+	}
+	if c := s.checks.Load(); s.opts.HealthGatesHeartbeat && c != nil && c.failure != "" {
+		hb.Status, hb.Output = StatusUnhealthy, c.failure
+	}
+	if reason := s.unhealthy.Load(); reason != nil {
+		hb.Status, hb.Output = StatusUnhealthy, *reason
+	}
+
+	start := time.Now()
+	err := r.Heartbeat(ctx, hb)
+	s.stats.IncCounter(MetricHeartbeats, resultLabel(err))
+	s.stats.ObserveHistogram(MetricHeartbeatDuration, time.Since(start).Seconds(), resultLabel(err))
 	if err != nil {
 		s.logger.Warn("heartbeat failed", "error", err, "serviceId", s.opts.ServiceID)
 	}
+	return err
 }
 
-func (s *MeshService) healthHandler(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "Healthy",
-		"service": s.opts.ServiceName,
-		"id":      s.opts.ServiceID,
-	})
+// evicted records that Discovery no longer knows the instance.
+func (s *MeshService) evicted() {
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+	if s.registered.Load() {
+		s.logger.Warn("evicted by discovery", "serviceId", s.opts.ServiceID)
+		s.setRegistered(false)
+	}
+}
+
+// heartbeatFailed counts a failed heartbeat and re-registers once
+// HeartbeatFailureThreshold consecutive ones have failed.
+func (s *MeshService) heartbeatFailed(ctx context.Context, r Registrar) {
+	n := s.opts.HeartbeatFailureThreshold
+	if n <= 0 || !s.opts.AutoRegister {
+		return
+	}
+	s.heartbeatFailures++
+	if s.heartbeatFailures < n {
+		return
+	}
+
+	s.logger.Warn("re-registering after failed heartbeats", "failures", s.heartbeatFailures, "serviceId", s.opts.ServiceID)
+	ctx, cancel := context.WithTimeout(ctx, s.opts.HeartbeatTimeout)
+	defer cancel()
+	if err := s.register(ctx, r); err != nil {
+		s.logger.Warn("re-registration failed", "error", err, "serviceId", s.opts.ServiceID)
+		return
+	}
+	s.heartbeatFailures = 0
+}
+
+// refreshWeight re-registers when the dynamic or slow-start weight, or the
+// capacity score, has drifted from the advertised one, and reports whether
+// it did. Discovery has no metadata-update RPC, so re-registering is how the
+// new values are propagated.
+func (s *MeshService) refreshWeight(ctx context.Context, r Registrar) bool {
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+
+	if !s.registered.Load() || s.withdrawn.Load() {
+		return false
+	}
+	if s.weight() == s.advertisedWeight && s.capacityLabel() == s.advertisedCap {
+		return false
+	}
+	if err := s.registerLocked(ctx, r); err != nil {
+		s.logger.Warn("weight update failed", "error", err, "serviceId", s.opts.ServiceID)
+		return false
+	}
+	return true
+}
+
+// drainWeight is the weight advertised during a WeightedDrain. Zero would
+// omit the key, which gateways read as the default weight of 1 anyway.
+const drainWeight = 1
+
+// lowerWeight re-registers with drainWeight, and reports whether the
+// lowered weight reached Discovery. A second shutdown signal cancels it.
+func (s *MeshService) lowerWeight(r Registrar, timeout time.Duration) bool {
+	s.weightDrained.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.hurry:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if !s.refreshWeight(ctx, r) {
+		return false
+	}
+	s.logger.Info("advertised drain weight", "weight", drainWeight, "serviceId", s.opts.ServiceID)
+	return true
 }
 
 func (s *MeshService) buildMetadata() map[string]string {
-	m := make(map[string]string, len(s.opts.Metadata)+4)
+	m := make(map[string]string, len(s.opts.Metadata)+6)
 	for k, v := range s.opts.Metadata {
 		m[k] = v
 	}
 	m["scheme"] = s.opts.Routing.Scheme
 	m["health_check_endpoint"] = s.opts.Routing.HealthCheckEndpoint
+	if s.opts.ProbePort > 0 {
+		m["health_check_port"] = strconv.Itoa(s.opts.ProbePort)
+	}
 	m["lb_strategy"] = string(s.opts.Routing.Strategy)
-	if s.opts.Routing.Weight > 0 {
-		m["weight"] = strconv.Itoa(s.opts.Routing.Weight)
+	if w := s.weight(); w > 0 {
+		m["weight"] = strconv.Itoa(w)
+	}
+	if s.opts.Routing.APIVersion != "" {
+		m["api_version"] = s.opts.Routing.APIVersion
+	}
+	if len(s.opts.Routing.ContentTypes) > 0 {
+		m["content_types"] = strings.Join(s.opts.Routing.ContentTypes, ",")
+	}
+	if c := s.capacityLabel(); c != "" {
+		m["capacity"] = c
+	}
+	if len(s.opts.Routing.ZoneWeights) > 0 {
+		// Maps marshal with sorted keys, so the value is stable.
+		b, _ := json.Marshal(s.opts.Routing.ZoneWeights)
+		m["zone_weights"] = string(b)
+	}
+	if s.opts.AdvertiseRoutes {
+		routes := s.Routes()
+		if len(routes) <= s.opts.MaxAdvertisedRoutes {
+			m["routes"] = strings.Join(routes, ",")
+		} else {
+			m["route_count"] = strconv.Itoa(len(routes))
+			m["routes_endpoint"] = RoutesEndpoint
+		}
 	}
 	return m
 }
+
+// checkScheme reports an advertised scheme that does not match whether the
+// server uses TLS, as clients following it would fail to connect. It is a
+// warning, since TLS may be terminated in front of the service, unless
+// StrictScheme is set.
+func checkScheme(o ServiceOptions, logger *slog.Logger) error {
+	var msg string
+	switch {
+	case o.Routing.Scheme == "https" && o.TLSConfig == nil:
+		msg = "advertised scheme is https but the server is plaintext"
+	case o.Routing.Scheme == "http" && o.TLSConfig != nil:
+		msg = "advertised scheme is http but the server uses TLS"
+	default:
+		return nil
+	}
+	if o.StrictScheme {
+		return fmt.Errorf("runtime: %s", msg)
+	}
+	logger.Warn(msg+"; clients using the advertised scheme will fail unless a proxy bridges them", "scheme", o.Routing.Scheme)
+	return nil
+}
+
+// readMetadataFiles stores the trimmed contents of each file under its key
+// in metadata. A missing optional file removes the key.
+func readMetadataFiles(files map[string]MetadataFile, metadata map[string]string) error {
+	for key, f := range files {
+		b, err := os.ReadFile(f.Path)
+		if err != nil {
+			if f.Optional && errors.Is(err, fs.ErrNotExist) {
+				delete(metadata, key)
+				continue
+			}
+			return fmt.Errorf("runtime: metadata %q: %w", key, err)
+		}
+		metadata[key] = strings.TrimSpace(string(b))
+	}
+	return nil
+}
+
+// discoveryDialOptions returns the gRPC options used for Discovery
+// connections.
+func (s *MeshService) discoveryDialOptions() []grpc.DialOption {
+	ua := s.opts.DiscoveryUserAgent
+	if ua == "" {
+		ua = defaultUserAgent(s.opts.ServiceName)
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUserAgent(ua),
+		grpc.WithChainUnaryInterceptor(withServiceID(s.opts.ServiceID)),
+	}
+	if s.opts.DiscoveryCredentials != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(s.opts.DiscoveryCredentials))
+	}
+	if len(s.opts.DiscoveryInterceptors) > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(s.opts.DiscoveryInterceptors...))
+	}
+	if s.opts.Resolver != nil {
+		opts = append(opts, resolverDialer(s.opts.Resolver))
+	}
+	return opts
+}
+
+// discoveryAddresses returns the Discovery endpoints to use.
+func (s *MeshService) discoveryAddresses() []string {
+	if len(s.opts.DiscoveryAddresses) > 0 {
+		return s.opts.DiscoveryAddresses
+	}
+	return []string{s.opts.DiscoveryAddress}
+}
+
+// weight returns the routing weight to advertise, consulting DynamicWeight
+// when set and scaling it down while within the SlowStart window. During a
+// WeightedDrain it is drainWeight.
+func (s *MeshService) weight() int {
+	if s.weightDrained.Load() {
+		return drainWeight
+	}
+	w := s.opts.Routing.Weight
+	if s.opts.Routing.DynamicWeight != nil {
+		w = s.opts.Routing.DynamicWeight()
+	}
+	if d := s.opts.Routing.SlowStart; d > 0 && w > 1 {
+		if elapsed := s.Uptime(); elapsed > 0 && elapsed < d {
+			w = max(1, int(int64(w)*int64(elapsed)/int64(d)))
+		}
+	}
+	return w
+}
+
+// capacity returns the CapacityReporter score clamped to [0,1], with NaN
+// counting as no capacity, and false if there is no reporter.
+func (s *MeshService) capacity() (float64, bool) {
+	if s.opts.Routing.CapacityReporter == nil {
+		return 0, false
+	}
+	c := s.opts.Routing.CapacityReporter()
+	if math.IsNaN(c) {
+		return 0, true
+	}
+	return min(max(c, 0), 1), true
+}
+
+// capacityLabel formats the capacity score for metadata, rounded so small
+// fluctuations do not each cause a re-registration. "" = no reporter.
+func (s *MeshService) capacityLabel() string {
+	c, ok := s.capacity()
+	if !ok {
+		return ""
+	}
+	return strconv.FormatFloat(c, 'f', 2, 64)
+}
+
+// checkMetadataSize rejects metadata that would exceed MaxMetadataBytes once
+// the reserved routing keys are added, naming the largest keys that would
+// have to go for the rest to fit.
+func (s *MeshService) checkMetadataSize() error {
+	if s.opts.MaxMetadataBytes <= 0 {
+		return nil
+	}
+
+	m := s.buildMetadata()
+	keys := make([]string, 0, len(m))
+	total := 0
+	for k, v := range m {
+		keys = append(keys, k)
+		total += len(k) + len(v)
+	}
+	if total <= s.opts.MaxMetadataBytes {
+		return nil
+	}
+
+	size := func(k string) int { return len(k) + len(m[k]) }
+	sort.Slice(keys, func(i, j int) bool {
+		if size(keys[i]) != size(keys[j]) {
+			return size(keys[i]) > size(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+
+	var offending []string
+	excess := total - s.opts.MaxMetadataBytes
+	for _, k := range keys {
+		if excess <= 0 {
+			break
+		}
+		offending = append(offending, fmt.Sprintf("%s (%d bytes)", k, size(k)))
+		excess -= size(k)
+	}
+
+	return fmt.Errorf("runtime: metadata is %d bytes, exceeds limit of %d; largest keys: %s",
+		total, s.opts.MaxMetadataBytes, strings.Join(offending, ", "))
+}
@@ -2,11 +2,35 @@ package runtime
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestNew_RequiresServiceName(t *testing.T) {
@@ -16,6 +40,26 @@ func TestNew_RequiresServiceName(t *testing.T) {
 	}
 }
 
+func TestNewWithContext(t *testing.T) {
+	svc, err := NewWithContext(context.Background(), WithServiceName("ctx-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.opts.ServiceName != "ctx-test" {
+		t.Fatalf("expected ServiceName=ctx-test, got %q", svc.opts.ServiceName)
+	}
+}
+
+func TestNewWithContext_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewWithContext(ctx, WithServiceName("ctx-test"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
 func TestNew_GeneratesServiceID(t *testing.T) {
 	svc, err := New(WithServiceName("test"))
 	if err != nil {
@@ -46,6 +90,444 @@ func TestNew_SetsRoutingHealthCheckEndpoint(t *testing.T) {
 	}
 }
 
+func TestNew_ProbeDefaultsFollowHealth(t *testing.T) {
+	svc, err := New(
+		WithServiceName("test"),
+		WithHealthEndpoint("/ready"),
+		WithHealthInterval(12*time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.opts.ProbePath != "/ready" {
+		t.Fatalf("expected ProbePath=/ready, got %q", svc.opts.ProbePath)
+	}
+	if svc.opts.ProbeInterval != 12*time.Second {
+		t.Fatalf("expected ProbeInterval=12s, got %v", svc.opts.ProbeInterval)
+	}
+	if svc.opts.ProbeTimeout != 5*time.Second {
+		t.Fatalf("expected ProbeTimeout=5s, got %v", svc.opts.ProbeTimeout)
+	}
+}
+
+func TestNew_NormalizesProbeEndpoints(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{endpoint: "/health", want: "/health"},
+		{endpoint: "health", want: "/health"},
+		{endpoint: "//healthz", want: "/healthz"},
+		{endpoint: "", wantErr: true},
+		{endpoint: "GET /health", wantErr: true},
+		{endpoint: "/health?verbose=1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			svc, err := New(WithServiceName("paths"), WithHealthEndpoint(tt.endpoint), WithReadinessEndpoint(tt.endpoint))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q", tt.endpoint)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if svc.opts.HealthEndpoint != tt.want || svc.opts.ReadinessEndpoint != tt.want {
+				t.Fatalf("got (%q, %q), want %q", svc.opts.HealthEndpoint, svc.opts.ReadinessEndpoint, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew_RejectsUnknownNetwork(t *testing.T) {
+	if _, err := New(WithServiceName("test"), WithNetwork("udp")); err == nil {
+		t.Fatal("expected error for unsupported network")
+	}
+}
+
+func TestNew_SchemeMismatch(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	tests := []struct {
+		name     string
+		opts     []Option
+		wantWarn string // "" = no warning
+	}{
+		{name: "plaintext http", opts: []Option{WithRoutingScheme("http")}},
+		{name: "tls https", opts: []Option{WithRoutingScheme("https"), WithTLSConfig(tlsConfig)}},
+		{name: "https without tls", opts: []Option{WithRoutingScheme("https")}, wantWarn: "server is plaintext"},
+		{name: "http with tls", opts: []Option{WithRoutingScheme("http"), WithTLSConfig(tlsConfig)}, wantWarn: "server uses TLS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs syncBuffer
+			opts := append([]Option{
+				WithServiceName("scheme"),
+				WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+			}, tt.opts...)
+
+			if _, err := New(opts...); err != nil {
+				t.Fatal(err)
+			}
+			if got := logs.String(); tt.wantWarn == "" && got != "" || !strings.Contains(got, tt.wantWarn) {
+				t.Fatalf("logs = %q, want warning %q", got, tt.wantWarn)
+			}
+
+			_, err := New(append(opts, WithStrictScheme(true))...)
+			if (err != nil) != (tt.wantWarn != "") {
+				t.Fatalf("strict New error = %v, want error: %v", err, tt.wantWarn != "")
+			}
+		})
+	}
+}
+
+func TestMeshService_ListenConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		control error // returned by Control
+	}{
+		{name: "control invoked"},
+		{name: "control error fails start", control: errors.New("setsockopt refused")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			lc := &net.ListenConfig{
+				Control: func(network, address string, _ syscall.RawConn) error {
+					calls.Add(1)
+					if !strings.HasPrefix(address, "127.0.0.1:") {
+						return fmt.Errorf("unexpected bind %s %s", network, address)
+					}
+					return tt.control
+				},
+			}
+			svc, err := New(
+				WithServiceName("sockopts"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithAutoRegister(false),
+				WithHeartbeat(false),
+				WithListenConfig(lc),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.control != nil {
+				if err := svc.Start(context.Background()); err == nil || !strings.Contains(err.Error(), tt.control.Error()) {
+					t.Fatalf("Start = %v, want the Control error", err)
+				}
+			} else {
+				runService(t, svc)
+			}
+			if calls.Load() == 0 {
+				t.Fatal("Control not called")
+			}
+		})
+	}
+}
+
+func TestStartupSummary(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("summary=%v", enabled), func(t *testing.T) {
+			var logs syncBuffer
+			svc, err := New(
+				WithServiceName("summarized"),
+				WithServiceID("summarized-1"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithAdvertisedPort(443),
+				WithDiscoveryAddress(fd.addr),
+				WithRoutingStrategy(Random),
+				WithHealthInterval(20*time.Second),
+				WithStartupSummary(enabled),
+				WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr, _ := runService(t, svc)
+
+			var line map[string]any
+			for _, l := range strings.Split(logs.String(), "\n") {
+				if strings.Contains(l, `"msg":"service starting"`) {
+					json.Unmarshal([]byte(l), &line)
+					break
+				}
+			}
+			if line == nil {
+				t.Fatalf("no startup line in %s", logs.String())
+			}
+
+			want := map[string]any{
+				"service":           "summarized",
+				"id":                "summarized-1",
+				"addr":              addr,
+				"advertised":        "127.0.0.1:443",
+				"discovery":         fd.addr,
+				"strategy":          "Random",
+				"tls":               false,
+				"heartbeatInterval": float64(20 * time.Second),
+			}
+			for k, v := range want {
+				got, ok := line[k]
+				if summary := k != "service" && k != "id" && k != "addr"; summary && !enabled {
+					if ok {
+						t.Fatalf("%s = %v logged with the summary off", k, got)
+					}
+					continue
+				}
+				if got != v {
+					t.Fatalf("%s = %v, want %v", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestMeshService_H2C(t *testing.T) {
+	// A transport that speaks only HTTP/2 with prior knowledge.
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("h2c=%v", enabled), func(t *testing.T) {
+			svc, err := New(
+				WithServiceName("h2c"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithAutoRegister(false),
+				WithHeartbeat(false),
+				WithH2C(enabled),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entered, release := make(chan struct{}), make(chan struct{})
+			svc.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+				close(entered)
+				<-release
+				fmt.Fprint(w, r.Proto)
+			})
+			addr, stop := runService(t, svc)
+
+			resp, err := client.Get("http://" + addr + "/health")
+			if !enabled {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("HTTP/2 prior-knowledge request succeeded without h2c")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.ProtoMajor != 2 {
+				t.Fatalf("proto = %s, want HTTP/2", resp.Proto)
+			}
+
+			// An in-flight HTTP/2 request completes during graceful shutdown.
+			type result struct {
+				body string
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				resp, err := client.Get("http://" + addr + "/slow")
+				if err != nil {
+					done <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				done <- result{string(b), err}
+			}()
+			<-entered
+			stopped := make(chan struct{})
+			go func() {
+				stop()
+				close(stopped)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+
+			if r := <-done; r.err != nil || r.body != "HTTP/2.0" {
+				t.Fatalf("in-flight request = %q, %v; want HTTP/2.0", r.body, r.err)
+			}
+			<-stopped
+		})
+	}
+
+	if _, err := New(WithH2C(true), WithTLSConfig(&tls.Config{})); err == nil {
+		t.Fatal("New accepted H2C with TLS")
+	}
+}
+
+func TestMeshService_MaxHeaderBytes(t *testing.T) {
+	svc, err := New(
+		WithServiceName("headers"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+		WithMaxHeaderBytes(1024),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := runService(t, svc)
+
+	tests := []struct {
+		name   string
+		header int // bytes in X-Padding
+		want   int
+	}{
+		{name: "under limit", header: 512, want: http.StatusOK},
+		// net/http allows 4KB of slack above MaxHeaderBytes.
+		{name: "over limit", header: 16 << 10, want: http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://"+addr+"/health", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Padding", strings.Repeat("x", tt.header))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeshService_TLS(t *testing.T) {
+	// Borrow httptest's certificate, valid for 127.0.0.1, and its client.
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	svc, err := New(
+		WithServiceName("secure"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+		WithRoutingScheme("https"),
+		WithTLSConfig(ts.TLS.Clone()),
+		WithStrictScheme(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := runService(t, svc)
+
+	resp, err := ts.Client().Get("https://" + addr + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("health = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestMeshService_NetworkFamily(t *testing.T) {
+	tests := []struct {
+		network string
+		wantV4  bool
+	}{
+		{"tcp4", true},
+		{"tcp6", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			if tt.network == "tcp6" {
+				ln, err := net.Listen("tcp6", "[::1]:0")
+				if err != nil {
+					t.Skip("IPv6 not available")
+				}
+				ln.Close()
+			}
+
+			svc, err := New(
+				WithServiceName("family"),
+				WithNetwork(tt.network),
+				WithPort(0),
+				WithAutoRegister(false),
+				WithHeartbeat(false),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			addr, _ := runService(t, svc)
+			host, _, _ := net.SplitHostPort(addr)
+			if isV4 := net.ParseIP(host).To4() != nil; isV4 != tt.wantV4 {
+				t.Fatalf("bound %s on %s, want IPv4=%v", addr, tt.network, tt.wantV4)
+			}
+
+			advertised := net.ParseIP(svc.advertisedAddr)
+			if advertised == nil || (advertised.To4() != nil) != tt.wantV4 {
+				t.Fatalf("advertised %q on %s, want IPv4=%v", svc.advertisedAddr, tt.network, tt.wantV4)
+			}
+		})
+	}
+}
+
+func TestNew_HealthTimeoutValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		interval    time.Duration
+		timeout     time.Duration
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{name: "valid", interval: 10 * time.Second, timeout: 2 * time.Second, wantTimeout: 2 * time.Second},
+		{name: "timeout equals interval", interval: 4 * time.Second, timeout: 4 * time.Second, wantTimeout: 2 * time.Second},
+		{name: "timeout exceeds interval", interval: 2 * time.Second, timeout: 5 * time.Second, wantTimeout: time.Second},
+		{name: "zero interval", interval: 0, timeout: time.Second, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := New(
+				WithServiceName("test"),
+				WithHealthInterval(tt.interval),
+				WithHealthTimeout(tt.timeout),
+				WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+			)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if svc.opts.HealthTimeout != tt.wantTimeout {
+				t.Fatalf("HealthTimeout = %v, want %v", svc.opts.HealthTimeout, tt.wantTimeout)
+			}
+		})
+	}
+}
+
 func TestMeshService_HealthEndpoint(t *testing.T) {
 	svc, err := New(
 		WithServiceName("health-test"),
@@ -157,6 +639,258 @@ func TestMeshService_CustomHandler(t *testing.T) {
 	<-done
 }
 
+func TestMeshService_Routes(t *testing.T) {
+	svc, err := New(WithServiceName("routes"), WithHealthEndpoint("/healthz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noop := func(http.ResponseWriter, *http.Request) {}
+	svc.HandleFunc("POST /orders", noop)
+	svc.HandleFunc("GET /orders/{id}", noop)
+	svc.Handle("/static/", http.NotFoundHandler())
+
+	want := []string{
+		"/static/",
+		"GET /healthz",
+		"GET /orders/{id}",
+		"GET /ready",
+		"POST /orders",
+	}
+	if got := svc.Routes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Routes() = %q, want %q", got, want)
+	}
+}
+
+func TestMeshService_HandleErr(t *testing.T) {
+	noop := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	tests := []struct {
+		name    string
+		first   string // registered before pattern; "" = none
+		pattern string
+		wantErr string
+	}{
+		{name: "new pattern", pattern: "GET /orders"},
+		{name: "duplicate", first: "GET /orders", pattern: "GET /orders", wantErr: "already registered"},
+		{name: "conflict", first: "GET /orders/{id}", pattern: "GET /orders/{name}", wantErr: "conflicts"},
+		{name: "health endpoint", pattern: "GET /health", wantErr: "built-in endpoint"},
+		{name: "invalid", pattern: "GET", wantErr: "register"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := New(WithServiceName("handlers"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.first != "" {
+				if err := svc.HandleErr(tt.first, noop); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = svc.HandleErr(tt.pattern, noop)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("HandleErr = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("HandleErr = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMeshService_HandleDuplicateLogs(t *testing.T) {
+	var logs syncBuffer
+	svc, err := New(WithServiceName("handlers"), WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noop := func(http.ResponseWriter, *http.Request) {}
+	svc.HandleFunc("GET /health", noop)
+	svc.HandleFunc("GET /orders", noop)
+	svc.HandleFunc("GET /orders", noop)
+
+	if n := strings.Count(logs.String(), "handler not registered"); n != 2 {
+		t.Fatalf("logged %d rejected handlers, want 2:\n%s", n, logs.String())
+	}
+	if got := svc.Routes(); !reflect.DeepEqual(got, []string{"GET /health", "GET /orders", "GET /ready"}) {
+		t.Fatalf("Routes() = %q", got)
+	}
+}
+
+func TestMeshService_HandleAfterStart(t *testing.T) {
+	svc, err := New(
+		WithServiceName("late"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := runService(t, svc)
+
+	// Serve requests and list routes while the route is being added, so
+	// the race detector sees both sides.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if resp, err := http.Get("http://" + addr + "/late"); err == nil {
+				resp.Body.Close()
+			}
+			svc.Routes()
+		}
+	}()
+
+	svc.HandleFunc("GET /late", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	close(done)
+	wg.Wait()
+
+	resp, err := http.Get("http://" + addr + "/late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("GET /late = %d, want 202", resp.StatusCode)
+	}
+	if !slices.Contains(svc.Routes(), "GET /late") {
+		t.Fatalf("Routes() = %q, missing GET /late", svc.Routes())
+	}
+}
+
+func TestStart_CollidingBuiltinEndpoints(t *testing.T) {
+	svc, err := New(
+		WithServiceName("handlers"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+		WithHealthEndpoint("/probe"),
+		WithReadinessEndpoint("/probe"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Start(context.Background()); err == nil {
+		t.Fatal("Start succeeded with colliding built-in endpoints")
+	}
+}
+
+func TestRegister_AdvertisedRoutes(t *testing.T) {
+	tests := []struct {
+		name      string
+		routes    int
+		wantList  bool
+		maxMDSize int
+	}{
+		{name: "few routes listed", routes: 3, wantList: true},
+		{name: "many routes summarized", routes: 500, maxMDSize: 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			svc, err := New(
+				WithServiceName("routes"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHeartbeat(false),
+				WithAdvertiseRoutes(true),
+				WithMaxAdvertisedRoutes(10),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			noop := func(http.ResponseWriter, *http.Request) {}
+			for i := range tt.routes {
+				svc.HandleFunc("GET /items/"+strconv.Itoa(i), noop)
+			}
+
+			addr, _ := runService(t, svc)
+			waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+			md := fd.Registers()[0].Metadata
+			routes := svc.Routes()
+			if tt.wantList {
+				if got := (Instance{Metadata: md}).MetadataList("routes"); !reflect.DeepEqual(got, routes) {
+					t.Fatalf("metadata routes = %q, want %q", got, routes)
+				}
+			} else {
+				if _, ok := md["routes"]; ok {
+					t.Fatal("full route list advertised above the limit")
+				}
+				if md["route_count"] != strconv.Itoa(len(routes)) || md["routes_endpoint"] != RoutesEndpoint {
+					t.Fatalf("route_count = %q, routes_endpoint = %q", md["route_count"], md["routes_endpoint"])
+				}
+				size := 0
+				for k, v := range md {
+					size += len(k) + len(v)
+				}
+				if size > tt.maxMDSize {
+					t.Fatalf("metadata is %d bytes, want <= %d", size, tt.maxMDSize)
+				}
+			}
+
+			resp, err := http.Get("http://" + addr + RoutesEndpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var body struct{ Routes []string }
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body.Routes, routes) {
+				t.Fatalf("%s listed %d routes, want %d", RoutesEndpoint, len(body.Routes), len(routes))
+			}
+		})
+	}
+}
+
+func TestMeshService_Uptime(t *testing.T) {
+	svc, err := New(
+		WithServiceName("uptime"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.Uptime(); got != 0 {
+		t.Fatalf("Uptime before Start = %v, want 0", got)
+	}
+
+	runService(t, svc)
+	prev := svc.Uptime()
+	for range 100 {
+		got := svc.Uptime()
+		if got < 0 || got < prev {
+			t.Fatalf("Uptime went from %v to %v", prev, got)
+		}
+		prev = got
+	}
+	if prev <= 0 {
+		t.Fatalf("Uptime = %v after Start, want > 0", prev)
+	}
+}
+
 func TestMeshService_EphemeralPort(t *testing.T) {
 	svc, err := New(
 		WithServiceName("ephemeral-test"),
@@ -227,3 +961,1941 @@ func TestBuildMetadata(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildMetadata_Lists(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{
+			name: "list encoding",
+			opts: []Option{WithMetadataList("tags", "gpu", "ssd")},
+			want: "gpu,ssd",
+		},
+		{
+			name: "append accumulates without duplicates",
+			opts: []Option{WithMetadataList("tags", "gpu"), WithMetadataList("tags", "ssd", "gpu")},
+			want: "gpu,ssd",
+		},
+		{
+			name: "append extends a plain value",
+			opts: []Option{WithMetadata("tags", "gpu"), WithMetadataList("tags", "ssd")},
+			want: "gpu,ssd",
+		},
+		{
+			name: "WithMetadata overwrites a list",
+			opts: []Option{WithMetadataList("tags", "gpu", "ssd"), WithMetadata("tags", "arm")},
+			want: "arm",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := New(append([]Option{WithServiceName("lists")}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := svc.buildMetadata()
+			if got := m["tags"]; got != tt.want {
+				t.Fatalf("metadata[tags] = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegister_APIVersionAndContentTypes(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("versioned"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithAPIVersion("v2"),
+		WithContentTypes("application/json", "application/protobuf"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	md := fd.Registers()[0].Metadata
+	if got := md["api_version"]; got != "v2" {
+		t.Fatalf("metadata[api_version] = %q, want v2", got)
+	}
+	if got := md["content_types"]; got != "application/json,application/protobuf" {
+		t.Fatalf("metadata[content_types] = %q", got)
+	}
+}
+
+func TestRegister_ZoneWeights(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("zoned"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithZoneWeight("eu-west-1a", 100),
+		WithZoneWeight("eu-west-1b", 10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	md := fd.Registers()[0].Metadata
+	if got := md["zone_weights"]; got != `{"eu-west-1a":100,"eu-west-1b":10}` {
+		t.Fatalf("metadata[zone_weights] = %q", got)
+	}
+	got := Instance{Metadata: md}.ZoneWeights()
+	want := map[string]int{"eu-west-1a": 100, "eu-west-1b": 10}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ZoneWeights() = %v, want %v", got, want)
+	}
+}
+
+func TestRegister_BeforeRegisterHook(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("hooked"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithBeforeRegister(func(req *pb.RegisterServiceRequest) {
+			req.Metadata["build"] = "abc123"
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	md := fd.Registers()[0].Metadata
+	if got := md["build"]; got != "abc123" {
+		t.Fatalf("metadata[build] = %q, want abc123", got)
+	}
+	if got := md["scheme"]; got != "http" {
+		t.Fatalf("built metadata lost: scheme = %q", got)
+	}
+}
+
+func TestRegister_MetadataFromFile(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err := New(
+		WithServiceName("files"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithMetadataFromFile("token", path),
+		WithOptionalMetadataFromFile("cert_sha", filepath.Join(t.TempDir(), "missing")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	md := fd.Registers()[0].Metadata
+	if got := md["token"]; got != "s3cret" {
+		t.Fatalf("metadata[token] = %q, want s3cret", got)
+	}
+	if got, ok := md["cert_sha"]; ok {
+		t.Fatalf("optional missing file set metadata[cert_sha] = %q", got)
+	}
+}
+
+func TestStart_MissingMetadataFile(t *testing.T) {
+	svc, err := New(
+		WithServiceName("files"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+		WithMetadataFromFile("token", filepath.Join(t.TempDir(), "missing")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.Start(context.Background())
+	if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), `"token"`) {
+		t.Fatalf("Start error = %v, want missing file for token", err)
+	}
+}
+
+func TestStart_MetadataFileOverLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cert")
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", 600)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := New(
+		WithServiceName("files"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+		WithMaxMetadataBytes(512),
+		WithMetadataFromFile("cert", path),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "cert (604 bytes)") {
+		t.Fatalf("Start error = %v, want the oversized file named", err)
+	}
+}
+
+func TestNew_RejectsInvalidZoneWeight(t *testing.T) {
+	if _, err := New(WithServiceName("zoned"), WithZoneWeight("a", -1)); err == nil {
+		t.Fatal("expected error for negative zone weight")
+	}
+}
+
+func TestHeartbeat_DynamicWeightReregisters(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	var weight atomic.Int32
+	weight.Store(1)
+
+	svc, err := New(
+		WithServiceName("adaptive"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(20*time.Millisecond),
+		WithDynamicWeight(func() int { return int(weight.Load()) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+	if got := fd.Registers()[0].Metadata["weight"]; got != "1" {
+		t.Fatalf("initial weight = %q, want 1", got)
+	}
+
+	// Unchanged weight must not re-register.
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Reports()) >= 3 })
+	if n := len(fd.Registers()); n != 1 {
+		t.Fatalf("expected 1 registration while weight is stable, got %d", n)
+	}
+
+	weight.Store(7)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 2 })
+	if got := fd.Registers()[1].Metadata["weight"]; got != "7" {
+		t.Fatalf("updated weight = %q, want 7", got)
+	}
+}
+
+func TestHeartbeat_CapacityReporter(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	var score atomic.Uint64
+	setScore := func(c float64) { score.Store(math.Float64bits(c)) }
+	setScore(1.7)
+
+	svc, err := New(
+		WithServiceName("shedding"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(20*time.Millisecond),
+		WithCapacityReporter(func() float64 { return math.Float64frombits(score.Load()) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runService(t, svc)
+
+	for _, tt := range []struct {
+		score float64
+		want  string
+	}{
+		{score: 1.7, want: "1.00"},
+		{score: -0.3, want: "0.00"},
+		{score: 0.456, want: "0.46"},
+	} {
+		setScore(tt.score)
+		waitFor(t, 2*time.Second, func() bool {
+			regs := fd.Registers()
+			return len(regs) > 0 && regs[len(regs)-1].Metadata["capacity"] == tt.want
+		})
+
+		rec := httptest.NewRecorder()
+		svc.healthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+		var body map[string]string
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if body["capacity"] != tt.want {
+			t.Fatalf("score %v: health capacity = %q, want %q", tt.score, body["capacity"], tt.want)
+		}
+	}
+}
+
+func TestHeartbeat_SlowStartRampsWeight(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("warming"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(20*time.Millisecond),
+		WithRoutingWeight(10),
+		WithSlowStart(500*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 3*time.Second, func() bool {
+		regs := fd.Registers()
+		return len(regs) > 0 && regs[len(regs)-1].Metadata["weight"] == "10"
+	})
+
+	var weights []int
+	for _, req := range fd.Registers() {
+		w, _ := strconv.Atoi(req.Metadata["weight"])
+		weights = append(weights, w)
+	}
+	if len(weights) < 3 || weights[0] >= 5 {
+		t.Fatalf("weights = %v, want a ramp starting low", weights)
+	}
+	for i := 1; i < len(weights); i++ {
+		if weights[i] <= weights[i-1] {
+			t.Fatalf("weights = %v, want strictly increasing", weights)
+		}
+	}
+}
+
+func TestNew_MaxMetadataBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		blob    string
+		wantErr bool
+	}{
+		{name: "unlimited", limit: 0, blob: strings.Repeat("x", 4096)},
+		{name: "within limit", limit: 512, blob: "small"},
+		{name: "exceeds limit", limit: 512, blob: strings.Repeat("x", 600), wantErr: true},
+		// Reserved routing keys alone are ~80 bytes and count toward the budget.
+		{name: "reserved keys count", limit: 40, blob: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(
+				WithServiceName("meta-limit"),
+				WithMetadata("blob", tt.blob),
+				WithMaxMetadataBytes(tt.limit),
+			)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("wantErr=%v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNew_MaxMetadataBytesNamesOffendingKeys(t *testing.T) {
+	_, err := New(
+		WithServiceName("meta-limit"),
+		WithMetadata("blob", strings.Repeat("x", 600)),
+		WithMetadata("env", "prod"),
+		WithMaxMetadataBytes(512),
+	)
+	if err == nil {
+		t.Fatal("expected error for oversized metadata")
+	}
+	if !strings.Contains(err.Error(), "blob (604 bytes)") {
+		t.Fatalf("error should name the offending key: %v", err)
+	}
+	if strings.Contains(err.Error(), "env") {
+		t.Fatalf("error should not name keys that fit: %v", err)
+	}
+}
+
+func TestLogAttrs_OnHeartbeatFailure(t *testing.T) {
+	// Nothing listens on this port, so every heartbeat fails.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+
+	var buf syncBuffer
+	svc, err := New(
+		WithServiceName("log-attrs"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithDiscoveryAddress(dead),
+		WithHealthInterval(20*time.Millisecond),
+		WithLogger(slog.New(slog.NewJSONHandler(&buf, nil))),
+		WithLogAttrs(slog.String("env", "staging"), slog.String("region", "eu-west-1")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return strings.Contains(buf.String(), "heartbeat failed") })
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if !strings.Contains(line, "heartbeat failed") {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decode log line: %v", err)
+		}
+		if entry["env"] != "staging" || entry["region"] != "eu-west-1" {
+			t.Fatalf("expected env/region attrs on heartbeat log, got %v", entry)
+		}
+		return
+	}
+}
+
+func TestShutdownBudget_BoundsSlowHandler(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("budget"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithShutdownBudget(300*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	svc.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})
+
+	addr, stop := runService(t, svc)
+	go http.Get("http://" + addr + "/slow")
+	<-entered
+
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("shutdown took %v, budget was 300ms", elapsed)
+	}
+	if n := len(fd.Deregisters()); n != 1 {
+		t.Fatalf("expected deregistration within budget, got %d", n)
+	}
+}
+
+func TestForceCloseAfter_ClosesHungConnections(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	var logs syncBuffer
+
+	svc, err := New(
+		WithServiceName("force-close"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithForceCloseAfter(200*time.Millisecond),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	svc.HandleFunc("GET /hang", func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release // never returns on its own
+	})
+
+	addr, stop := runService(t, svc)
+	clientErr := make(chan error, 1)
+	go func() {
+		_, err := http.Get("http://" + addr + "/hang")
+		clientErr <- err
+	}()
+	<-entered
+
+	start := time.Now()
+	stop()
+	elapsed := time.Since(start)
+	if elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("shutdown took %v, want about 200ms", elapsed)
+	}
+
+	select {
+	case err := <-clientErr:
+		if err == nil {
+			t.Fatal("expected the hung request to fail when its connection was closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not force-closed")
+	}
+	if !strings.Contains(logs.String(), "force-closing connection") {
+		t.Fatalf("force-closed connection not logged:\n%s", logs.String())
+	}
+}
+
+func TestShortRequestDrain_LongRunningKeepsBudget(t *testing.T) {
+	svc, err := New(
+		WithServiceName("mixed"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+		WithForceCloseAfter(5*time.Second),
+		WithShortRequestDrain(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entered sync.WaitGroup
+	entered.Add(2)
+	release := make(chan struct{})
+	defer close(release)
+	finishLong := make(chan struct{})
+	svc.HandleFunc("GET /short", func(w http.ResponseWriter, r *http.Request) {
+		entered.Done()
+		select {
+		case <-release:
+		case <-r.Context().Done(): // connection closed
+		}
+	})
+	svc.HandleFunc("GET /long", func(w http.ResponseWriter, r *http.Request) {
+		MarkLongRunning(r.Context())
+		entered.Done()
+		<-finishLong
+		w.Write([]byte("done"))
+	})
+
+	addr, stop := runService(t, svc)
+	type result struct {
+		status int
+		err    error
+		at     time.Duration
+	}
+	get := func(path string, out chan<- result) {
+		resp, err := http.Get("http://" + addr + path)
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			out <- result{status: resp.StatusCode, err: err}
+			return
+		}
+		out <- result{err: err}
+	}
+	shortRes, longRes := make(chan result, 1), make(chan result, 1)
+	go get("/short", shortRes)
+	go get("/long", longRes)
+	entered.Wait()
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+
+	select {
+	case r := <-shortRes:
+		if r.err == nil {
+			t.Fatalf("short request completed with %d, want it cut off", r.status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("short request was not cut off after ShortRequestDrain")
+	}
+
+	// The long request is still being served after the short one was cut.
+	select {
+	case r := <-longRes:
+		t.Fatalf("long request ended early: %+v", r)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(finishLong)
+	if r := <-longRes; r.err != nil || r.status != http.StatusOK {
+		t.Fatalf("long request = %+v, want 200", r)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWeightedDrain(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	const delay = 150 * time.Millisecond
+
+	svc, err := New(
+		WithServiceName("weighted"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithRoutingWeight(10),
+		WithWeightedDrain(true),
+		WithPostDeregisterDelay(delay),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+
+	var (
+		loweredAt time.Time
+		weights   []string
+	)
+	fd.registerHook = func(context.Context, *pb.RegisterServiceRequest) error {
+		loweredAt = time.Now()
+		return nil
+	}
+	deregistered := make(chan time.Time, 1)
+	fd.deregisterHook = func(context.Context, *pb.DeregisterServiceRequest) error {
+		for _, r := range fd.Registers() {
+			weights = append(weights, r.Metadata["weight"])
+		}
+		deregistered <- time.Now()
+		return nil
+	}
+	stop()
+
+	deregAt := <-deregistered
+	if want := []string{"10", "1"}; !slices.Equal(weights, want) {
+		t.Fatalf("registered weights before deregister = %v, want %v", weights, want)
+	}
+	if gap := deregAt.Sub(loweredAt); gap < delay {
+		t.Fatalf("deregistered %v after lowering the weight, want at least %v", gap, delay)
+	}
+}
+
+func TestWeightedDrain_WithinBudget(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	const budget = 800 * time.Millisecond
+
+	svc, err := New(
+		WithServiceName("weighted"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithRoutingWeight(10),
+		WithWeightedDrain(true),
+		WithPostDeregisterDelay(time.Minute),
+		WithShutdownBudget(budget),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	svc.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})
+
+	addr, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+	go http.Get("http://" + addr + "/slow")
+	<-entered
+
+	// Discovery hangs on both the weight update and the deregister, so
+	// each takes its whole share of the budget.
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	fd.registerHook = func(ctx context.Context, _ *pb.RegisterServiceRequest) error { return hang(ctx) }
+	fd.deregisterHook = func(ctx context.Context, _ *pb.DeregisterServiceRequest) error { return hang(ctx) }
+
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed > budget+100*time.Millisecond {
+		t.Fatalf("shutdown took %v, budget was %v", elapsed, budget)
+	}
+}
+
+func TestWeightedDrain_SkippedWhenHurried(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	svc, err := New(
+		WithServiceName("weighted"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithRoutingWeight(10),
+		WithWeightedDrain(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+	svc.hurryShutdown()
+	stop()
+
+	if n := len(fd.Registers()); n != 1 {
+		t.Fatalf("registered %d times, want no weight update after a second signal", n)
+	}
+	if n := len(fd.Deregisters()); n != 1 {
+		t.Fatalf("deregistered %d times, want 1", n)
+	}
+}
+
+func TestPostDeregisterDelay_Ordering(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	const delay = 200 * time.Millisecond
+
+	svc, err := New(
+		WithServiceName("settle"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithPostDeregisterDelay(delay),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+
+	get := func(path string) (int, error) {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			return 0, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	var (
+		deregAt        time.Time
+		readyAtDereg   int
+		servedInSettle bool
+	)
+	deregistered := make(chan struct{})
+	fd.deregisterHook = func(context.Context, *pb.DeregisterServiceRequest) error {
+		deregAt = time.Now()
+		readyAtDereg, _ = get("/ready")
+		close(deregistered)
+		return nil
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+
+	<-deregistered
+	// Still accepting connections during the settle delay.
+	_, err = get("/health")
+	servedInSettle = err == nil
+	<-stopped
+	elapsed := time.Since(deregAt)
+
+	if readyAtDereg != http.StatusServiceUnavailable {
+		t.Fatalf("readiness at deregister = %d, want 503", readyAtDereg)
+	}
+	if !servedInSettle {
+		t.Fatal("server stopped accepting requests before the settle delay elapsed")
+	}
+	if elapsed < delay {
+		t.Fatalf("server stopped %v after deregister, want at least %v", elapsed, delay)
+	}
+}
+
+func TestShutdown_DisablesKeepAlives(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	svc, err := New(
+		WithServiceName("keepalive"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithPostDeregisterDelay(200*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+
+	connClose := func() bool {
+		resp, err := http.Get("http://" + addr + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.Close
+	}
+	if connClose() {
+		t.Fatal("Connection: close before shutdown")
+	}
+
+	deregistered := make(chan struct{})
+	fd.deregisterHook = func(context.Context, *pb.DeregisterServiceRequest) error {
+		close(deregistered)
+		return nil
+	}
+	go stop()
+	<-deregistered
+
+	// Served during the post-deregister delay, on the idle connection
+	// from before if it survived.
+	if !connClose() {
+		t.Fatal("response during shutdown lacks Connection: close")
+	}
+}
+
+func TestShutdown_Phases(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	phases := make(chan Phase, 4)
+	svc, err := New(
+		WithServiceName("phases"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithPhaseChannel(phases),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The deregister RPC must arrive after Deregistering was reported.
+	var sawDeregistering bool
+	fd.deregisterHook = func(context.Context, *pb.DeregisterServiceRequest) error {
+		sawDeregistering = len(phases) == 2
+		return nil
+	}
+
+	_, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	close(phases)
+
+	var got []Phase
+	for p := range phases {
+		got = append(got, p)
+	}
+	want := []Phase{PhaseDraining, PhaseDeregistering, PhaseServerStopping, PhaseStopped}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("phases = %v, want %v", got, want)
+	}
+	if !sawDeregistering {
+		t.Fatal("Deregister sent before the Deregistering phase")
+	}
+}
+
+func TestRun_SecondSignalSkipsDrain(t *testing.T) {
+	sigs := make(chan chan<- os.Signal, 1)
+	orig := notifySignals
+	notifySignals = func(c chan<- os.Signal, _ ...os.Signal) { sigs <- c }
+	defer func() { notifySignals = orig }()
+
+	fd := startFakeDiscovery(t)
+	phases := make(chan Phase, 4)
+	svc, err := New(
+		WithServiceName("hurry"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithPhaseChannel(phases),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A request that ignores cancellation would hold the default 10s drain.
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	svc.HandleFunc("GET /stuck", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- svc.Run(context.Background()) }()
+	sigCh := <-sigs
+	waitFor(t, 2*time.Second, svc.registered.Load)
+	go http.Get("http://" + svc.Addr() + "/stuck")
+	<-started
+
+	sigCh <- syscall.SIGTERM
+	for p := range phases {
+		if p == PhaseServerStopping {
+			break
+		}
+	}
+	start := time.Now()
+	sigCh <- syscall.SIGTERM
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run still draining after a second signal")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took %v after the second signal", elapsed)
+	}
+	if len(fd.Deregisters()) != 1 {
+		t.Fatalf("deregistrations = %d, want 1", len(fd.Deregisters()))
+	}
+}
+
+func TestMeshService_IsRegistered(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	var evict atomic.Bool
+	fd.reportHook = func(context.Context, *pb.ReportHealthRequest) error {
+		if evict.Load() {
+			return status.Error(codes.NotFound, "unknown service id")
+		}
+		return nil
+	}
+	svc, err := New(
+		WithServiceName("membership"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(20*time.Millisecond),
+		WithHealthTimeout(10*time.Millisecond),
+		WithReportRegistration(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.IsRegistered() {
+		t.Fatal("registered before Start")
+	}
+
+	registeredIn := func(path string) string {
+		rec := httptest.NewRecorder()
+		svc.handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var body map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return body["registered"]
+	}
+
+	_, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, svc.IsRegistered)
+	if got := registeredIn("/health"); got != "true" {
+		t.Fatalf("health registered = %v, want true", got)
+	}
+
+	ctx := context.Background()
+	if err := svc.Deregister(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if svc.IsRegistered() {
+		t.Fatal("registered after Deregister")
+	}
+	if got := registeredIn("/ready"); got != "false" {
+		t.Fatalf("readiness registered = %v, want false", got)
+	}
+
+	if err := svc.Reregister(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !svc.IsRegistered() {
+		t.Fatal("not registered after Reregister")
+	}
+
+	evict.Store(true)
+	waitFor(t, 2*time.Second, func() bool { return !svc.IsRegistered() })
+	evict.Store(false)
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if svc.IsRegistered() {
+		t.Fatal("registered after shutdown")
+	}
+}
+
+func TestRegisterTimeout(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	fd.registerHook = func(ctx context.Context, _ *pb.RegisterServiceRequest) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+	var logs syncBuffer
+	svc, err := New(
+		WithServiceName("slow-discovery"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithRegisterTimeout(100*time.Millisecond),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runService(t, svc)
+	waitFor(t, time.Second, func() bool { return strings.Contains(logs.String(), "registration failed") })
+
+	start := time.Now()
+	err = svc.Reregister(context.Background())
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Reregister = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Reregister returned after %v", elapsed)
+	}
+}
+
+func TestShutdown_PhaseChannelNeverBlocks(t *testing.T) {
+	svc, err := New(
+		WithServiceName("phases"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithHeartbeat(false),
+		WithPhaseChannel(make(chan Phase)), // unbuffered, never read
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop := runService(t, svc)
+	done := make(chan error, 1)
+	go func() { done <- stop() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown blocked on the phase channel")
+	}
+}
+
+func TestShutdownTimeouts(t *testing.T) {
+	tests := []struct {
+		budget, dereg, force time.Duration
+		wantDereg, drain     time.Duration
+	}{
+		{0, 5 * time.Second, 0, 5 * time.Second, 10 * time.Second},
+		{0, 2 * time.Second, 0, 2 * time.Second, 10 * time.Second},
+		{8 * time.Second, 5 * time.Second, 0, 2 * time.Second, 6 * time.Second},
+		{8 * time.Second, time.Second, 0, time.Second, 7 * time.Second},
+		{0, 5 * time.Second, 30 * time.Second, 5 * time.Second, 30 * time.Second},
+		{8 * time.Second, 5 * time.Second, time.Second, 2 * time.Second, time.Second},
+	}
+
+	for _, tt := range tests {
+		svc, err := New(WithServiceName("budget"), WithShutdownBudget(tt.budget), WithDeregisterTimeout(tt.dereg), WithForceCloseAfter(tt.force))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dereg, drain := svc.shutdownTimeouts()
+		if dereg != tt.wantDereg || drain != tt.drain {
+			t.Errorf("budget %v: got (%v, %v), want (%v, %v)", tt.budget, dereg, drain, tt.wantDereg, tt.drain)
+		}
+	}
+}
+
+func TestRegister_ProbeConfig(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("probed"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithHealthInterval(5*time.Second),
+		WithProbePath("/livez"),
+		WithProbeInterval(20*time.Second),
+		WithProbeTimeout(2*time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	hc := fd.Registers()[0].HealthCheck
+	if hc.Endpoint != "/livez" {
+		t.Fatalf("Endpoint = %q, want /livez", hc.Endpoint)
+	}
+	if hc.IntervalSeconds != 20 {
+		t.Fatalf("IntervalSeconds = %d, want 20", hc.IntervalSeconds)
+	}
+	if hc.TimeoutSeconds != 2 {
+		t.Fatalf("TimeoutSeconds = %d, want 2", hc.TimeoutSeconds)
+	}
+}
+
+func TestRegister_ProbePort(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	svc, err := New(
+		WithServiceName("probed"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithProbePath("/livez"),
+		WithProbePort(9901),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	req := fd.Registers()[0]
+	if want := "http://127.0.0.1:9901/livez"; req.HealthCheck.Endpoint != want {
+		t.Fatalf("Endpoint = %q, want %q", req.HealthCheck.Endpoint, want)
+	}
+	if got := req.Metadata["health_check_port"]; got != "9901" {
+		t.Fatalf("health_check_port = %q, want 9901", got)
+	}
+}
+
+func TestDiscoveryConnState(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	svc, err := New(
+		WithServiceName("conn-state"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := svc.DiscoveryConnState(); got != connectivity.Idle {
+		t.Fatalf("before start: %v, want IDLE", got)
+	}
+
+	addr, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return svc.DiscoveryConnState() == connectivity.Ready })
+
+	resp, err := http.Get("http://" + addr + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]string
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if body["discovery"] != "READY" {
+		t.Fatalf("health body discovery = %q, want READY", body["discovery"])
+	}
+
+	stop()
+	if got := svc.DiscoveryConnState(); got != connectivity.Shutdown {
+		t.Fatalf("after stop: %v, want SHUTDOWN", got)
+	}
+}
+
+func TestShutdownReason(t *testing.T) {
+	t.Run("context cancelled", func(t *testing.T) {
+		fd := startFakeDiscovery(t)
+		svc, err := New(
+			WithServiceName("reason"),
+			WithAddress("127.0.0.1"),
+			WithPort(0),
+			WithDiscoveryAddress(fd.addr),
+			WithHeartbeat(false),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, stop := runService(t, svc)
+		stop()
+
+		if got := svc.ShutdownReason(); got != "context canceled" {
+			t.Fatalf("ShutdownReason = %q", got)
+		}
+		reports := fd.Reports()
+		if len(reports) != 1 || reports[0].Output != "shutting down: context canceled" {
+			t.Fatalf("unexpected degraded report %v", reports)
+		}
+	})
+
+	t.Run("SIGTERM", func(t *testing.T) {
+		sigs := make(chan chan<- os.Signal, 1)
+		orig := notifySignals
+		notifySignals = func(c chan<- os.Signal, _ ...os.Signal) { sigs <- c }
+		defer func() { notifySignals = orig }()
+
+		fd := startFakeDiscovery(t)
+		svc, err := New(
+			WithServiceName("reason"),
+			WithAddress("127.0.0.1"),
+			WithPort(0),
+			WithDiscoveryAddress(fd.addr),
+			WithHeartbeat(false),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- svc.Run(context.Background()) }()
+		sigCh := <-sigs
+		waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+		sigCh <- syscall.SIGTERM
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return after SIGTERM")
+		}
+
+		if got := svc.ShutdownReason(); got != "received signal terminated" {
+			t.Fatalf("ShutdownReason = %q", got)
+		}
+		reports := fd.Reports()
+		if len(reports) != 1 || !strings.Contains(reports[0].Output, "received signal terminated") {
+			t.Fatalf("unexpected degraded report %v", reports)
+		}
+	})
+}
+
+func TestStop(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	svc, err := New(
+		WithServiceName("stopper"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.Stop(context.Background()); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("Stop before start = %v, want ErrNotStarted", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- svc.Start(context.Background()) }()
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stopErr := make(chan error, 1)
+	go func() { stopErr <- svc.Stop(ctx) }()
+
+	if err := <-stopErr; err != nil {
+		t.Fatalf("Stop = %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Start = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+
+	if got := svc.ShutdownReason(); got != "stop requested" {
+		t.Fatalf("ShutdownReason = %q", got)
+	}
+	if n := len(fd.Deregisters()); n != 1 {
+		t.Fatalf("expected 1 Deregister, got %d", n)
+	}
+	if err := svc.Stop(ctx); err != nil {
+		t.Fatalf("second Stop = %v", err)
+	}
+}
+
+func TestHeartbeatTimeout_ClampedToInterval(t *testing.T) {
+	tests := []struct {
+		name  string
+		lease time.Duration
+		want  time.Duration
+	}{
+		{name: "no lease", want: 5 * time.Second},
+		{name: "long lease", lease: time.Minute, want: 5 * time.Second},
+		{name: "short lease", lease: 2 * time.Second, want: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, err := New(
+				WithServiceName("clamped"),
+				WithHealthInterval(30*time.Second),
+				WithHeartbeatTimeout(5*time.Second),
+				WithLeaseTTL(tt.lease),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := svc.heartbeatTimeout(); got != tt.want {
+				t.Fatalf("heartbeatTimeout = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeartbeat_ClampedToLeaseTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		// header is the lease TTL Discovery announces; "" = none.
+		header string
+	}{
+		{name: "TTL from Register response", header: "200ms"},
+		{name: "configured TTL", opts: []Option{WithLeaseTTL(200 * time.Millisecond)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			if tt.header != "" {
+				fd.registerHook = func(ctx context.Context, _ *pb.RegisterServiceRequest) error {
+					return grpc.SetHeader(ctx, metadata.Pairs(LeaseTTLHeader, tt.header))
+				}
+			}
+			var logs syncBuffer
+			opts := append([]Option{
+				WithServiceName("leased"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHealthInterval(time.Hour),
+				WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+			}, tt.opts...)
+			svc, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runService(t, svc)
+			// With the configured hour-long interval there would be none.
+			waitFor(t, 2*time.Second, func() bool { return len(fd.Reports()) >= 2 })
+
+			if got := svc.heartbeatInterval(); got != 100*time.Millisecond {
+				t.Fatalf("heartbeat interval = %v, want 100ms", got)
+			}
+			if !strings.Contains(logs.String(), "heartbeat interval clamped") {
+				t.Fatalf("override not logged:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestHeartbeat_Payload(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	var depth atomic.Int32
+	svc, err := New(
+		WithServiceName("busy"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(20*time.Millisecond),
+		WithHeartbeatPayload(func() (HealthStatus, string) {
+			n := depth.Add(1)
+			if n >= 3 {
+				return StatusDegraded, fmt.Sprintf("queue depth %d", n)
+			}
+			return "", fmt.Sprintf("queue depth %d", n)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Reports()) >= 3 })
+
+	for i, req := range fd.Reports()[:3] {
+		wantStatus := pb.HealthStatus_HEALTH_STATUS_HEALTHY
+		if i == 2 {
+			wantStatus = pb.HealthStatus_HEALTH_STATUS_DEGRADED
+		}
+		if want := fmt.Sprintf("queue depth %d", i+1); req.Output != want || req.Status != wantStatus {
+			t.Fatalf("heartbeat %d = %v %q, want %v %q", i, req.Status, req.Output, wantStatus, want)
+		}
+	}
+}
+
+func TestHeartbeat_FailureThreshold(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail lists the outcome of each heartbeat in turn; later ones succeed.
+		fail            []bool
+		timeout         bool // fail by outlasting HeartbeatTimeout instead of with an error
+		wantReregisters int
+	}{
+		{name: "n-1 failures", fail: []bool{true, true}, wantReregisters: 0},
+		{name: "n failures", fail: []bool{true, true, true}, wantReregisters: 1},
+		{name: "n timeouts", fail: []bool{true, true, true}, timeout: true, wantReregisters: 1},
+		{name: "success resets", fail: []bool{true, true, false, true, true}, wantReregisters: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			var calls atomic.Int32
+			fd.reportHook = func(ctx context.Context, _ *pb.ReportHealthRequest) error {
+				if i := int(calls.Add(1)) - 1; i < len(tt.fail) && tt.fail[i] {
+					if tt.timeout {
+						<-ctx.Done()
+						return ctx.Err()
+					}
+					return status.Error(codes.Unavailable, "discovery restarting")
+				}
+				return nil
+			}
+
+			svc, err := New(
+				WithServiceName("flaky"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHealthInterval(20*time.Millisecond),
+				WithHealthTimeout(10*time.Millisecond),
+				WithHeartbeatFailureThreshold(3),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runService(t, svc)
+			// Two successful heartbeats past the scripted ones.
+			waitFor(t, 2*time.Second, func() bool { return int(calls.Load()) >= len(tt.fail)+2 })
+
+			if got := len(fd.Registers()) - 1; got != tt.wantReregisters {
+				t.Fatalf("re-registrations = %d, want %d", got, tt.wantReregisters)
+			}
+		})
+	}
+}
+
+func TestReregisterInterval(t *testing.T) {
+	tests := []struct {
+		name      string
+		heartbeat bool
+	}{
+		{name: "with heartbeats", heartbeat: true},
+		{name: "without heartbeats", heartbeat: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			svc, err := New(
+				WithServiceName("refresh"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHealthInterval(20*time.Millisecond),
+				WithHealthTimeout(10*time.Millisecond),
+				WithHeartbeat(tt.heartbeat),
+				WithReregisterInterval(50*time.Millisecond),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			runService(t, svc)
+			waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) >= 3 })
+			if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+				t.Fatalf("3 registrations after %v, want at least 2 intervals apart", elapsed)
+			}
+
+			regs := fd.Registers()
+			if regs[1].GetServiceId() != regs[0].GetServiceId() {
+				t.Fatalf("re-registered as %q, want %q", regs[1].GetServiceId(), regs[0].GetServiceId())
+			}
+		})
+	}
+}
+
+func TestHeartbeat_UsesHealthTimeout(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	var mu sync.Mutex
+	var remaining []time.Duration
+	fd.reportHook = func(ctx context.Context, _ *pb.ReportHealthRequest) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return errors.New("heartbeat has no deadline")
+		}
+		mu.Lock()
+		remaining = append(remaining, time.Until(deadline))
+		mu.Unlock()
+		return nil
+	}
+
+	svc, err := New(
+		WithServiceName("hb-timeout"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithAutoRegister(false),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(200*time.Millisecond),
+		WithHealthTimeout(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Reports()) >= 1 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(remaining) == 0 || remaining[0] <= 0 || remaining[0] > 50*time.Millisecond {
+		t.Fatalf("heartbeat deadline should be within 50ms, got %v", remaining)
+	}
+}
+
+func TestDiscoveryTimeouts_Honored(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	// Both hooks stall until the client gives up, recording the deadline the
+	// client attached to the call.
+	var mu sync.Mutex
+	budget := map[string]time.Duration{}
+	stall := func(kind string, ctx context.Context) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return errors.New("no deadline")
+		}
+		mu.Lock()
+		if _, seen := budget[kind]; !seen {
+			budget[kind] = time.Until(deadline)
+		}
+		mu.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	fd.reportHook = func(ctx context.Context, req *pb.ReportHealthRequest) error {
+		if req.Status == pb.HealthStatus_HEALTH_STATUS_DEGRADED {
+			return nil
+		}
+		return stall("heartbeat", ctx)
+	}
+	fd.deregisterHook = func(ctx context.Context, _ *pb.DeregisterServiceRequest) error {
+		return stall("deregister", ctx)
+	}
+
+	svc, err := New(
+		WithServiceName("timeouts"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(100*time.Millisecond),
+		WithHealthTimeout(80*time.Millisecond),
+		WithHeartbeatTimeout(20*time.Millisecond),
+		WithDeregisterTimeout(60*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		_, ok := budget["heartbeat"]
+		return ok
+	})
+
+	start := time.Now()
+	stop()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("shutdown took %v with a 60ms deregister timeout", elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if d := budget["heartbeat"]; d <= 0 || d > 20*time.Millisecond {
+		t.Fatalf("heartbeat deadline %v, want <= 20ms", d)
+	}
+	if d := budget["deregister"]; d <= 0 || d > 60*time.Millisecond {
+		t.Fatalf("deregister deadline %v, want <= 60ms", d)
+	}
+}
+
+func TestShutdown_DuringPendingRegistrationLeavesNoGhost(t *testing.T) {
+	tests := []struct {
+		name string
+		// stall makes Register block until the client gives up instead of
+		// completing after a short delay.
+		stall bool
+	}{
+		{name: "slow registration completes during shutdown"},
+		{name: "registration still pending at deregister timeout", stall: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			entered := make(chan struct{}, 1)
+			fd.registerHook = func(ctx context.Context, _ *pb.RegisterServiceRequest) error {
+				entered <- struct{}{}
+				if tt.stall {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				time.Sleep(100 * time.Millisecond)
+				return nil
+			}
+
+			svc, err := New(
+				WithServiceName("ghost"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHeartbeat(false),
+				WithDeregisterTimeout(time.Second),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, stop := runService(t, svc)
+			<-entered
+			stop()
+
+			fd.mu.Lock()
+			defer fd.mu.Unlock()
+			if len(fd.instances) != 0 {
+				t.Fatalf("left ghost registration(s): %v", fd.instances)
+			}
+			if len(fd.deregisters) != 1 {
+				t.Fatalf("expected 1 Deregister RPC, got %d", len(fd.deregisters))
+			}
+		})
+	}
+}
+
+func TestDeregister_Retries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failWith codes.Code
+		want     int // Deregister RPCs the service should send
+	}{
+		{name: "transient failure retried", failWith: codes.Unavailable, want: 2},
+		{name: "not found is success", failWith: codes.NotFound, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			var calls atomic.Int32
+			fd.deregisterHook = func(context.Context, *pb.DeregisterServiceRequest) error {
+				if calls.Add(1) == 1 {
+					return status.Error(tt.failWith, "first attempt fails")
+				}
+				return nil
+			}
+
+			svc, err := New(
+				WithServiceName("retry-dereg"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHeartbeat(false),
+				WithDeregisterRetries(2),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, stop := runService(t, svc)
+			waitFor(t, 2*time.Second, svc.registered.Load)
+			stop()
+
+			if n := int(calls.Load()); n != tt.want {
+				t.Fatalf("got %d Deregister RPCs, want %d", n, tt.want)
+			}
+			if tt.failWith == codes.Unavailable {
+				fd.mu.Lock()
+				defer fd.mu.Unlock()
+				if len(fd.instances) != 0 {
+					t.Fatalf("entry not removed: %v", fd.instances)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdown_SkipsDeregisterWhenNeverRegistered(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	var attempts atomic.Int32
+	fd.registerHook = func(context.Context, *pb.RegisterServiceRequest) error {
+		attempts.Add(1)
+		return status.Error(codes.Unavailable, "not now")
+	}
+
+	svc, err := New(
+		WithServiceName("unregistered"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return attempts.Load() >= 1 })
+	stop()
+
+	if n := len(fd.Deregisters()); n != 0 {
+		t.Fatalf("expected no Deregister RPC, got %d", n)
+	}
+}
+
+func TestDeregister_Idempotent(t *testing.T) {
+	tests := []struct {
+		name       string
+		reregister bool // call Reregister after the manual Deregister
+		want       int  // Deregister RPCs in total, including shutdown's
+	}{
+		{name: "manual then shutdown", want: 1},
+		{name: "reregistered before shutdown", reregister: true, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			svc, err := New(
+				WithServiceName("once"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHeartbeat(false),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, stop := runService(t, svc)
+			waitFor(t, 2*time.Second, svc.registered.Load)
+
+			ctx := context.Background()
+			for range 2 {
+				if err := svc.Deregister(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.reregister {
+				if err := svc.Reregister(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stop()
+
+			if n := len(fd.Deregisters()); n != tt.want {
+				t.Fatalf("Deregister RPCs = %d, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeregisterReregister_Serialized(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	var weight atomic.Int32
+	svc, err := New(
+		WithServiceName("racy"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(2*time.Millisecond),
+		WithHealthTimeout(time.Millisecond),
+		WithHeartbeatTimeout(time.Second),
+		// A changing weight makes every heartbeat re-register.
+		WithDynamicWeight(func() int { return int(weight.Add(1)%5) + 1 }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.Deregister(context.Background()); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("Deregister before start = %v, want ErrNotStarted", err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if i%2 == 0 {
+					svc.Deregister(ctx)
+				} else {
+					svc.Reregister(ctx)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	registeredIn := func() bool {
+		fd.mu.Lock()
+		defer fd.mu.Unlock()
+		_, ok := fd.instances[svc.opts.ServiceID]
+		return ok
+	}
+
+	// The last explicit intent wins, even with heartbeats re-registering.
+	if err := svc.Deregister(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if registeredIn() || svc.registered.Load() {
+		t.Fatal("instance re-registered after Deregister")
+	}
+
+	if err := svc.Reregister(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !registeredIn() || !svc.registered.Load() {
+		t.Fatal("instance missing after Reregister")
+	}
+}
+
+func TestRegisterLoop_RetriesUntilSuccess(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	var attempts atomic.Int32
+	fd.registerHook = func(context.Context, *pb.RegisterServiceRequest) error {
+		if attempts.Add(1) == 1 {
+			return status.Error(codes.Unavailable, "starting up")
+		}
+		return nil
+	}
+
+	svc, err := New(
+		WithServiceName("retry"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 3*time.Second, svc.registered.Load)
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("expected 2 Register attempts, got %d", n)
+	}
+}
+
+func TestDeregister_FailureKeepsRegistration(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	svc, err := New(
+		WithServiceName("stubborn"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithDeregisterRetries(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+	fd.deregisterHook = func(context.Context, *pb.DeregisterServiceRequest) error {
+		return status.Error(codes.Unavailable, "discovery restarting")
+	}
+
+	if err := svc.Deregister(context.Background()); err == nil {
+		t.Fatal("Deregister succeeded, want the RPC error")
+	}
+	if svc.withdrawn.Load() {
+		t.Fatal("failed Deregister suppressed automatic re-registration")
+	}
+	if !svc.IsRegistered() {
+		t.Fatal("failed Deregister marked the instance unregistered")
+	}
+	fd.deregisterHook = nil
+	stop()
+}
+
+func TestOptions_FromBeforeRegister(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	var svc *MeshService
+	var seen atomic.Value
+	svc, err := New(
+		WithServiceName("hooked"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithBeforeRegister(func(req *pb.RegisterServiceRequest) {
+			seen.Store(svc.Options().ServiceName)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, svc.registered.Load)
+	if got := seen.Load(); got != "hooked" {
+		t.Fatalf("Options().ServiceName from the hook = %v, want hooked", got)
+	}
+}
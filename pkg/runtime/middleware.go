@@ -0,0 +1,115 @@
+package runtime
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// middleware wraps an http.Handler with additional behaviour.
+type middleware func(http.Handler) http.Handler
+
+// handler returns the service mux wrapped in the runtime's middleware chain.
+// The first middleware in the chain sees the request first.
+func (s *MeshService) handler() http.Handler {
+	chain := []middleware{requestID}
+	if s.opts.LogRequests {
+		chain = append(chain, logRequests(s.logger))
+	}
+	if s.opts.Stats != nil {
+		chain = append(chain, countRequests(s.opts.Stats))
+	}
+	chain = append(chain, s.withService)
+	if s.opts.MaxRequestBodyBytes > 0 {
+		chain = append(chain, maxBodyBytes(s.opts.MaxRequestBodyBytes))
+	}
+	if s.opts.CompressionMinSize > 0 {
+		// Probes are tiny and some probers mishandle encoded bodies.
+		chain = append(chain, compress(s.opts.CompressionMinSize, s.opts.HealthEndpoint, s.opts.ReadinessEndpoint))
+	}
+
+	h := http.Handler(s.mux)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h
+}
+
+// maxBodyBytes rejects requests whose declared Content-Length exceeds n with
+// 413, and caps undeclared (chunked) bodies so reads past n fail with
+// *http.MaxBytesError.
+func maxBodyBytes(n int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				WriteError(w, http.StatusRequestEntityTooLarge, "request_too_large",
+					fmt.Sprintf("request body exceeds %d bytes", n))
+				return
+			}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = http.MaxBytesReader(w, r.Body, n)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// logRequests logs each completed request, correlated with its trace when
+// the caller propagated one.
+func logRequests(logger *slog.Logger) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+
+			code := sw.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", code),
+				slog.Duration("duration", time.Since(start)),
+				slog.String("request_id", RequestID(r.Context())),
+			}
+			if traceID, spanID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+				attrs = append(attrs, slog.String("trace_id", traceID), slog.String("span_id", spanID))
+			}
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+		})
+	}
+}
+
+// parseTraceparent extracts the trace and parent span IDs from a W3C
+// traceparent header ("00-<32 hex>-<16 hex>-<2 hex>"). All-zero IDs are
+// invalid.
+func parseTraceparent(h string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	traceID, spanID = parts[1], parts[2]
+	if !isLowerHex(traceID, 32) || !isLowerHex(spanID, 16) {
+		return "", "", false
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(spanID, "0") == "" {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package runtime
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	svc, err := New(WithServiceName("body-limit"), WithMaxRequestBodyBytes(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.HandleFunc("POST /echo", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Write(body)
+	})
+	h := svc.handler()
+
+	tests := []struct {
+		name    string
+		body    io.Reader
+		chunked bool
+		want    int
+	}{
+		{name: "under limit", body: strings.NewReader("small"), want: http.StatusOK},
+		{name: "over limit", body: strings.NewReader(strings.Repeat("x", 64)), want: http.StatusRequestEntityTooLarge},
+		{name: "over limit chunked", body: strings.NewReader(strings.Repeat("x", 64)), chunked: true, want: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/echo", tt.body)
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	svc, err := New(WithServiceName("gzip"), WithCompression(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := `{"items":"` + strings.Repeat("abc", 200) + `"}`
+	svc.HandleFunc("GET /large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(large))
+	})
+	svc.HandleFunc("GET /small", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	})
+	svc.HandleFunc("GET /image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(large))
+	})
+	h := svc.handler()
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantEncoding   string
+		wantBody       string
+	}{
+		{name: "large gzip", path: "/large", acceptEncoding: "gzip, deflate", wantEncoding: "gzip", wantBody: large},
+		{name: "large deflate", path: "/large", acceptEncoding: "gzip;q=0.5, deflate", wantEncoding: "deflate", wantBody: large},
+		{name: "large not accepted", path: "/large", acceptEncoding: "br", wantBody: large},
+		{name: "small", path: "/small", acceptEncoding: "gzip", wantBody: `{"ok":true}`},
+		{name: "already compressed type", path: "/image", acceptEncoding: "gzip", wantBody: large},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Fatalf("Vary = %q", got)
+			}
+
+			var body io.Reader = rec.Body
+			switch tt.wantEncoding {
+			case "gzip":
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			case "deflate":
+				zr, err := zlib.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.wantBody {
+				t.Fatalf("body = %q", got)
+			}
+		})
+	}
+}
+
+func TestCompression_SkipsHealthAndStreams(t *testing.T) {
+	svc, err := New(WithServiceName("gzip"), WithCompression(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.HandleFunc("GET /stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first chunk "))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("second chunk"))
+	})
+	h := svc.handler()
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Fatal("health endpoint was compressed")
+	}
+
+	req = httptest.NewRequest("GET", "/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if !rec.Flushed {
+		t.Fatal("Flush was not propagated")
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first chunk second chunk" {
+		t.Fatalf("body = %q", got)
+	}
+}
+
+func TestLogRequests_TraceCorrelation(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name        string
+		traceparent string
+		wantTrace   bool
+	}{
+		{name: "traced", traceparent: traceparent, wantTrace: true},
+		{name: "untraced"},
+		{name: "malformed", traceparent: "00-xyz-00f067aa0ba902b7-01"},
+		{name: "zero trace id", traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs syncBuffer
+			svc, err := New(
+				WithServiceName("logged"),
+				WithLogRequests(true),
+				WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			svc.HandleFunc("GET /orders", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			})
+
+			req := httptest.NewRequest("GET", "/orders", nil)
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			svc.handler().ServeHTTP(httptest.NewRecorder(), req)
+
+			var line map[string]any
+			if err := json.Unmarshal([]byte(logs.String()), &line); err != nil {
+				t.Fatalf("log line %q: %v", logs.String(), err)
+			}
+			if line["msg"] != "request" || line["path"] != "/orders" || line["status"] != float64(http.StatusAccepted) {
+				t.Fatalf("log line = %v", line)
+			}
+			_, hasTrace := line["trace_id"]
+			if hasTrace != tt.wantTrace {
+				t.Fatalf("trace_id present = %v, want %v: %v", hasTrace, tt.wantTrace, line)
+			}
+			if tt.wantTrace && (line["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || line["span_id"] != "00f067aa0ba902b7") {
+				t.Fatalf("trace fields = %v, %v", line["trace_id"], line["span_id"])
+			}
+		})
+	}
+}
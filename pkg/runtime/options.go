@@ -1,6 +1,21 @@
 package runtime
 
-import "time"
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
 
 // LoadBalancingStrategy controls how the router distributes traffic.
 type LoadBalancingStrategy string
@@ -19,6 +34,18 @@ type RoutingOptions struct {
 	HealthCheckEndpoint string                // Health endpoint path. Default: matches ServiceOptions.HealthEndpoint.
 	Strategy            LoadBalancingStrategy // Load balancing strategy. Default: RoundRobin.
 	Weight              int                   // Weight for WeightedRoundRobin. Default: 1.
+	DynamicWeight       func() int            // Computes Weight on each heartbeat; changes trigger re-registration.
+	SlowStart           time.Duration         // Ramp the advertised weight up from 1 over this long after start, via heartbeats. 0 = off.
+	APIVersion          string                // API version served (e.g. "v2"). Omitted if empty.
+	ContentTypes        []string              // Supported content types. Omitted if empty.
+	ZoneWeights         map[string]int        // Per-zone weights for topology-aware gateways, sent as "zone_weights" JSON. Omitted if empty.
+	CapacityReporter    func() float64        // Spare capacity score in [0,1], sent as "capacity" and recomputed on each heartbeat; changes trigger re-registration.
+}
+
+// MetadataFile is a metadata value read from a file.
+type MetadataFile struct {
+	Path     string
+	Optional bool // A missing file leaves the key unset instead of failing.
 }
 
 // ServiceOptions configures a mesh service instance.
@@ -26,22 +53,274 @@ type ServiceOptions struct {
 	ServiceName string // Name registered with discovery. Required.
 	ServiceID   string // Unique instance ID. Auto-generated if empty.
 
+	Network           string // Listen network: "tcp", "tcp4", or "tcp6". Default: "tcp" (dual-stack).
 	Address           string // Bind address. Default: "0.0.0.0".
-	AdvertisedAddress string // Address advertised to discovery. Defaults to Address.
+	AdvertisedAddress string // Address advertised to discovery. Defaults to Address, or a detected interface address when Address is a wildcard.
 	Port              int    // Bind port. 0 = ephemeral (useful for tests).
+	AdvertisedPort    int    // Port advertised to discovery, e.g. a fixed port in front of an ephemeral bind. 0 = the bound port.
+	SocketActivation  bool   // Adopt a socket passed by systemd (LISTEN_FDS) instead of binding Address:Port, when one is present.
+
+	// ListenConfig binds Address:Port, so its Control function can set
+	// socket options such as SO_REUSEADDR or SO_REUSEPORT, and its
+	// KeepAlive fields tune TCP keep-alive on accepted connections. Unused
+	// with an inherited socket. nil = a zero ListenConfig: keep-alive on,
+	// with Go's default 15s period.
+	ListenConfig *net.ListenConfig
+
+	// TLSConfig makes the server speak HTTPS; it must carry a certificate.
+	// nil = plaintext. New warns when Routing.Scheme does not match, or
+	// fails if StrictScheme is set.
+	TLSConfig    *tls.Config
+	StrictScheme bool
+
+	// H2C serves HTTP/2 over plaintext (h2c) to clients with prior
+	// knowledge, alongside HTTP/1.1. Requires a nil TLSConfig. Default:
+	// false.
+	H2C bool
+
+	// AdvertisedAddressTemplate overrides AdvertisedAddress with a value
+	// resolved at start: ${VAR} and $VAR are read from the environment and
+	// {port} becomes the bound port, e.g. "${HOST_IP}:{port}". A port in the
+	// result replaces the advertised port, including AdvertisedPort. Unset
+	// variables fail Start.
+	AdvertisedAddressTemplate string
+
+	// AdvertiseFamily selects the family of the address advertised when it
+	// is detected from the host's interfaces because the bind address is a
+	// wildcard. Default: FamilyAuto.
+	AdvertiseFamily AddressFamily
 
 	HealthEndpoint     string        // Health endpoint path. Default: "/health".
+	ReadinessEndpoint  string        // Readiness endpoint path. Default: "/ready".
 	HealthInterval     time.Duration // Probe interval. Default: 30s.
-	HealthTimeout      time.Duration // Probe timeout. Default: 5s.
+	HealthTimeout      time.Duration // Probe and heartbeat RPC timeout; must be below HealthInterval. Default: 5s.
 	UnhealthyThreshold int           // Failed probes before unhealthy. Default: 3.
 
-	HeartbeatEnabled bool // Send periodic heartbeats to discovery. Default: true.
-	AutoRegister     bool // Register on startup. Default: true.
+	// HealthQueryKey lets the health endpoint double as the readiness
+	// endpoint: ?<key>=ready answers with readiness, anything else with
+	// liveness. "" = disabled.
+	HealthQueryKey string
+
+	// ReportRegistration adds "registered": "true" or "false" (see
+	// MeshService.IsRegistered) to the health and readiness bodies.
+	// Default: false.
+	ReportRegistration bool
+
+	// HealthFormat selects the body schema of the health and readiness
+	// endpoints. Status codes are the same in every format. Default:
+	// HealthFormatSimple.
+	HealthFormat HealthFormat
+
+	// JSONEncoder creates the encoder used by the built-in endpoints.
+	// Default: encoding/json, with HTML escaping unless DisableHTMLEscape.
+	JSONEncoder       func(w io.Writer) JSONEncoder
+	DisableHTMLEscape bool
+
+	// HealthCheckers run, in name order, on every request to the health
+	// endpoint, bounded by HealthTimeout. The first failure answers 503
+	// with the checker's name and error. See MeshService.RefreshHealth.
+	HealthCheckers map[string]HealthChecker
+
+	// HealthGatesReadiness also fails readiness while a HealthChecker is
+	// failing. Readiness reuses the latest result, from any probe,
+	// heartbeat or RefreshHealth, for up to HealthCacheTTL before running
+	// the checkers again. Default: false.
+	HealthGatesReadiness bool
+	HealthCacheTTL       time.Duration // 0 = run the checkers on every readiness probe.
+
+	// HealthGatesHeartbeat also runs the HealthCheckers before every
+	// heartbeat and reports UNHEALTHY to Discovery, overriding
+	// HeartbeatPayload, while one is failing. Default: false.
+	HealthGatesHeartbeat bool
+
+	// AdminAuth gates the admin endpoints (RoutesEndpoint and those added
+	// with HandleAdmin); requests it refuses get 401 or 403. Application
+	// routes and probes are unaffected. nil = admin endpoints are open.
+	AdminAuth func(*http.Request) bool
+
+	// Pprof serves the standard profiling endpoints under PprofPrefix,
+	// gated by AdminAuth. Profiles expose internals and cost CPU, so set
+	// AdminAuth wherever the port is reachable. Default: false.
+	Pprof bool
+
+	// ShutdownOnFatalCheck starts a graceful shutdown when a health
+	// checker fails with ErrFatal, so an unrecoverable instance is
+	// replaced instead of reporting unhealthy forever. Run and Start then
+	// return the checker's error, which wraps ErrFatal. Default: false.
+	ShutdownOnFatalCheck bool
+
+	// HealthResponse builds the JSON body of the health endpoint. Default:
+	// {"status":"Healthy","service":<name>,"id":<id>}. With
+	// HealthFormatIETF it replaces only the passing body.
+	HealthResponse func(r *http.Request) any
+
+	// Active probing by Discovery, independent of our outbound heartbeat.
+	ProbePath     string        // Path Discovery probes. Default: HealthEndpoint.
+	ProbePort     int           // Port Discovery probes, e.g. an admin port. 0 = the advertised port.
+	ProbeInterval time.Duration // Discovery probe interval. Default: HealthInterval.
+	ProbeTimeout  time.Duration // Discovery probe timeout. Default: HealthTimeout.
+
+	ShutdownBudget    time.Duration // Upper bound on deregistration plus HTTP drain at shutdown. 0 = DeregisterTimeout + 10s.
+	DeregisterTimeout time.Duration // Timeout for the deregister RPCs at shutdown. Default: 5s.
+	RegisterTimeout   time.Duration // Timeout for each Register RPC, so a slow Discovery cannot stall registration. 0 = none. Default: 10s.
+	DeregisterRetries int           // Extra Deregister attempts after a failure, within DeregisterTimeout. Default: 3.
+	ForceCloseAfter   time.Duration // HTTP drain limit after which lingering connections are closed. 0 = log and abandon them after the drain.
+	HeartbeatTimeout  time.Duration // Timeout for each heartbeat RPC, capped at the heartbeat interval. Default: HealthTimeout.
+	ShortRequestDrain time.Duration // Drain time for requests not marked with MarkLongRunning; their connections are then closed, cancelling their contexts. 0 = no distinction.
+
+	// HeartbeatFailureThreshold re-registers the instance after this many
+	// consecutive failed heartbeats, e.g. when Discovery restarted and lost
+	// it. A successful heartbeat resets the count. 0 = never re-register.
+	HeartbeatFailureThreshold int
+
+	// ReregisterInterval re-sends the full registration this often, on top
+	// of heartbeats, for Discovery backends that expire entries regardless
+	// of heartbeats and to refresh metadata. Any successful registration
+	// restarts the interval. Requires AutoRegister. 0 = never.
+	ReregisterInterval time.Duration
+
+	// HeartbeatPayload is called before every heartbeat to supply its
+	// status and output, e.g. queue depth. An empty status means healthy.
+	// Lame duck and MarkUnhealthy still take precedence. nil = healthy,
+	// "heartbeat".
+	HeartbeatPayload func() (HealthStatus, string)
+
+	// LeaseTTL is Discovery's registration lease. Heartbeats run at least
+	// every LeaseTTL/2, overriding a longer HealthInterval. A TTL announced
+	// in the Register response (LeaseTTLHeader) replaces it. 0 = unknown.
+	LeaseTTL time.Duration
+
+	// PostDeregisterDelay keeps the server accepting requests for a while
+	// after deregistering, so gateways can drop the instance before its
+	// listener closes. Readiness already fails during the delay. 0 = none.
+	PostDeregisterDelay time.Duration
+
+	// WeightedDrain lowers the advertised weight to the minimum at shutdown,
+	// by re-registering, and waits PostDeregisterDelay before deregistering,
+	// so weighted gateways shift traffic away gradually rather than losing
+	// the instance at once. Default: false.
+	WeightedDrain bool
 
-	DiscoveryAddress string // gRPC address of discovery service. Default: "localhost:8080".
+	MaxRequestBodyBytes int64 // Request bodies larger than this get 413. 0 = unlimited.
+	CompressionMinSize  int   // Gzip/deflate responses of at least this many bytes. 0 = disabled.
 
-	Metadata map[string]string // Custom metadata propagated to discovery.
-	Routing  RoutingOptions    // Routing configuration.
+	// MaxHeaderBytes limits the size of request headers, including the
+	// request line; larger ones get 431. net/http allows a little slack
+	// above it. Default: 1MB. 0 = net/http's default.
+	MaxHeaderBytes int
+
+	// StartupSummary adds the effective configuration to the "service
+	// starting" log line: advertised address, Discovery, strategy, TLS and
+	// heartbeat interval. Default: true.
+	StartupSummary bool
+
+	// LogRequests logs one line per request with its method, path, status,
+	// duration and request ID, plus trace_id and span_id when the request
+	// carries a W3C traceparent header. Default: false.
+	LogRequests bool
+
+	// RouteTimeouts bounds handlers by the pattern they are registered
+	// with. A handler that has not started responding in time gets 503.
+	RouteTimeouts map[string]time.Duration
+
+	// LameDuckSignal puts the service in lame-duck mode when received by Run:
+	// readiness fails and heartbeats report DEGRADED, but the server keeps
+	// serving until a shutdown signal arrives. nil = disabled.
+	LameDuckSignal os.Signal
+
+	HeartbeatEnabled       bool // Send periodic heartbeats to discovery. Default: true.
+	AutoRegister           bool // Register on startup. Default: true.
+	ReadyAfterRegistration bool // Fail readiness until the first successful Register. Default: false.
+
+	DiscoveryAddress   string        // gRPC address of discovery service. Default: "localhost:8080".
+	DiscoveryAddresses []string      // Discovery cluster endpoints. Overrides DiscoveryAddress when set.
+	DiscoveryMode      DiscoveryMode // How multiple endpoints are used. Default: DiscoveryBroadcast.
+
+	// Registrar replaces Discovery for registration, heartbeats and
+	// deregistration. The Discovery* options are then unused and no gRPC
+	// connection is made. nil = Discovery.
+	Registrar Registrar
+
+	// DiscoveryCredentials are attached to every Discovery RPC (e.g. an
+	// authorization header). nil = none.
+	DiscoveryCredentials credentials.PerRPCCredentials
+
+	// DiscoveryInterceptors wrap every Discovery RPC, outermost first.
+	DiscoveryInterceptors []grpc.UnaryClientInterceptor
+
+	// DiscoveryUserAgent is the gRPC user agent sent to Discovery; gRPC
+	// appends its own. The service ID is also sent on every RPC, in
+	// ServiceIDHeader. Default: "toska-mesh-go/<version> <ServiceName>".
+	DiscoveryUserAgent string
+
+	// DiscoveryReconnect replaces a Discovery connection that has been in
+	// TransientFailure for longer than HealthInterval with a new one,
+	// re-resolving its address, e.g. after Discovery moved to another IP
+	// behind the same DNS name. Default: false.
+	DiscoveryReconnect bool
+
+	// Resolver resolves Discovery host names, replacing gRPC's built-in DNS
+	// resolver for targets without a scheme, and checks that an advertised
+	// host name resolves. nil = the system resolver.
+	Resolver *net.Resolver
+
+	Logger   *slog.Logger // Base logger. Default: JSON to stdout at Info level.
+	Stats    StatsSink    // Receives request, heartbeat and registration metrics. nil = none.
+	LogAttrs []slog.Attr  // Attributes attached to every runtime log line.
+	LogLevel slog.Level   // Minimum level of the default logger. Default: Info. Ignored with a custom Logger.
+
+	// ConfigReload is called by Run on SIGHUP. Its options are applied on
+	// top of the current configuration; only Metadata, MetadataFiles,
+	// Routing.Weight and LogLevel take effect. Metadata files are re-read
+	// and the instance re-registers to publish the result. Changes to other
+	// options are logged and ignored. nil = SIGHUP is not handled.
+	ConfigReload func() ([]Option, error)
+
+	// PhaseChannel receives a Phase marker at each step of shutdown. Sends
+	// are non-blocking and dropped if the channel is full. nil = none.
+	PhaseChannel chan<- Phase
+
+	// BeforeRegister may modify each Register request just before it is
+	// sent, as an escape hatch for fields without a dedicated option. Only
+	// used with the default Discovery registrar.
+	BeforeRegister func(*pb.RegisterServiceRequest)
+
+	Metadata         map[string]string // Custom metadata propagated to discovery.
+	MaxMetadataBytes int               // Max total size of keys and values sent to discovery. 0 = unlimited.
+	Routing          RoutingOptions    // Routing configuration.
+
+	// AdvertiseRoutes publishes Routes() as the "routes" metadata list and
+	// serves it at RoutesEndpoint. Beyond MaxAdvertisedRoutes routes only
+	// "route_count" and "routes_endpoint" are published, keeping the
+	// registration small; the endpoint always has the full list.
+	AdvertiseRoutes     bool
+	MaxAdvertisedRoutes int // Default: 50.
+
+	// MetadataFiles sets metadata keys from file contents, read at start
+	// and on reload, so values such as tokens need not appear in args or
+	// the environment. Keys here override Metadata.
+	MetadataFiles map[string]MetadataFile
+}
+
+// JSONEncoder encodes one value per call, like *json.Encoder.
+type JSONEncoder interface {
+	Encode(v any) error
+}
+
+// clone returns a copy of o whose maps and slices are not shared with o.
+// Funcs, interfaces and channels are shared; TLSConfig is cloned.
+func (o ServiceOptions) clone() ServiceOptions {
+	o.Metadata = maps.Clone(o.Metadata)
+	o.MetadataFiles = maps.Clone(o.MetadataFiles)
+	o.HealthCheckers = maps.Clone(o.HealthCheckers)
+	o.RouteTimeouts = maps.Clone(o.RouteTimeouts)
+	o.Routing.ZoneWeights = maps.Clone(o.Routing.ZoneWeights)
+	o.Routing.ContentTypes = slices.Clone(o.Routing.ContentTypes)
+	o.DiscoveryAddresses = slices.Clone(o.DiscoveryAddresses)
+	o.DiscoveryInterceptors = slices.Clone(o.DiscoveryInterceptors)
+	o.LogAttrs = slices.Clone(o.LogAttrs)
+	o.TLSConfig = o.TLSConfig.Clone()
+	return o
 }
 
 // Option is a functional option for configuring a MeshService.
@@ -51,15 +330,25 @@ type Option func(*ServiceOptions)
 func DefaultOptions() ServiceOptions {
 	return ServiceOptions{
 		ServiceName:        "mesh-service",
+		Network:            "tcp",
 		Address:            "0.0.0.0",
 		Port:               8080,
 		HealthEndpoint:     "/health",
+		ReadinessEndpoint:  "/ready",
 		HealthInterval:     30 * time.Second,
 		HealthTimeout:      5 * time.Second,
 		UnhealthyThreshold: 3,
+		HealthFormat:       HealthFormatSimple,
+		StartupSummary:     true,
+		AdvertiseFamily:    FamilyAuto,
+		MaxHeaderBytes:     1 << 20,
+		DeregisterTimeout:  5 * time.Second,
+		RegisterTimeout:    10 * time.Second,
+		DeregisterRetries:  3,
 		HeartbeatEnabled:   true,
 		AutoRegister:       true,
 		DiscoveryAddress:   "localhost:8080",
+		DiscoveryMode:      DiscoveryBroadcast,
 		Metadata:           make(map[string]string),
 		Routing: RoutingOptions{
 			Scheme:   "http",
@@ -77,6 +366,10 @@ func WithServiceID(id string) Option {
 	return func(o *ServiceOptions) { o.ServiceID = id }
 }
 
+func WithNetwork(network string) Option {
+	return func(o *ServiceOptions) { o.Network = network }
+}
+
 func WithAddress(addr string) Option {
 	return func(o *ServiceOptions) { o.Address = addr }
 }
@@ -85,6 +378,42 @@ func WithAdvertisedAddress(addr string) Option {
 	return func(o *ServiceOptions) { o.AdvertisedAddress = addr }
 }
 
+func WithStartupSummary(enabled bool) Option {
+	return func(o *ServiceOptions) { o.StartupSummary = enabled }
+}
+
+func WithH2C(enabled bool) Option {
+	return func(o *ServiceOptions) { o.H2C = enabled }
+}
+
+func WithAdvertisedPort(port int) Option {
+	return func(o *ServiceOptions) { o.AdvertisedPort = port }
+}
+
+func WithAdvertiseFamily(family AddressFamily) Option {
+	return func(o *ServiceOptions) { o.AdvertiseFamily = family }
+}
+
+func WithAdvertisedAddressTemplate(tmpl string) Option {
+	return func(o *ServiceOptions) { o.AdvertisedAddressTemplate = tmpl }
+}
+
+func WithListenConfig(lc *net.ListenConfig) Option {
+	return func(o *ServiceOptions) { o.ListenConfig = lc }
+}
+
+func WithSocketActivation(enabled bool) Option {
+	return func(o *ServiceOptions) { o.SocketActivation = enabled }
+}
+
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(o *ServiceOptions) { o.TLSConfig = cfg }
+}
+
+func WithStrictScheme(strict bool) Option {
+	return func(o *ServiceOptions) { o.StrictScheme = strict }
+}
+
 func WithPort(port int) Option {
 	return func(o *ServiceOptions) { o.Port = port }
 }
@@ -93,10 +422,213 @@ func WithHealthEndpoint(endpoint string) Option {
 	return func(o *ServiceOptions) { o.HealthEndpoint = endpoint }
 }
 
+func WithReadinessEndpoint(endpoint string) Option {
+	return func(o *ServiceOptions) { o.ReadinessEndpoint = endpoint }
+}
+
 func WithHealthInterval(d time.Duration) Option {
 	return func(o *ServiceOptions) { o.HealthInterval = d }
 }
 
+func WithShutdownBudget(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.ShutdownBudget = d }
+}
+
+func WithHealthTimeout(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.HealthTimeout = d }
+}
+
+// WithHealthChecker adds a liveness check under name, replacing any
+// earlier one with the same name.
+func WithHealthChecker(name string, check HealthChecker) Option {
+	return func(o *ServiceOptions) {
+		if o.HealthCheckers == nil {
+			o.HealthCheckers = make(map[string]HealthChecker)
+		}
+		o.HealthCheckers[name] = check
+	}
+}
+
+// WithHealthGatesReadiness makes readiness fail while a HealthChecker is
+// failing, re-running the checkers once the last result is older than
+// WithHealthCacheTTL.
+func WithHealthGatesReadiness(enabled bool) Option {
+	return func(o *ServiceOptions) { o.HealthGatesReadiness = enabled }
+}
+
+func WithHealthCacheTTL(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.HealthCacheTTL = d }
+}
+
+func WithAdminAuth(check func(*http.Request) bool) Option {
+	return func(o *ServiceOptions) { o.AdminAuth = check }
+}
+
+func WithPprof(enabled bool) Option {
+	return func(o *ServiceOptions) { o.Pprof = enabled }
+}
+
+// WithHealthGatesHeartbeat makes heartbeats run the HealthCheckers and
+// report UNHEALTHY while one is failing.
+func WithHealthGatesHeartbeat(enabled bool) Option {
+	return func(o *ServiceOptions) { o.HealthGatesHeartbeat = enabled }
+}
+
+func WithShutdownOnFatalCheck(enabled bool) Option {
+	return func(o *ServiceOptions) { o.ShutdownOnFatalCheck = enabled }
+}
+
+func WithHealthResponse(fn func(r *http.Request) any) Option {
+	return func(o *ServiceOptions) { o.HealthResponse = fn }
+}
+
+func WithProbePath(path string) Option {
+	return func(o *ServiceOptions) { o.ProbePath = path }
+}
+
+func WithProbePort(port int) Option {
+	return func(o *ServiceOptions) { o.ProbePort = port }
+}
+
+func WithProbeInterval(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.ProbeInterval = d }
+}
+
+func WithProbeTimeout(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.ProbeTimeout = d }
+}
+
+func WithDeregisterTimeout(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.DeregisterTimeout = d }
+}
+
+func WithLeaseTTL(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.LeaseTTL = d }
+}
+
+func WithPostDeregisterDelay(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.PostDeregisterDelay = d }
+}
+
+// WithWeightedDrain lowers the advertised weight before deregistering at
+// shutdown. See ServiceOptions.WeightedDrain.
+func WithWeightedDrain(enabled bool) Option {
+	return func(o *ServiceOptions) { o.WeightedDrain = enabled }
+}
+
+func WithForceCloseAfter(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.ForceCloseAfter = d }
+}
+
+func WithShortRequestDrain(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.ShortRequestDrain = d }
+}
+
+func WithRegisterTimeout(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.RegisterTimeout = d }
+}
+
+func WithDeregisterRetries(n int) Option {
+	return func(o *ServiceOptions) { o.DeregisterRetries = n }
+}
+
+func WithHeartbeatTimeout(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.HeartbeatTimeout = d }
+}
+
+func WithHeartbeatFailureThreshold(n int) Option {
+	return func(o *ServiceOptions) { o.HeartbeatFailureThreshold = n }
+}
+
+func WithReregisterInterval(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.ReregisterInterval = d }
+}
+
+func WithHeartbeatPayload(fn func() (HealthStatus, string)) Option {
+	return func(o *ServiceOptions) { o.HeartbeatPayload = fn }
+}
+
+func WithMaxHeaderBytes(n int) Option {
+	return func(o *ServiceOptions) { o.MaxHeaderBytes = n }
+}
+
+func WithMaxRequestBodyBytes(n int64) Option {
+	return func(o *ServiceOptions) { o.MaxRequestBodyBytes = n }
+}
+
+func WithLogRequests(enabled bool) Option {
+	return func(o *ServiceOptions) { o.LogRequests = enabled }
+}
+
+// WithRouteTimeout limits the handler registered under pattern (exactly as
+// passed to Handle or HandleFunc) to d. The request context carries the
+// deadline; if nothing has been written when it expires the client gets
+// 503. Streaming handlers that have already started writing are not cut
+// off and should watch their context.
+func WithRouteTimeout(pattern string, d time.Duration) Option {
+	return func(o *ServiceOptions) {
+		if o.RouteTimeouts == nil {
+			o.RouteTimeouts = make(map[string]time.Duration)
+		}
+		o.RouteTimeouts[pattern] = d
+	}
+}
+
+// WithCompression enables gzip/deflate response compression, negotiated via
+// Accept-Encoding, for responses of at least minSize bytes. Already
+// compressed content types and the health endpoints are left alone.
+func WithCompression(minSize int) Option {
+	return func(o *ServiceOptions) { o.CompressionMinSize = max(minSize, 1) }
+}
+
+func WithJSONEncoder(fn func(w io.Writer) JSONEncoder) Option {
+	return func(o *ServiceOptions) { o.JSONEncoder = fn }
+}
+
+// WithDisableHTMLEscape stops the default encoder from escaping <, > and &
+// in built-in responses.
+func WithDisableHTMLEscape(disable bool) Option {
+	return func(o *ServiceOptions) { o.DisableHTMLEscape = disable }
+}
+
+// WithHealthQueryMode makes the health endpoint answer readiness for
+// ?type=ready and liveness otherwise, for probers that use a single path.
+func WithHealthQueryMode(enabled bool) Option {
+	return func(o *ServiceOptions) {
+		o.HealthQueryKey = ""
+		if enabled {
+			o.HealthQueryKey = "type"
+		}
+	}
+}
+
+// WithHealthQueryKey is like WithHealthQueryMode(true) with a custom query
+// parameter name.
+func WithHealthQueryKey(key string) Option {
+	return func(o *ServiceOptions) { o.HealthQueryKey = key }
+}
+
+func WithReportRegistration(enabled bool) Option {
+	return func(o *ServiceOptions) { o.ReportRegistration = enabled }
+}
+
+// WithHealthFormat selects the body schema of the health and readiness
+// endpoints.
+func WithHealthFormat(format HealthFormat) Option {
+	return func(o *ServiceOptions) { o.HealthFormat = format }
+}
+
+// WithReadyAfterRegistration holds readiness at 503 until Discovery has
+// accepted the first registration, so the instance is not reported ready
+// before it is discoverable.
+func WithReadyAfterRegistration(enabled bool) Option {
+	return func(o *ServiceOptions) { o.ReadyAfterRegistration = enabled }
+}
+
+func WithLameDuckSignal(sig os.Signal) Option {
+	return func(o *ServiceOptions) { o.LameDuckSignal = sig }
+}
+
 func WithHeartbeat(enabled bool) Option {
 	return func(o *ServiceOptions) { o.HeartbeatEnabled = enabled }
 }
@@ -109,8 +641,130 @@ func WithDiscoveryAddress(addr string) Option {
 	return func(o *ServiceOptions) { o.DiscoveryAddress = addr }
 }
 
+func WithDiscoveryAddresses(addrs ...string) Option {
+	return func(o *ServiceOptions) { o.DiscoveryAddresses = addrs }
+}
+
+func WithDiscoveryMode(mode DiscoveryMode) Option {
+	return func(o *ServiceOptions) { o.DiscoveryMode = mode }
+}
+
+func WithRegistrar(r Registrar) Option {
+	return func(o *ServiceOptions) { o.Registrar = r }
+}
+
+func WithStatsSink(sink StatsSink) Option {
+	return func(o *ServiceOptions) { o.Stats = sink }
+}
+
+// WithPhaseChannel reports shutdown phases on ch. Sends never block: use a
+// buffered channel to be sure of seeing every phase.
+func WithPhaseChannel(ch chan<- Phase) Option {
+	return func(o *ServiceOptions) { o.PhaseChannel = ch }
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(o *ServiceOptions) { o.Logger = l }
+}
+
+func WithLogLevel(level slog.Level) Option {
+	return func(o *ServiceOptions) { o.LogLevel = level }
+}
+
+func WithConfigReload(load func() ([]Option, error)) Option {
+	return func(o *ServiceOptions) { o.ConfigReload = load }
+}
+
+func WithLogAttrs(attrs ...slog.Attr) Option {
+	return func(o *ServiceOptions) { o.LogAttrs = append(o.LogAttrs, attrs...) }
+}
+
+// WithDiscoveryToken authenticates Discovery RPCs with an
+// "authorization: Bearer <token>" header.
+func WithDiscoveryToken(token string) Option {
+	return WithDiscoveryCallCredentials(bearerToken(token))
+}
+
+func WithDiscoveryCallCredentials(creds credentials.PerRPCCredentials) Option {
+	return func(o *ServiceOptions) { o.DiscoveryCredentials = creds }
+}
+
+func WithDiscoveryReconnect(enabled bool) Option {
+	return func(o *ServiceOptions) { o.DiscoveryReconnect = enabled }
+}
+
+func WithResolver(r *net.Resolver) Option {
+	return func(o *ServiceOptions) { o.Resolver = r }
+}
+
+func WithDiscoveryInterceptors(interceptors ...grpc.UnaryClientInterceptor) Option {
+	return func(o *ServiceOptions) {
+		o.DiscoveryInterceptors = append(o.DiscoveryInterceptors, interceptors...)
+	}
+}
+
+// WithDiscoveryUserAgent overrides the gRPC user agent sent to Discovery.
+func WithDiscoveryUserAgent(ua string) Option {
+	return func(o *ServiceOptions) { o.DiscoveryUserAgent = ua }
+}
+
+// WithMetadata sets key to value, replacing any earlier value for key,
+// including a list built with WithMetadataList.
 func WithMetadata(key, value string) Option {
-	return func(o *ServiceOptions) { o.Metadata[key] = value }
+	return func(o *ServiceOptions) {
+		if o.Metadata == nil {
+			o.Metadata = make(map[string]string)
+		}
+		o.Metadata[key] = value
+	}
+}
+
+func WithAdvertiseRoutes(enabled bool) Option {
+	return func(o *ServiceOptions) { o.AdvertiseRoutes = enabled }
+}
+
+func WithMaxAdvertisedRoutes(n int) Option {
+	return func(o *ServiceOptions) { o.MaxAdvertisedRoutes = n }
+}
+
+// WithMetadataFromFile sets key to the contents of the file at path, with
+// surrounding whitespace trimmed. Start fails if the file cannot be read.
+func WithMetadataFromFile(key, path string) Option {
+	return withMetadataFile(key, MetadataFile{Path: path})
+}
+
+// WithOptionalMetadataFromFile is like WithMetadataFromFile, but a missing
+// file leaves key unset instead of failing.
+func WithOptionalMetadataFromFile(key, path string) Option {
+	return withMetadataFile(key, MetadataFile{Path: path, Optional: true})
+}
+
+func withMetadataFile(key string, f MetadataFile) Option {
+	return func(o *ServiceOptions) {
+		if o.MetadataFiles == nil {
+			o.MetadataFiles = make(map[string]MetadataFile)
+		}
+		o.MetadataFiles[key] = f
+	}
+}
+
+// WithMetadataList appends values to the comma-separated list stored under
+// key, skipping values already present, so repeated calls accumulate
+// rather than overwrite. Values must not contain commas. Read lists back
+// with Instance.MetadataList.
+func WithMetadataList(key string, values ...string) Option {
+	return func(o *ServiceOptions) {
+		list := splitMetadataList(o.Metadata[key])
+		for _, v := range values {
+			if !slices.Contains(list, v) {
+				list = append(list, v)
+			}
+		}
+		if o.Metadata == nil {
+			o.Metadata = make(map[string]string)
+		}
+		o.Metadata[key] = strings.Join(list, ",")
+	}
 }
 
 func WithRoutingStrategy(s LoadBalancingStrategy) Option {
@@ -124,3 +778,49 @@ func WithRoutingWeight(w int) Option {
 func WithRoutingScheme(scheme string) Option {
 	return func(o *ServiceOptions) { o.Routing.Scheme = scheme }
 }
+
+func WithAPIVersion(v string) Option {
+	return func(o *ServiceOptions) { o.Routing.APIVersion = v }
+}
+
+func WithContentTypes(types ...string) Option {
+	return func(o *ServiceOptions) { o.Routing.ContentTypes = append(o.Routing.ContentTypes, types...) }
+}
+
+// WithZoneWeight advertises weight for traffic originating in zone, so
+// zone-aware gateways can penalize cross-zone routing. May be repeated.
+func WithZoneWeight(zone string, weight int) Option {
+	return func(o *ServiceOptions) {
+		if o.Routing.ZoneWeights == nil {
+			o.Routing.ZoneWeights = make(map[string]int)
+		}
+		o.Routing.ZoneWeights[zone] = weight
+	}
+}
+
+func WithDynamicWeight(fn func() int) Option {
+	return func(o *ServiceOptions) { o.Routing.DynamicWeight = fn }
+}
+
+// WithCapacityReporter advertises fn's score, clamped to [0,1] and rounded
+// to two decimals, as the "capacity" metadata key, so gateways can shift
+// traffic in proportion to it. It is also shown by the health endpoint.
+func WithCapacityReporter(fn func() float64) Option {
+	return func(o *ServiceOptions) { o.Routing.CapacityReporter = fn }
+}
+
+// WithBeforeRegister sets a hook that can modify every Register request
+// (initial and re-registrations) after metadata is built but before it is
+// sent.
+func WithBeforeRegister(fn func(*pb.RegisterServiceRequest)) Option {
+	return func(o *ServiceOptions) { o.BeforeRegister = fn }
+}
+
+// WithSlowStart ramps the advertised weight up from 1 over d after start.
+func WithSlowStart(d time.Duration) Option {
+	return func(o *ServiceOptions) { o.Routing.SlowStart = d }
+}
+
+func WithMaxMetadataBytes(n int) Option {
+	return func(o *ServiceOptions) { o.MaxMetadataBytes = n }
+}
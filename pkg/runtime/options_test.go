@@ -11,6 +11,9 @@ func TestDefaultOptions(t *testing.T) {
 	if o.ServiceName != "mesh-service" {
 		t.Fatalf("expected ServiceName=mesh-service, got %q", o.ServiceName)
 	}
+	if o.Network != "tcp" {
+		t.Fatalf("expected Network=tcp, got %q", o.Network)
+	}
 	if o.Address != "0.0.0.0" {
 		t.Fatalf("expected Address=0.0.0.0, got %q", o.Address)
 	}
@@ -20,6 +23,9 @@ func TestDefaultOptions(t *testing.T) {
 	if o.HealthEndpoint != "/health" {
 		t.Fatalf("expected HealthEndpoint=/health, got %q", o.HealthEndpoint)
 	}
+	if o.ReadinessEndpoint != "/ready" {
+		t.Fatalf("expected ReadinessEndpoint=/ready, got %q", o.ReadinessEndpoint)
+	}
 	if o.HealthInterval != 30*time.Second {
 		t.Fatalf("expected HealthInterval=30s, got %v", o.HealthInterval)
 	}
@@ -38,6 +44,12 @@ func TestDefaultOptions(t *testing.T) {
 	if o.Routing.Weight != 1 {
 		t.Fatalf("expected Routing.Weight=1, got %d", o.Routing.Weight)
 	}
+	if o.MaxHeaderBytes != 1<<20 {
+		t.Fatalf("expected MaxHeaderBytes=1MB, got %d", o.MaxHeaderBytes)
+	}
+	if !o.StartupSummary {
+		t.Fatal("expected StartupSummary=true")
+	}
 }
 
 func TestFunctionalOptions(t *testing.T) {
@@ -106,3 +118,70 @@ func TestFunctionalOptions(t *testing.T) {
 		t.Fatalf("Scheme: got %q", o.Routing.Scheme)
 	}
 }
+
+func TestMeshService_Options(t *testing.T) {
+	svc, err := New(
+		WithServiceName("effective"),
+		WithAddress("127.0.0.1"),
+		WithMetadata("env", "staging"),
+		WithDiscoveryAddresses("d1:8080", "d2:8080"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := svc.Options()
+	if o.ServiceID == "" {
+		t.Fatal("ServiceID not generated")
+	}
+	if o.AdvertisedAddress != "127.0.0.1" {
+		t.Fatalf("AdvertisedAddress: got %q, want the bind address", o.AdvertisedAddress)
+	}
+	if o.HealthInterval != 30*time.Second {
+		t.Fatalf("HealthInterval: got %v", o.HealthInterval)
+	}
+	if o.MaxAdvertisedRoutes != 50 {
+		t.Fatalf("MaxAdvertisedRoutes: got %d", o.MaxAdvertisedRoutes)
+	}
+
+	o.Metadata["env"] = "prod"
+	o.DiscoveryAddresses[0] = "evil:8080"
+	again := svc.Options()
+	if again.Metadata["env"] != "staging" {
+		t.Fatalf("Metadata[env] = %q after modifying a copy", again.Metadata["env"])
+	}
+	if again.DiscoveryAddresses[0] != "d1:8080" {
+		t.Fatalf("DiscoveryAddresses[0] = %q after modifying a copy", again.DiscoveryAddresses[0])
+	}
+	if again.ServiceID != o.ServiceID {
+		t.Fatalf("ServiceID changed between calls: %q, %q", o.ServiceID, again.ServiceID)
+	}
+}
+
+func TestMetadata_NilMap(t *testing.T) {
+	// As an option that assigns a hand-built ServiceOptions would.
+	bare := func(o *ServiceOptions) { o.Metadata = nil }
+
+	var o ServiceOptions
+	WithMetadata("env", "prod")(&o)
+	WithMetadataList("tags", "a", "b")(&o)
+	if o.Metadata["env"] != "prod" || o.Metadata["tags"] != "a,b" {
+		t.Fatalf("Metadata = %v", o.Metadata)
+	}
+
+	svc, err := New(bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.opts.Metadata == nil {
+		t.Fatal("New left Metadata nil")
+	}
+
+	svc, err = New(bare, WithMetadata("env", "prod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.buildMetadata()["env"]; got != "prod" {
+		t.Fatalf("metadata env = %q, want prod", got)
+	}
+}
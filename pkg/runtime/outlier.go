@@ -0,0 +1,137 @@
+package runtime
+
+import (
+	"sync"
+	"time"
+)
+
+// HealthSource decides whether the client may send traffic to an instance
+// of service. Implementations must be safe for concurrent use.
+type HealthSource interface {
+	Healthy(service string, inst Instance) bool
+}
+
+// HealthSourceFunc adapts a function to a HealthSource.
+type HealthSourceFunc func(service string, inst Instance) bool
+
+func (f HealthSourceFunc) Healthy(service string, inst Instance) bool { return f(service, inst) }
+
+// DiscoveryHealth trusts the health Discovery reports; see
+// Instance.IsHealthy.
+var DiscoveryHealth HealthSource = HealthSourceFunc(func(_ string, inst Instance) bool {
+	return inst.IsHealthy()
+})
+
+// AllHealthy combines sources: an instance is healthy only if every one of
+// them says so.
+func AllHealthy(sources ...HealthSource) HealthSource {
+	return HealthSourceFunc(func(service string, inst Instance) bool {
+		for _, src := range sources {
+			if !src.Healthy(service, inst) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// OutlierDetector is a passive HealthSource: it ejects an instance for a
+// while after a run of consecutive failed calls, whatever Discovery says.
+// Outcomes are fed to it with Observe, e.g. through Client.ReportResult.
+type OutlierDetector struct {
+	threshold int
+	ejectFor  time.Duration
+	now       func() time.Time // swapped in tests
+
+	mu        sync.Mutex
+	failures  map[string]failureRun // consecutive failures by instance
+	ejected   map[string]time.Time  // ejection expiry by instance
+	nextSweep time.Time             // when stale entries are next pruned
+}
+
+type failureRun struct {
+	count int
+	last  time.Time
+}
+
+// NewOutlierDetector returns an OutlierDetector that ejects an instance for
+// ejectFor after consecutiveFailures failed calls in a row.
+func NewOutlierDetector(consecutiveFailures int, ejectFor time.Duration) *OutlierDetector {
+	return &OutlierDetector{
+		threshold: max(consecutiveFailures, 1),
+		ejectFor:  ejectFor,
+		now:       time.Now,
+		failures:  make(map[string]failureRun),
+		ejected:   make(map[string]time.Time),
+	}
+}
+
+// Observe records the outcome of a call to inst; a nil err is a success
+// and resets its failure count. A run of failures with no new failure for
+// ejectFor is forgotten, so instances that leave the pool are not tracked
+// forever.
+func (d *OutlierDetector) Observe(service string, inst Instance, err error) {
+	key := outlierKey(service, inst)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.sweep(now)
+	if err == nil {
+		delete(d.failures, key)
+		return
+	}
+	run := d.failures[key]
+	if now.Sub(run.last) >= d.ejectFor {
+		run.count = 0
+	}
+	run.count++
+	run.last = now
+	if run.count >= d.threshold {
+		delete(d.failures, key)
+		d.ejected[key] = now.Add(d.ejectFor)
+		return
+	}
+	d.failures[key] = run
+}
+
+// sweep drops expired ejections and stale failure runs, at most once per
+// ejectFor. d.mu must be held.
+func (d *OutlierDetector) sweep(now time.Time) {
+	if now.Before(d.nextSweep) {
+		return
+	}
+	d.nextSweep = now.Add(d.ejectFor)
+	for key, until := range d.ejected {
+		if !now.Before(until) {
+			delete(d.ejected, key)
+		}
+	}
+	for key, run := range d.failures {
+		if now.Sub(run.last) >= d.ejectFor {
+			delete(d.failures, key)
+		}
+	}
+}
+
+// Healthy reports whether inst is not currently ejected.
+func (d *OutlierDetector) Healthy(service string, inst Instance) bool {
+	key := outlierKey(service, inst)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, ok := d.ejected[key]
+	if !ok {
+		return true
+	}
+	if d.now().Before(until) {
+		return false
+	}
+	delete(d.ejected, key)
+	return true
+}
+
+func outlierKey(service string, inst Instance) string {
+	if inst.ServiceID != "" {
+		return service + "/" + inst.ServiceID
+	}
+	return service + "/" + inst.HostPort()
+}
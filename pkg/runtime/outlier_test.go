@@ -0,0 +1,111 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+)
+
+func TestOutlierDetector(t *testing.T) {
+	fail := errors.New("connection refused")
+	tests := []struct {
+		name     string
+		outcomes []error
+		advance  time.Duration // clock moved forward after the outcomes
+		gap      time.Duration // with a nil outcome: wait this long, then fail
+		want     bool
+	}{
+		{name: "below threshold", outcomes: []error{fail, fail}, want: true},
+		{name: "ejected", outcomes: []error{fail, fail, fail}, want: false},
+		{name: "success resets", outcomes: []error{fail, fail, nil, fail, fail}, want: true},
+		{name: "ejection expires", outcomes: []error{fail, fail, fail}, advance: time.Minute, want: true},
+		{name: "stale run forgotten", outcomes: []error{fail, fail, nil}, gap: time.Minute, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(0, 0)
+			d := NewOutlierDetector(3, time.Minute)
+			d.now = func() time.Time { return now }
+
+			inst := Instance{ServiceID: "a"}
+			for _, err := range tt.outcomes {
+				if err == nil && tt.gap > 0 {
+					// Let the clock pass instead of reporting a success.
+					now = now.Add(tt.gap)
+					err = fail
+				}
+				d.Observe("svc", inst, err)
+			}
+			now = now.Add(tt.advance)
+			if got := d.Healthy("svc", inst); got != tt.want {
+				t.Fatalf("Healthy = %v, want %v", got, tt.want)
+			}
+			if !d.Healthy("svc", Instance{ServiceID: "b"}) {
+				t.Fatal("other instance affected")
+			}
+		})
+	}
+}
+
+func TestOutlierDetector_PrunesStaleEntries(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := NewOutlierDetector(2, time.Minute)
+	d.now = func() time.Time { return now }
+
+	// One instance is ejected and another has a failure on record; then
+	// both leave the pool and are never called again.
+	fail := errors.New("connection refused")
+	d.Observe("svc", Instance{ServiceID: "a"}, fail)
+	d.Observe("svc", Instance{ServiceID: "a"}, fail)
+	d.Observe("svc", Instance{ServiceID: "b"}, fail)
+
+	now = now.Add(time.Minute)
+	d.Observe("svc", Instance{ServiceID: "c"}, nil)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.ejected) != 0 || len(d.failures) != 0 {
+		t.Fatalf("stale entries kept: ejected=%v failures=%v", d.ejected, d.failures)
+	}
+}
+
+func TestClient_SkipsEjectedInstance(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	for _, id := range []string{"a", "b"} {
+		fd.addInstance(&pb.ServiceInstance{ServiceName: "orders", ServiceId: id,
+			Status: pb.HealthStatus_HEALTH_STATUS_HEALTHY})
+	}
+
+	for _, strategy := range []LoadBalancingStrategy{RoundRobin, Random} {
+		t.Run(string(strategy), func(t *testing.T) {
+			c, err := NewClient(
+				WithClientDiscoveryAddress(fd.addr),
+				WithClientStrategy(strategy),
+				WithClientOutlierDetector(NewOutlierDetector(2, time.Minute)),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			// Discovery says a is healthy, but calls to it keep failing.
+			ctx := context.Background()
+			for range 2 {
+				c.ReportResult("orders", Instance{ServiceID: "a"}, errors.New("connection reset"))
+			}
+			for range 20 {
+				inst, err := c.Pick(ctx, "orders")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if inst.ServiceID == "a" {
+					t.Fatal("picked the ejected instance")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	goruntime "runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PprofPrefix is where the profiling endpoints are served when Pprof is
+// set. The layout matches net/http/pprof, so `go tool pprof` works against
+// it, but that package is not imported: its init registers the same
+// handlers, ungated, on http.DefaultServeMux.
+const PprofPrefix = "/debug/pprof/"
+
+// handlePprof registers the profiling handlers under PprofPrefix, gated by
+// AdminAuth. They are not advertised with the other routes.
+func (s *MeshService) handlePprof() error {
+	for pattern, h := range map[string]http.HandlerFunc{
+		PprofPrefix:             pprofIndex, // also serves the named profiles
+		PprofPrefix + "cmdline": pprofCmdline,
+		PprofPrefix + "profile": pprofCPU,
+		PprofPrefix + "symbol":  pprofSymbol,
+		PprofPrefix + "trace":   pprofTrace,
+	} {
+		if err := muxHandle(s.mux, pattern, s.adminOnly(h)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pprofIndex lists the named profiles, or serves one when the path names
+// it, e.g. /debug/pprof/heap?debug=1.
+func pprofIndex(w http.ResponseWriter, r *http.Request) {
+	if name := strings.TrimPrefix(r.URL.Path, PprofPrefix); name != "" {
+		pprofNamed(w, r, name)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, "<html><body><p>Profiles:</p><ul>\n")
+	for _, p := range pprof.Profiles() {
+		name := html.EscapeString(p.Name())
+		fmt.Fprintf(w, "<li><a href=\"%s?debug=1\">%s</a> (%d)</li>\n", name, name, p.Count())
+	}
+	fmt.Fprint(w, "<li><a href=\"profile\">profile</a></li>\n")
+	fmt.Fprint(w, "<li><a href=\"trace\">trace</a></li>\n")
+	fmt.Fprint(w, "</ul></body></html>\n")
+}
+
+func pprofNamed(w http.ResponseWriter, r *http.Request, name string) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		WriteError(w, http.StatusNotFound, "not_found", "unknown profile "+name)
+		return
+	}
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if name == "heap" && r.URL.Query().Get("gc") != "" {
+		goruntime.GC()
+	}
+	pprofHeaders(w, name, debug)
+	p.WriteTo(w, debug)
+}
+
+func pprofCmdline(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+}
+
+// pprofCPU records a CPU profile for ?seconds= (default 30), cut short if
+// the caller goes away.
+func pprofCPU(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		WriteError(w, http.StatusInternalServerError, "profile_failed", err.Error())
+		return
+	}
+	pprofSleep(r, 30*time.Second)
+	pprof.StopCPUProfile()
+	pprofHeaders(w, "profile", 0)
+	w.Write(buf.Bytes())
+}
+
+// pprofTrace records an execution trace for ?seconds= (default 1).
+func pprofTrace(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		WriteError(w, http.StatusInternalServerError, "trace_failed", err.Error())
+		return
+	}
+	pprofSleep(r, time.Second)
+	trace.Stop()
+	pprofHeaders(w, "trace", 0)
+	w.Write(buf.Bytes())
+}
+
+// pprofSymbol maps program counters to function names: a POST body (or
+// the query string) of "+"-separated hex addresses, one line per result.
+// A GET without addresses only reports that symbols are available.
+func pprofSymbol(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "num_symbols: 1\n")
+
+	var in *bufio.Reader
+	if r.Method == http.MethodPost {
+		in = bufio.NewReader(r.Body)
+	} else {
+		in = bufio.NewReader(strings.NewReader(r.URL.RawQuery))
+	}
+	for {
+		word, err := in.ReadSlice('+')
+		if err == nil {
+			word = word[:len(word)-1]
+		}
+		pc, _ := strconv.ParseUint(string(word), 0, 64)
+		if pc != 0 {
+			if f := goruntime.FuncForPC(uintptr(pc)); f != nil {
+				fmt.Fprintf(&out, "%#x %s\n", pc, f.Name())
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+	w.Write(out.Bytes())
+}
+
+func pprofHeaders(w http.ResponseWriter, name string, debug int) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+}
+
+func pprofSleep(r *http.Request, def time.Duration) {
+	d := def
+	if sec, err := strconv.ParseFloat(r.URL.Query().Get("seconds"), 64); err == nil && sec > 0 {
+		d = time.Duration(sec * float64(time.Second))
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
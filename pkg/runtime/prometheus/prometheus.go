@@ -0,0 +1,150 @@
+// Package prometheus provides a runtime.StatsSink that records the
+// runtime's metrics with the Prometheus client library. It is a separate
+// module, so services that do not use Prometheus do not depend on it.
+//
+// Usage:
+//
+//	sink := prometheus.New(prometheus.WithNamespace("orders"))
+//	svc, err := runtime.New(
+//	    runtime.WithServiceName("orders"),
+//	    runtime.WithStatsSink(sink),
+//	)
+//	svc.Handle("GET /metrics", promhttp.Handler())
+package prometheus
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/toska-mesh/toska-mesh-go/pkg/runtime"
+)
+
+// Options configures a Sink.
+type Options struct {
+	Registerer prom.Registerer // Where metrics are registered. Default: prom.DefaultRegisterer.
+	Namespace  string          // Prefix for every metric name. Empty = none.
+	Buckets    []float64       // Histogram buckets, in seconds. Default: prom.DefBuckets.
+}
+
+// Option is a functional option for configuring a Sink.
+type Option func(*Options)
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	return Options{Registerer: prom.DefaultRegisterer, Buckets: prom.DefBuckets}
+}
+
+func WithRegisterer(r prom.Registerer) Option {
+	return func(o *Options) { o.Registerer = r }
+}
+
+func WithNamespace(ns string) Option {
+	return func(o *Options) { o.Namespace = ns }
+}
+
+func WithBuckets(buckets ...float64) Option {
+	return func(o *Options) { o.Buckets = buckets }
+}
+
+// help describes the runtime's metrics; others get a generic description.
+var help = map[string]string{
+	runtime.MetricHTTPRequests:        "HTTP requests served, by method and status code.",
+	runtime.MetricHTTPRequestDuration: "HTTP request latency in seconds, by method and status code.",
+	runtime.MetricHeartbeats:          "Heartbeats sent to Discovery, by result.",
+	runtime.MetricHeartbeatDuration:   "Heartbeat latency in seconds, by result.",
+	runtime.MetricRegistrations:       "Registrations with Discovery, by result.",
+	runtime.MetricRegistered:          "1 while the instance is registered with Discovery, else 0.",
+}
+
+// Sink is a runtime.StatsSink backed by Prometheus collectors. Each metric
+// is registered the first time it is reported, with the label names of that
+// first report; later reports with other label names are dropped.
+type Sink struct {
+	opts Options
+
+	mu         sync.Mutex
+	counters   map[string]*prom.CounterVec
+	histograms map[string]*prom.HistogramVec
+	gauges     map[string]*prom.GaugeVec
+}
+
+var _ runtime.StatsSink = (*Sink)(nil)
+
+// New creates a Sink with the given functional options.
+func New(opts ...Option) *Sink {
+	o := DefaultOptions()
+	for _, fn := range opts {
+		fn(&o)
+	}
+	return &Sink{
+		opts:       o,
+		counters:   make(map[string]*prom.CounterVec),
+		histograms: make(map[string]*prom.HistogramVec),
+		gauges:     make(map[string]*prom.GaugeVec),
+	}
+}
+
+func (s *Sink) IncCounter(name string, labels map[string]string) {
+	vec := vector(s, s.counters, name, labels, func(opts prom.Opts, names []string) *prom.CounterVec {
+		return prom.NewCounterVec(prom.CounterOpts(opts), names)
+	})
+	if c, err := vec.GetMetricWith(labels); err == nil {
+		c.Inc()
+	}
+}
+
+func (s *Sink) ObserveHistogram(name string, value float64, labels map[string]string) {
+	vec := vector(s, s.histograms, name, labels, func(opts prom.Opts, names []string) *prom.HistogramVec {
+		return prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: opts.Namespace,
+			Name:      opts.Name,
+			Help:      opts.Help,
+			Buckets:   s.opts.Buckets,
+		}, names)
+	})
+	if h, err := vec.GetMetricWith(labels); err == nil {
+		h.Observe(value)
+	}
+}
+
+func (s *Sink) SetGauge(name string, value float64, labels map[string]string) {
+	vec := vector(s, s.gauges, name, labels, func(opts prom.Opts, names []string) *prom.GaugeVec {
+		return prom.NewGaugeVec(prom.GaugeOpts(opts), names)
+	})
+	if g, err := vec.GetMetricWith(labels); err == nil {
+		g.Set(value)
+	}
+}
+
+// vector returns the collector for name, creating and registering it on
+// first use. If a collector with the same description is already
+// registered, for example by another Sink on the same Registerer, that one
+// is shared.
+func vector[V prom.Collector](s *Sink, vecs map[string]V, name string, labels map[string]string,
+	newVec func(prom.Opts, []string) V) V {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := vecs[name]; ok {
+		return v
+	}
+
+	desc := help[name]
+	if desc == "" {
+		desc = "toska-mesh runtime metric " + name + "."
+	}
+	v := newVec(prom.Opts{Namespace: s.opts.Namespace, Name: name, Help: desc}, slices.Sorted(maps.Keys(labels)))
+	if err := s.opts.Registerer.Register(v); err != nil {
+		var are prom.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(V); ok {
+				v = existing
+			}
+		}
+	}
+	vecs[name] = v
+	return v
+}
@@ -0,0 +1,54 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/toska-mesh/toska-mesh-go/pkg/runtime"
+)
+
+func TestSink(t *testing.T) {
+	reg := prom.NewRegistry()
+	sink := New(WithRegisterer(reg), WithNamespace("orders"), WithBuckets(0.1, 1))
+
+	labels := map[string]string{"method": "GET", "code": "200"}
+	sink.IncCounter(runtime.MetricHTTPRequests, labels)
+	sink.IncCounter(runtime.MetricHTTPRequests, labels)
+	sink.IncCounter(runtime.MetricHTTPRequests, map[string]string{"result": "ok"}) // wrong labels: dropped
+	sink.ObserveHistogram(runtime.MetricHeartbeatDuration, 0.05, map[string]string{"result": "ok"})
+	sink.SetGauge(runtime.MetricRegistered, 1, nil)
+
+	want := `
+# HELP orders_http_requests_total HTTP requests served, by method and status code.
+# TYPE orders_http_requests_total counter
+orders_http_requests_total{code="200",method="GET"} 2
+# HELP orders_mesh_heartbeat_duration_seconds Heartbeat latency in seconds, by result.
+# TYPE orders_mesh_heartbeat_duration_seconds histogram
+orders_mesh_heartbeat_duration_seconds_bucket{result="ok",le="0.1"} 1
+orders_mesh_heartbeat_duration_seconds_bucket{result="ok",le="1"} 1
+orders_mesh_heartbeat_duration_seconds_bucket{result="ok",le="+Inf"} 1
+orders_mesh_heartbeat_duration_seconds_sum{result="ok"} 0.05
+orders_mesh_heartbeat_duration_seconds_count{result="ok"} 1
+# HELP orders_mesh_registered 1 while the instance is registered with Discovery, else 0.
+# TYPE orders_mesh_registered gauge
+orders_mesh_registered 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSink_SharedRegisterer(t *testing.T) {
+	reg := prom.NewRegistry()
+	a, b := New(WithRegisterer(reg)), New(WithRegisterer(reg))
+
+	a.IncCounter(runtime.MetricHeartbeats, map[string]string{"result": "ok"})
+	b.IncCounter(runtime.MetricHeartbeats, map[string]string{"result": "ok"})
+
+	if n := testutil.ToFloat64(a.counters[runtime.MetricHeartbeats]); n != 2 {
+		t.Fatalf("heartbeats = %v, want 2 from both sinks", n)
+	}
+}
@@ -0,0 +1,116 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+)
+
+// NewReverseProxy returns a reverse proxy that forwards each request to an
+// instance of serviceName, resolved through Discovery and selected by the
+// client's load balancing strategy. Instances are re-resolved per request,
+// so instances that leave the mesh stop receiving traffic. Resolution and
+// upstream failures produce a 502 Bad Gateway. Failed idempotent requests
+// are retried as configured by ClientOptions.MaxRetries and RetryBudget.
+//
+// The proxy owns a Client, and its Discovery connection, that can never be
+// closed.
+//
+// Deprecated: Create a Client with NewClient and use Client.ReverseProxy,
+// closing the Client when done.
+func NewReverseProxy(serviceName string, opts ...ClientOption) (*httputil.ReverseProxy, error) {
+	c, err := NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.ReverseProxy(serviceName), nil
+}
+
+// ReverseProxy returns a reverse proxy to serviceName backed by c.
+// See NewReverseProxy.
+func (c *Client) ReverseProxy(serviceName string) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// The real target is chosen per attempt by meshTransport.
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = serviceName
+			pr.SetXForwarded()
+		},
+		Transport: &meshTransport{
+			client:  c,
+			service: serviceName,
+			base:    http.DefaultTransport,
+		},
+	}
+}
+
+// meshTransport is an http.RoundTripper that points each request at a
+// freshly picked instance before handing it to a pooled base transport.
+type meshTransport struct {
+	client  *Client
+	service string
+	base    http.RoundTripper
+}
+
+func (t *meshTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		// Each attempt starts from a fresh clone, so modifiers that set
+		// per-call state (short-lived tokens, attempt headers) run again.
+		out := req.Clone(req.Context())
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			out.Body = body
+		}
+		for _, modify := range t.client.opts.RequestModifiers {
+			if err := modify(out.Context(), out); err != nil {
+				return nil, fmt.Errorf("runtime: request to %s: %w", t.service, err)
+			}
+		}
+
+		inst, err := t.client.Pick(req.Context(), t.service)
+		if err != nil {
+			return nil, err
+		}
+
+		out.URL.Scheme = inst.scheme()
+		out.URL.Host = inst.HostPort()
+		out.Host = ""
+
+		resp, err := t.base.RoundTrip(out)
+		outcome := err
+		if err == nil && isGatewayError(resp.StatusCode) {
+			outcome = fmt.Errorf("upstream status %d", resp.StatusCode)
+		}
+		// A call the caller gave up on says nothing about the instance.
+		if req.Context().Err() == nil {
+			t.client.ReportResult(t.service, inst, outcome)
+		}
+		if outcome == nil {
+			t.client.retries.deposit()
+			return resp, nil
+		}
+
+		if attempt >= t.client.opts.MaxRetries || !retryable(req) || req.Context().Err() != nil ||
+			!t.client.retries.withdraw() {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+}
+
+// isGatewayError reports whether code suggests the instance itself is
+// failing rather than rejecting the request.
+func isGatewayError(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,298 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+)
+
+func TestReverseProxy_ForwardsToRegisteredService(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	backend, err := New(
+		WithServiceName("backend"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.HandleFunc("GET /hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from backend"))
+	})
+	_, stopBackend := runService(t, backend)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	proxy, err := NewReverseProxy("backend", WithClientDiscoveryAddress(fd.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from backend" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+
+	// Once the backend deregisters, the proxy re-resolves and finds nothing.
+	stopBackend()
+	resp, err = http.Get(front.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 after backend left, got %d", resp.StatusCode)
+	}
+}
+
+type tenantKey struct{}
+
+func TestReverseProxy_RequestModifier(t *testing.T) {
+	fd := startFakeDiscovery(t)
+
+	backend, err := New(
+		WithServiceName("backend"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hits atomic.Int32
+	backend.HandleFunc("GET /tenant", func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(r.Header.Get("X-Tenant")))
+	})
+	runService(t, backend)
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	c, err := NewClient(
+		WithClientDiscoveryAddress(fd.addr),
+		WithClientRequestModifier(func(ctx context.Context, req *http.Request) error {
+			tenant, _ := ctx.Value(tenantKey{}).(string)
+			if tenant == "" {
+				return errors.New("no tenant")
+			}
+			req.Header.Set("X-Tenant", tenant)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	proxy := c.ReverseProxy("backend")
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+			r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant))
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantBody string
+		wantHits int32
+	}{
+		{name: "header added", query: "?tenant=acme", wantCode: http.StatusOK, wantBody: "acme", wantHits: 1},
+		{name: "error aborts", query: "", wantCode: http.StatusBadGateway, wantHits: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(front.URL + "/tenant" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Fatalf("body = %q, want %q", body, tt.wantBody)
+			}
+			if n := hits.Load(); n != tt.wantHits {
+				t.Fatalf("backend hits = %d, want %d", n, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestReverseProxy_RequestModifierPerAttempt(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("X-Attempt"))
+		n := len(seen)
+		mu.Unlock()
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	fd := startFakeDiscovery(t)
+	fd.addInstance(&pb.ServiceInstance{ServiceName: "flaky", ServiceId: "flaky-1", Address: host,
+		Port: int32(portNum), Status: pb.HealthStatus_HEALTH_STATUS_HEALTHY})
+
+	var calls atomic.Int32
+	c, err := NewClient(
+		WithClientDiscoveryAddress(fd.addr),
+		WithClientRetries(2),
+		WithClientRequestModifier(func(_ context.Context, req *http.Request) error {
+			req.Header.Add("X-Attempt", strconv.Itoa(int(calls.Add(1))))
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	front := httptest.NewServer(c.ReverseProxy("flaky"))
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after retries", resp.StatusCode)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"1", "2", "3"}; !slices.Equal(seen, want) {
+		t.Fatalf("X-Attempt per call = %q, want %q", seen, want)
+	}
+}
+
+func TestReverseProxy_RetryBudget(t *testing.T) {
+	var hits atomic.Int32
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	fd := startFakeDiscovery(t)
+	fd.addInstance(&pb.ServiceInstance{ServiceName: "flaky", ServiceId: "flaky-1", Address: host,
+		Port: int32(portNum), Status: pb.HealthStatus_HEALTH_STATUS_HEALTHY})
+
+	tests := []struct {
+		name     string
+		budget   float64
+		wantHits int32 // for 20 failing requests with 3 retries each
+	}{
+		{name: "unlimited", budget: 0, wantHits: 20 * 4},
+		{name: "budgeted", budget: 0.1, wantHits: 20 + retryBudgetCap},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(
+				WithClientDiscoveryAddress(fd.addr),
+				WithClientRetries(3),
+				WithRetryBudget(tt.budget),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			front := httptest.NewServer(c.ReverseProxy("flaky"))
+			defer front.Close()
+
+			send := func(n int) int32 {
+				hits.Store(0)
+				for range n {
+					resp, err := http.Get(front.URL + "/")
+					if err != nil {
+						t.Fatal(err)
+					}
+					resp.Body.Close()
+				}
+				return hits.Load()
+			}
+
+			failing.Store(true)
+			if got := send(20); got != tt.wantHits {
+				t.Fatalf("backend hits = %d, want %d", got, tt.wantHits)
+			}
+			if tt.budget == 0 {
+				return
+			}
+
+			// 20 successes earn two retries back.
+			failing.Store(false)
+			send(20)
+			failing.Store(true)
+			if got := send(5); got != 5+2 {
+				t.Fatalf("backend hits after refill = %d, want 7", got)
+			}
+		})
+	}
+}
+
+func TestReverseProxy_CanceledCallNotReported(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	fd := startFakeDiscovery(t)
+	fd.addInstance(&pb.ServiceInstance{ServiceName: "slow", ServiceId: "slow-1", Address: host,
+		Port: int32(portNum), Status: pb.HealthStatus_HEALTH_STATUS_HEALTHY})
+
+	outliers := NewOutlierDetector(1, time.Minute)
+	c, err := NewClient(
+		WithClientDiscoveryAddress(fd.addr),
+		WithClientOutlierDetector(outliers),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The caller gives up; that is not the instance's fault.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	c.ReverseProxy("slow").ServeHTTP(httptest.NewRecorder(), req)
+
+	if !outliers.Healthy("slow", Instance{ServiceID: "slow-1"}) {
+		t.Fatal("instance ejected for a canceled call")
+	}
+}
@@ -0,0 +1,251 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Registrar performs the membership operations of a service: announcing
+// the instance, renewing it while it runs, and withdrawing it. The default
+// registrar talks to ToskaMesh Discovery over gRPC; WithRegistrar plugs in
+// another registry.
+//
+// The runtime serializes Register and Deregister calls but may call
+// Heartbeat concurrently with them. Register may be called again while the
+// instance is registered, e.g. to publish a new weight, and should replace
+// the existing entry. Deregister should treat an unknown instance as
+// success.
+type Registrar interface {
+	Register(ctx context.Context, reg Registration) error
+	Heartbeat(ctx context.Context, hb Heartbeat) error
+	Deregister(ctx context.Context, serviceID string) error
+}
+
+// Registration describes the instance being registered.
+type Registration struct {
+	ServiceName string
+	ServiceID   string
+	Address     string
+	Port        int
+	Metadata    map[string]string // includes the routing keys (scheme, weight, ...)
+	HealthCheck HealthCheck
+}
+
+// HealthCheck describes how the registry should probe the instance.
+type HealthCheck struct {
+	Endpoint           string // path on the instance
+	Port               int    // 0 = the registered port
+	Interval           time.Duration
+	Timeout            time.Duration
+	UnhealthyThreshold int
+}
+
+// HealthStatus is the health reported in a Heartbeat.
+type HealthStatus string
+
+const (
+	StatusHealthy   HealthStatus = "healthy"
+	StatusDegraded  HealthStatus = "degraded"  // lame duck or shutting down
+	StatusUnhealthy HealthStatus = "unhealthy" // marked with MarkUnhealthy
+)
+
+// Heartbeat is a periodic health report.
+type Heartbeat struct {
+	ServiceID string
+	Status    HealthStatus
+	Output    string // human-readable detail, e.g. the unhealthy reason
+}
+
+// NoopRegistrar registers nowhere. Use it with WithRegistrar when another
+// layer, such as a service mesh sidecar or Kubernetes Endpoints, already
+// tracks membership: the HTTP server and health endpoints run as usual,
+// but no Discovery connection is attempted.
+type NoopRegistrar struct{}
+
+func (NoopRegistrar) Register(context.Context, Registration) error { return nil }
+func (NoopRegistrar) Heartbeat(context.Context, Heartbeat) error   { return nil }
+func (NoopRegistrar) Deregister(context.Context, string) error     { return nil }
+
+// registration returns the Registration for the instance as currently
+// configured.
+func (s *MeshService) registration() Registration {
+	return Registration{
+		ServiceName: s.opts.ServiceName,
+		ServiceID:   s.opts.ServiceID,
+		Address:     s.advertisedAddr,
+		Port:        s.advertisedPort,
+		Metadata:    s.buildMetadata(),
+		HealthCheck: HealthCheck{
+			Endpoint:           s.opts.ProbePath,
+			Port:               s.opts.ProbePort,
+			Interval:           s.opts.ProbeInterval,
+			Timeout:            s.opts.ProbeTimeout,
+			UnhealthyThreshold: s.opts.UnhealthyThreshold,
+		},
+	}
+}
+
+// maybeApplied reports whether a failed call may nonetheless have taken
+// effect: it was cancelled or timed out rather than refused.
+func maybeApplied(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	code := status.Code(err)
+	return code == codes.Canceled || code == codes.DeadlineExceeded
+}
+
+// discoveryRegistrar is the default Registrar, backed by the Discovery
+// gRPC API.
+type discoveryRegistrar struct {
+	client pb.DiscoveryRegistryClient
+
+	// beforeRegister is ServiceOptions.BeforeRegister.
+	beforeRegister func(*pb.RegisterServiceRequest)
+	// onLeaseTTL receives a lease TTL announced in the Register response.
+	onLeaseTTL func(time.Duration)
+}
+
+func (d *discoveryRegistrar) Register(ctx context.Context, reg Registration) error {
+	req := &pb.RegisterServiceRequest{
+		ServiceName: reg.ServiceName,
+		ServiceId:   reg.ServiceID,
+		Address:     reg.Address,
+		Port:        int32(reg.Port),
+		Metadata:    reg.Metadata,
+		HealthCheck: &pb.HealthCheckConfig{
+			Endpoint:           probeEndpoint(reg),
+			IntervalSeconds:    int32(reg.HealthCheck.Interval.Seconds()),
+			TimeoutSeconds:     int32(reg.HealthCheck.Timeout.Seconds()),
+			UnhealthyThreshold: int32(reg.HealthCheck.UnhealthyThreshold),
+		},
+	}
+	if d.beforeRegister != nil {
+		d.beforeRegister(req)
+	}
+
+	var header metadata.MD
+	resp, err := d.client.Register(ctx, req, grpc.Header(&header))
+	if err != nil {
+		return fmt.Errorf("gRPC Register: %w", err)
+	}
+	if !resp.Success {
+		return &rejectionError{reason: rejectionReason(resp.ErrorMessage), message: resp.ErrorMessage}
+	}
+	if ttl, ok := parseLeaseTTL(header.Get(LeaseTTLHeader)); ok && d.onLeaseTTL != nil {
+		d.onLeaseTTL(ttl)
+	}
+	return nil
+}
+
+// Errors for a registration Discovery refused. Errors from Reregister, and
+// those logged by automatic registration, match ErrRegistrationRejected
+// and, when Discovery gave a recognized reason, one of the others, so
+// callers can react, e.g. pick a new ID after ErrDuplicateServiceID.
+var (
+	ErrRegistrationRejected = errors.New("runtime: registration rejected")
+	ErrDuplicateServiceID   = errors.New("runtime: duplicate service ID")
+	ErrInvalidMetadata      = errors.New("runtime: invalid metadata")
+	ErrQuotaExceeded        = errors.New("runtime: registration quota exceeded")
+)
+
+// rejectionError is a registration refused by Discovery.
+type rejectionError struct {
+	reason  error // nil if the message was not recognized
+	message string
+}
+
+func (e *rejectionError) Error() string { return "registration rejected: " + e.message }
+
+func (e *rejectionError) Unwrap() []error {
+	if e.reason == nil {
+		return []error{ErrRegistrationRejected}
+	}
+	return []error{ErrRegistrationRejected, e.reason}
+}
+
+// rejectionPrefixes maps the start of Discovery's ErrorMessage to a reason.
+// The response has no code field, so the message is all there is to go on.
+var rejectionPrefixes = []struct {
+	prefix string
+	reason error
+}{
+	{"duplicate id", ErrDuplicateServiceID},
+	{"duplicate service id", ErrDuplicateServiceID},
+	{"duplicate serviceid", ErrDuplicateServiceID},
+	{"service id already registered", ErrDuplicateServiceID},
+	{"invalid metadata", ErrInvalidMetadata},
+	{"metadata too large", ErrInvalidMetadata},
+	{"quota exceeded", ErrQuotaExceeded},
+	{"too many instances", ErrQuotaExceeded},
+}
+
+// rejectionReason returns the reason for a rejection message, matched
+// case-insensitively, or nil if it is not recognized.
+func rejectionReason(message string) error {
+	m := strings.ToLower(strings.TrimSpace(message))
+	for _, p := range rejectionPrefixes {
+		if strings.HasPrefix(m, p.prefix) {
+			return p.reason
+		}
+	}
+	return nil
+}
+
+// probeEndpoint returns the HealthCheckConfig endpoint for reg. The config
+// has no port field, so a probe port other than the registered one is
+// sent as a full URL.
+func probeEndpoint(reg Registration) string {
+	hc := reg.HealthCheck
+	if hc.Port == 0 || hc.Port == reg.Port {
+		return hc.Endpoint
+	}
+	scheme := reg.Metadata["scheme"]
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + net.JoinHostPort(reg.Address, strconv.Itoa(hc.Port)) + hc.Endpoint
+}
+
+func (d *discoveryRegistrar) Heartbeat(ctx context.Context, hb Heartbeat) error {
+	st := pb.HealthStatus_HEALTH_STATUS_HEALTHY
+	switch hb.Status {
+	case StatusDegraded:
+		st = pb.HealthStatus_HEALTH_STATUS_DEGRADED
+	case StatusUnhealthy:
+		st = pb.HealthStatus_HEALTH_STATUS_UNHEALTHY
+	}
+
+	resp, err := d.client.ReportHealth(ctx, &pb.ReportHealthRequest{
+		ServiceId: hb.ServiceID,
+		Status:    st,
+		Output:    hb.Output,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.GetSuccess() {
+		return errors.New("rejected by discovery")
+	}
+	return nil
+}
+
+func (d *discoveryRegistrar) Deregister(ctx context.Context, serviceID string) error {
+	_, err := d.client.Deregister(ctx, &pb.DeregisterServiceRequest{ServiceId: serviceID})
+	if status.Code(err) == codes.NotFound {
+		// Already gone, e.g. expired or removed by an earlier attempt.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc"
+)
+
+// recordingRegistrar is an in-memory Registrar that records each call.
+type recordingRegistrar struct {
+	mu     sync.Mutex
+	events []string
+	regs   []Registration
+}
+
+func (r *recordingRegistrar) Register(_ context.Context, reg Registration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "register")
+	r.regs = append(r.regs, reg)
+	return nil
+}
+
+func (r *recordingRegistrar) Heartbeat(_ context.Context, hb Heartbeat) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "heartbeat "+string(hb.Status))
+	return nil
+}
+
+func (r *recordingRegistrar) Deregister(_ context.Context, serviceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "deregister "+serviceID)
+	return nil
+}
+
+func (r *recordingRegistrar) Events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func TestRegistrar_Lifecycle(t *testing.T) {
+	reg := &recordingRegistrar{}
+	svc, err := New(
+		WithServiceName("custom"),
+		WithServiceID("custom-1"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithHealthInterval(20*time.Millisecond),
+		WithHealthTimeout(10*time.Millisecond),
+		WithRegistrar(reg),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, stop := runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return len(reg.Events()) >= 2 })
+
+	if len(svc.discoveryConns) != 0 {
+		t.Fatal("dialed Discovery despite a custom registrar")
+	}
+	if ev := reg.Events(); ev[0] != "register" || ev[1] != "heartbeat healthy" {
+		t.Fatalf("events while running = %v, want register then heartbeats", ev)
+	}
+
+	_, port, _ := net.SplitHostPort(addr)
+	reg.mu.Lock()
+	got := reg.regs[0]
+	reg.mu.Unlock()
+	if got.ServiceID != "custom-1" || strconv.Itoa(got.Port) != port || got.Metadata["scheme"] != "http" {
+		t.Fatalf("registration = %+v", got)
+	}
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	ev := reg.Events()
+	if n := len(ev); n < 2 || ev[n-2] != "heartbeat degraded" || ev[n-1] != "deregister custom-1" {
+		t.Fatalf("events at shutdown = %v, want degraded heartbeat then deregister", ev)
+	}
+}
+
+func TestNoDiscovery_NeverDials(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "NoopRegistrar", opts: []Option{WithRegistrar(NoopRegistrar{})}},
+		{name: "registration and heartbeats off", opts: []Option{WithAutoRegister(false), WithHeartbeat(false)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Stands in for Discovery; any connection to it is a dial.
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			dialed := make(chan struct{}, 1)
+			go func() {
+				if c, err := ln.Accept(); err == nil {
+					c.Close()
+					dialed <- struct{}{}
+				}
+			}()
+
+			svc, err := New(append([]Option{
+				WithServiceName("sidecar"),
+				WithAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(ln.Addr().String()),
+				WithHealthInterval(20 * time.Millisecond),
+				WithHealthTimeout(10 * time.Millisecond),
+			}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			addr, _ := runService(t, svc)
+			resp, err := http.Get("http://" + addr + "/health")
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("health = %d, want 200", resp.StatusCode)
+			}
+
+			select {
+			case <-dialed:
+				t.Fatal("dialed Discovery")
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+// rejectingClient is a Discovery client whose Register always answers
+// Success: false with message.
+type rejectingClient struct {
+	pb.DiscoveryRegistryClient
+	message string
+}
+
+func (c rejectingClient) Register(context.Context, *pb.RegisterServiceRequest, ...grpc.CallOption) (*pb.RegisterServiceResponse, error) {
+	return &pb.RegisterServiceResponse{ErrorMessage: c.message}, nil
+}
+
+func TestDiscoveryRegistrar_Rejection(t *testing.T) {
+	tests := []struct {
+		message string
+		want    error // nil = no specific reason
+	}{
+		{message: "duplicate id: orders-1 is taken", want: ErrDuplicateServiceID},
+		{message: "Duplicate Service ID orders-1", want: ErrDuplicateServiceID},
+		{message: "invalid metadata: key too long", want: ErrInvalidMetadata},
+		{message: "quota exceeded for orders", want: ErrQuotaExceeded},
+		{message: "maintenance window"},
+	}
+
+	reasons := []error{ErrDuplicateServiceID, ErrInvalidMetadata, ErrQuotaExceeded}
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			d := &discoveryRegistrar{client: rejectingClient{message: tt.message}}
+			err := d.Register(context.Background(), Registration{ServiceName: "orders", ServiceID: "orders-1"})
+			if !errors.Is(err, ErrRegistrationRejected) {
+				t.Fatalf("err = %v, want ErrRegistrationRejected", err)
+			}
+			if !strings.Contains(err.Error(), tt.message) {
+				t.Fatalf("err = %q, want it to include %q", err, tt.message)
+			}
+			for _, reason := range reasons {
+				if got := errors.Is(err, reason); got != (reason == tt.want) {
+					t.Fatalf("errors.Is(err, %v) = %v", reason, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+)
+
+// reload re-runs the ConfigReload loader, applies the reloadable options,
+// and re-registers so Discovery sees the new metadata and weight.
+func (s *MeshService) reload(ctx context.Context) error {
+	opts, err := s.opts.ConfigReload()
+	if err != nil {
+		return fmt.Errorf("runtime: reload: %w", err)
+	}
+
+	// Options may modify maps in place, so give them copies.
+	next := s.Options()
+	for _, fn := range opts {
+		fn(&next)
+	}
+	if next.Metadata == nil {
+		next.Metadata = make(map[string]string)
+	}
+	if err := readMetadataFiles(next.MetadataFiles, next.Metadata); err != nil {
+		return fmt.Errorf("runtime: reload: %w", err)
+	}
+
+	for name, changed := range map[string]bool{
+		"ServiceName":      next.ServiceName != s.opts.ServiceName,
+		"ServiceID":        next.ServiceID != s.opts.ServiceID,
+		"Network":          next.Network != s.opts.Network,
+		"Address":          next.Address != s.opts.Address,
+		"Port":             next.Port != s.opts.Port,
+		"DiscoveryAddress": next.DiscoveryAddress != s.opts.DiscoveryAddress,
+	} {
+		if changed {
+			s.logger.Warn("option cannot be reloaded; ignoring", "option", name)
+		}
+	}
+
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+	s.optsMu.Lock()
+	prev := s.opts
+	s.opts.Metadata = next.Metadata
+	s.opts.MetadataFiles = next.MetadataFiles
+	s.opts.Routing.Weight = next.Routing.Weight
+	s.opts.LogLevel = next.LogLevel
+	s.optsMu.Unlock()
+
+	// The size check may call user callbacks (DynamicWeight,
+	// CapacityReporter), so it runs without optsMu.
+	if err := s.checkMetadataSize(); err != nil {
+		s.optsMu.Lock()
+		s.opts.Metadata = prev.Metadata
+		s.opts.MetadataFiles = prev.MetadataFiles
+		s.opts.Routing.Weight = prev.Routing.Weight
+		s.opts.LogLevel = prev.LogLevel
+		s.optsMu.Unlock()
+		return fmt.Errorf("runtime: reload: %w", err)
+	}
+	s.logLevel.Set(next.LogLevel)
+	s.logger.Info("config reloaded", "service", s.opts.ServiceName)
+
+	r := s.currentRegistrar()
+	if r == nil || !s.registered.Load() || s.withdrawn.Load() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.opts.HeartbeatTimeout)
+	defer cancel()
+	if err := s.registerLocked(ctx, r); err != nil {
+		return fmt.Errorf("runtime: reload: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package runtime
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConfigReload_SIGHUP(t *testing.T) {
+	// Capture the channel Run subscribes, so the test can deliver signals
+	// without signalling the test process.
+	sigs := make(chan chan<- os.Signal, 1)
+	orig := notifySignals
+	notifySignals = func(c chan<- os.Signal, _ ...os.Signal) { sigs <- c }
+	defer func() { notifySignals = orig }()
+
+	fd := startFakeDiscovery(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var logs syncBuffer
+	svc, err := New(
+		WithServiceName("reloadable"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHeartbeat(false),
+		WithMetadata("version", "1"),
+		WithMetadataFromFile("token", tokenFile),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithConfigReload(func() ([]Option, error) {
+			return []Option{
+				WithMetadata("version", "2"),
+				WithRoutingWeight(7),
+				WithPort(9999),
+			}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- svc.Run(ctx) }()
+	sigCh := <-sigs
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 1 })
+
+	if err := os.WriteFile(tokenFile, []byte("new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sigCh <- syscall.SIGHUP
+	waitFor(t, 2*time.Second, func() bool { return len(fd.Registers()) == 2 })
+
+	md := fd.Registers()[1].Metadata
+	if md["version"] != "2" || md["weight"] != "7" {
+		t.Fatalf("re-registered with version=%q weight=%q, want 2 and 7", md["version"], md["weight"])
+	}
+	if md["token"] != "new" {
+		t.Fatalf("metadata file not re-read: token = %q", md["token"])
+	}
+	if !strings.Contains(logs.String(), "option=Port") {
+		t.Fatalf("port change not warned about:\n%s", logs.String())
+	}
+	if svc.Addr() == "" || strings.HasSuffix(svc.Addr(), ":9999") {
+		t.Fatalf("port changed on reload: %s", svc.Addr())
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigReload_MetadataLimit(t *testing.T) {
+	svc, err := New(
+		WithServiceName("bounded"),
+		WithMaxMetadataBytes(512),
+		WithMetadata("version", "1"),
+		WithConfigReload(func() ([]Option, error) {
+			return []Option{WithMetadata("blob", strings.Repeat("x", 600)), WithRoutingWeight(7)}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.reload(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "blob (604 bytes)") {
+		t.Fatalf("reload = %v, want the oversized key named", err)
+	}
+	if _, ok := svc.opts.Metadata["blob"]; ok || svc.opts.Routing.Weight == 7 {
+		t.Fatalf("rejected reload was applied: metadata %v, weight %d", svc.opts.Metadata, svc.opts.Routing.Weight)
+	}
+}
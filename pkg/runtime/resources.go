@@ -0,0 +1,48 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// errUnsupported is returned by resource probes on platforms that lack
+// them. The checks built on them then always pass.
+var errUnsupported = errors.New("not supported on this platform")
+
+// DiskSpaceCheck returns a HealthChecker that fails when the filesystem
+// holding path has less than minFreeBytes available to unprivileged users.
+// It always passes on platforms without statfs.
+func DiskSpaceCheck(path string, minFreeBytes uint64) HealthChecker {
+	return func(context.Context) error {
+		free, err := diskFree(path)
+		if errors.Is(err, errUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("disk space: %w", err)
+		}
+		if free < minFreeBytes {
+			return fmt.Errorf("disk space: %d bytes free on %s, need %d", free, path, minFreeBytes)
+		}
+		return nil
+	}
+}
+
+// MemoryCheck returns a HealthChecker that fails when the process's
+// resident memory exceeds maxRSSBytes. It always passes outside Linux.
+func MemoryCheck(maxRSSBytes uint64) HealthChecker {
+	return func(context.Context) error {
+		rss, err := residentMemory()
+		if errors.Is(err, errUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("memory: %w", err)
+		}
+		if rss > maxRSSBytes {
+			return fmt.Errorf("memory: resident set is %d bytes, limit %d", rss, maxRSSBytes)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,20 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+)
+
+// residentMemory returns the process's resident set size, read from
+// /proc/self/statm.
+func residentMemory() (uint64, error) {
+	b, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	var size, resident uint64
+	if _, err := fmt.Sscan(string(b), &size, &resident); err != nil {
+		return 0, fmt.Errorf("parse /proc/self/statm: %w", err)
+	}
+	return resident * uint64(os.Getpagesize()), nil
+}
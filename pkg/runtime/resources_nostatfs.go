@@ -0,0 +1,5 @@
+//go:build !(linux || darwin || freebsd)
+
+package runtime
+
+func diskFree(string) (uint64, error) { return 0, errUnsupported }
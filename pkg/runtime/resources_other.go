@@ -0,0 +1,5 @@
+//go:build !linux
+
+package runtime
+
+func residentMemory() (uint64, error) { return 0, errUnsupported }
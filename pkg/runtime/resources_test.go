@@ -0,0 +1,59 @@
+package runtime
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDiskSpaceCheck(t *testing.T) {
+	dir := t.TempDir()
+	free, err := diskFree(dir)
+	if err != nil {
+		t.Skipf("disk space not available: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		min     uint64
+		wantErr bool
+	}{
+		{name: "below available", min: 1},
+		{name: "above available", min: free + 1<<40, wantErr: true},
+		{name: "impossible", min: math.MaxUint64, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DiskSpaceCheck(dir, tt.min)(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DiskSpaceCheck(%d) = %v, wantErr %v", tt.min, err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), dir) {
+				t.Fatalf("error %q does not name the path", err)
+			}
+		})
+	}
+}
+
+func TestDiskSpaceCheck_MissingPath(t *testing.T) {
+	if _, err := diskFree(t.TempDir()); err != nil {
+		t.Skipf("disk space not available: %v", err)
+	}
+	if err := DiskSpaceCheck("/does/not/exist", 1)(context.Background()); err == nil {
+		t.Fatal("expected an error for a missing path")
+	}
+}
+
+func TestMemoryCheck(t *testing.T) {
+	if _, err := residentMemory(); err != nil {
+		t.Skipf("resident memory not available: %v", err)
+	}
+	if err := MemoryCheck(math.MaxUint64)(context.Background()); err != nil {
+		t.Fatalf("generous limit: %v", err)
+	}
+	if err := MemoryCheck(1)(context.Background()); err == nil {
+		t.Fatal("1-byte limit passed")
+	}
+}
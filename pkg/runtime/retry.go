@@ -0,0 +1,61 @@
+package runtime
+
+import (
+	"net/http"
+	"sync"
+)
+
+// retryBudgetCap is the most retries a budget can save up, and its balance
+// when new, so a quiet client can still retry a short burst of failures.
+const retryBudgetCap = 10
+
+// retryBudget caps retries at a fraction of successful requests, so a
+// widespread outage does not multiply load by the retry count. Each
+// success deposits ratio tokens, up to retryBudgetCap; each retry spends
+// one.
+type retryBudget struct {
+	ratio float64
+
+	mu      sync.Mutex
+	balance float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, balance: retryBudgetCap}
+}
+
+// deposit records a successful request.
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.balance = min(b.balance+b.ratio, retryBudgetCap)
+}
+
+// withdraw spends a token for a retry, reporting false if the budget is
+// spent. A nil budget is unlimited.
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// retryable reports whether req can be sent again: its method must be
+// idempotent and its body, if any, replayable.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
@@ -0,0 +1,149 @@
+package runtime
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+)
+
+// SelfTest runs the service once end to end and reports the first step
+// that fails: it starts the service, waits for registration, checks the
+// health endpoint over HTTP on the bound address, confirms Discovery lists
+// the instance, then stops it (deregistering on the way out). The
+// registration steps are skipped when AutoRegister is off, and the listing
+// check when a custom Registrar is used.
+//
+// Bound the whole run with ctx. The service cannot be started again
+// afterwards.
+func (s *MeshService) SelfTest(ctx context.Context) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start(runCtx) }()
+
+	if err := s.selfTestSteps(ctx, done); err != nil {
+		cancel()
+		<-done
+		return fmt.Errorf("runtime: self-test: %w", err)
+	}
+
+	if err := s.Stop(ctx); err != nil {
+		return fmt.Errorf("runtime: self-test: stop: %w", err)
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("runtime: self-test: %w", err)
+	}
+	if s.opts.AutoRegister && s.registered.Load() {
+		return fmt.Errorf("runtime: self-test: instance still registered after stop")
+	}
+	return nil
+}
+
+func (s *MeshService) selfTestSteps(ctx context.Context, done <-chan error) error {
+	// Wait for the listener, failing fast if Start gives up.
+	if err := selfTestWait(ctx, done, func() bool { return s.Addr() != "" }); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+
+	if s.opts.AutoRegister {
+		if err := selfTestWait(ctx, done, s.registered.Load); err != nil {
+			return fmt.Errorf("register: %w", err)
+		}
+	}
+
+	if err := s.selfTestHealth(ctx); err != nil {
+		return fmt.Errorf("health: %w", err)
+	}
+
+	if s.opts.AutoRegister && s.opts.Registrar == nil {
+		if err := s.selfTestListed(ctx); err != nil {
+			return fmt.Errorf("discovery: %w", err)
+		}
+	}
+	return nil
+}
+
+// selfTestWait polls cond until it holds, ctx ends, or Start returns.
+func selfTestWait(ctx context.Context, done <-chan error, cond func() bool) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-done:
+			if err == nil {
+				err = fmt.Errorf("service exited")
+			}
+			return err
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (s *MeshService) selfTestHealth(ctx context.Context) error {
+	host, port, err := net.SplitHostPort(s.Addr())
+	if err != nil {
+		return err
+	}
+	if isUnspecified(host) {
+		host = "127.0.0.1"
+		if s.opts.Network == "tcp6" {
+			host = "::1"
+		}
+	}
+
+	scheme, client := "http", http.DefaultClient
+	if s.opts.TLSConfig != nil {
+		// The loopback address is unlikely to be in the certificate, and
+		// the peer is this process, so verification adds nothing.
+		scheme = "https"
+		client = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		defer client.CloseIdleConnections()
+	}
+
+	url := scheme + "://" + net.JoinHostPort(host, port) + s.opts.HealthEndpoint
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *MeshService) selfTestListed(ctx context.Context) error {
+	client := s.discoveryClient()
+	if client == nil {
+		return ErrNotStarted
+	}
+	resp, err := client.GetInstances(ctx, &pb.GetInstancesRequest{ServiceName: s.opts.ServiceName})
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(resp.Instances, func(si *pb.ServiceInstance) bool {
+		return si.GetServiceId() == s.opts.ServiceID
+	}) {
+		return fmt.Errorf("instance %s not listed for %s", s.opts.ServiceID, s.opts.ServiceName)
+	}
+	return nil
+}
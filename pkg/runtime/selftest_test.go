@@ -0,0 +1,66 @@
+package runtime
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+)
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr string
+	}{
+		{name: "passes end to end"},
+		{
+			name: "instance not listed",
+			// Registers under a different ID, so the listing check misses.
+			opts: []Option{WithBeforeRegister(func(req *pb.RegisterServiceRequest) {
+				req.ServiceId = "someone-else"
+			})},
+			wantErr: "not listed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := startFakeDiscovery(t)
+			opts := append([]Option{
+				WithServiceName("smoke"),
+				WithAddress("0.0.0.0"),
+				WithAdvertisedAddress("127.0.0.1"),
+				WithPort(0),
+				WithDiscoveryAddress(fd.addr),
+				WithHeartbeat(false),
+			}, tt.opts...)
+			svc, err := New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = svc.SelfTest(ctx)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SelfTest = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SelfTest = %v", err)
+			}
+			if n := len(fd.Deregisters()); n != 1 {
+				t.Fatalf("expected 1 Deregister, got %d", n)
+			}
+			if svc.Addr() == "" {
+				t.Fatal("service never bound")
+			}
+		})
+	}
+}
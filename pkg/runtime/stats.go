@@ -0,0 +1,100 @@
+package runtime
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StatsSink receives the runtime's metrics, so they can be fed to any
+// metrics system without the runtime depending on one. Metric names are the
+// Metric* constants. Implementations must be safe for concurrent use and
+// should not block. The prometheus subpackage provides one for the
+// Prometheus client library.
+type StatsSink interface {
+	IncCounter(name string, labels map[string]string)
+	ObserveHistogram(name string, value float64, labels map[string]string)
+	SetGauge(name string, value float64, labels map[string]string)
+}
+
+// Metrics reported to a StatsSink.
+const (
+	MetricHTTPRequests        = "http_requests_total"             // counter; labels: method, code
+	MetricHTTPRequestDuration = "http_request_duration_seconds"   // histogram; labels: method, code
+	MetricHeartbeats          = "mesh_heartbeats_total"           // counter; labels: result ("ok" or "error")
+	MetricHeartbeatDuration   = "mesh_heartbeat_duration_seconds" // histogram; labels: result
+	MetricRegistrations       = "mesh_registrations_total"        // counter; labels: result
+	MetricRegistered          = "mesh_registered"                 // gauge; 1 while registered, else 0
+)
+
+// noopStats is the StatsSink used when none is configured.
+type noopStats struct{}
+
+func (noopStats) IncCounter(string, map[string]string)                {}
+func (noopStats) ObserveHistogram(string, float64, map[string]string) {}
+func (noopStats) SetGauge(string, float64, map[string]string)         {}
+
+// resultLabel returns the "result" label for an outcome.
+func resultLabel(err error) map[string]string {
+	if err != nil {
+		return map[string]string{"result": "error"}
+	}
+	return map[string]string{"result": "ok"}
+}
+
+// countRequests reports each request's count and latency to the sink.
+func countRequests(sink StatsSink) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+
+			code := sw.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			labels := map[string]string{"method": r.Method, "code": strconv.Itoa(code)}
+			sink.IncCounter(MetricHTTPRequests, labels)
+			sink.ObserveHistogram(MetricHTTPRequestDuration, time.Since(start).Seconds(), labels)
+		})
+	}
+}
+
+// statusWriter records the response status.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 && code >= 200 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Flush() {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return http.NewResponseController(sw.ResponseWriter).Hijack()
+}
@@ -0,0 +1,113 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/toska-mesh/toska-mesh-go/pkg/meshpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordingSink is a StatsSink that records calls as "kind name{labels}".
+type recordingSink struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recordingSink) record(kind, name string, labels map[string]string) {
+	var parts []string
+	for k, v := range labels {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, fmt.Sprintf("%s %s{%s}", kind, name, strings.Join(parts, ",")))
+}
+
+func (r *recordingSink) IncCounter(name string, labels map[string]string) {
+	r.record("inc", name, labels)
+}
+
+func (r *recordingSink) ObserveHistogram(name string, _ float64, labels map[string]string) {
+	r.record("observe", name, labels)
+}
+
+func (r *recordingSink) SetGauge(name string, v float64, labels map[string]string) {
+	r.record(fmt.Sprintf("gauge=%g", v), name, labels)
+}
+
+func (r *recordingSink) Calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+func (r *recordingSink) has(call string) bool {
+	return slices.Contains(r.Calls(), call)
+}
+
+func TestStats_Request(t *testing.T) {
+	sink := &recordingSink{}
+	svc, err := New(WithServiceName("stats"), WithStatsSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	svc.handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/orders", nil))
+
+	for _, want := range []string{
+		"inc http_requests_total{code=201,method=POST}",
+		"observe http_request_duration_seconds{code=201,method=POST}",
+	} {
+		if !sink.has(want) {
+			t.Fatalf("missing %q in %v", want, sink.Calls())
+		}
+	}
+}
+
+func TestStats_Heartbeat(t *testing.T) {
+	fd := startFakeDiscovery(t)
+	fd.reportHook = func(context.Context, *pb.ReportHealthRequest) error {
+		return status.Error(codes.Unavailable, "down")
+	}
+
+	sink := &recordingSink{}
+	svc, err := New(
+		WithServiceName("stats"),
+		WithAddress("127.0.0.1"),
+		WithPort(0),
+		WithDiscoveryAddress(fd.addr),
+		WithHealthInterval(20*time.Millisecond),
+		WithHealthTimeout(10*time.Millisecond),
+		WithStatsSink(sink),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runService(t, svc)
+	waitFor(t, 2*time.Second, func() bool { return sink.has("observe mesh_heartbeat_duration_seconds{result=error}") })
+
+	for _, want := range []string{
+		"inc mesh_heartbeats_total{result=error}",
+		"inc mesh_registrations_total{result=ok}",
+		"gauge=1 mesh_registered{}",
+	} {
+		if !sink.has(want) {
+			t.Fatalf("missing %q in %v", want, sink.Calls())
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package runtime
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// withTimeout bounds how long next may take to start responding. The
+// request context carries the deadline. If it expires before next has
+// written anything, the client gets a 503 error envelope and further writes fail with
+// http.ErrHandlerTimeout. A handler that has already started streaming is
+// left to finish and should stop when its context is cancelled.
+//
+// Unlike http.TimeoutHandler the response is not buffered, so Flush works.
+func withTimeout(d time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{w: w, h: w.Header().Clone(), ctx: ctx}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case p := <-panicked:
+			panic(p)
+		case <-ctx.Done():
+			tw.mu.Lock()
+			streaming := tw.wroteHeader
+			if !streaming {
+				tw.timedOut = true
+			}
+			tw.mu.Unlock()
+			if streaming {
+				// We cannot change the status any more; let it finish.
+				select {
+				case <-done:
+				case p := <-panicked:
+					panic(p)
+				}
+			}
+		}
+
+		tw.mu.Lock()
+		timedOut := tw.timedOut
+		tw.mu.Unlock()
+		if timedOut {
+			WriteError(w, http.StatusServiceUnavailable, "timeout", "request timed out")
+		}
+	})
+}
+
+// timeoutWriter forwards writes to w until the route times out. The handler
+// gets its own header map, copied to w when it starts responding, so a
+// timeout response never races with a late Header().Set.
+type timeoutWriter struct {
+	w   http.ResponseWriter
+	h   http.Header
+	ctx context.Context
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.h }
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expiredLocked() || tw.wroteHeader {
+		return
+	}
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expiredLocked() {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	return tw.w.Write(p)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expiredLocked() {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	http.NewResponseController(tw.w).Flush()
+}
+
+// expiredLocked reports whether the handler may no longer respond: the
+// deadline passed before it wrote anything.
+func (tw *timeoutWriter) expiredLocked() bool {
+	if !tw.wroteHeader && tw.ctx.Err() != nil {
+		tw.timedOut = true
+	}
+	return tw.timedOut
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for k, v := range tw.h {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(code)
+}
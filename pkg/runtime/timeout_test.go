@@ -0,0 +1,61 @@
+package runtime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteTimeout(t *testing.T) {
+	svc, err := New(
+		WithServiceName("timeouts"),
+		WithRouteTimeout("GET /slow", 50*time.Millisecond),
+		WithRouteTimeout("GET /fast", time.Second),
+		WithRouteTimeout("GET /stream", 50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.Write([]byte("too late"))
+	})
+	svc.HandleFunc("GET /fast", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Fast", "yes")
+		w.Write([]byte("ok"))
+	})
+	svc.HandleFunc("GET /stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		w.Write([]byte("last"))
+	})
+	h := svc.handler()
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{path: "/slow", wantCode: http.StatusServiceUnavailable, wantBody: `"code":"timeout"`},
+		{path: "/fast", wantCode: http.StatusOK, wantBody: "ok"},
+		// Already streaming when the deadline hits: the status stands and
+		// the handler finishes on its own.
+		{path: "/stream", wantCode: http.StatusOK, wantBody: "first last"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.TrimPrefix(tt.path, "/"), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Body.String(); !strings.Contains(got, tt.wantBody) {
+				t.Fatalf("body = %q, want it to contain %q", got, tt.wantBody)
+			}
+		})
+	}
+}